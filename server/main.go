@@ -2,180 +2,73 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
+	"ivar/pkg/attachment"
+	"ivar/pkg/auth"
 	"ivar/pkg/chat"
 	"ivar/pkg/controller"
 	"ivar/pkg/database"
-	"ivar/pkg/models"
+	"ivar/pkg/gateway"
+	"ivar/pkg/presence"
+	"ivar/pkg/search"
 	"ivar/pkg/server"
 	"ivar/pkg/user"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
-	"github.com/gorilla/websocket"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-type Manager struct {
-	Clients     map[*Client]bool
-	Broadcast   chan []byte
-	Register    chan *Client
-	Unregister  chan *Client
-	ChatService *chat.Service
-}
-
-var manager = Manager{
-	Broadcast:  make(chan []byte),
-	Register:   make(chan *Client),
-	Unregister: make(chan *Client),
-	Clients:    make(map[*Client]bool),
-}
-
-func (m *Manager) Start() {
-	for {
-		select {
-		case conn := <-m.Register:
-			m.Clients[conn] = true
-		case conn := <-m.Unregister:
-			if _, ok := m.Clients[conn]; ok {
-				close(conn.Send)
-				delete(m.Clients, conn)
-			}
-		case msg := <-m.Broadcast:
-			var jsonMsg models.Message
-			if err := json.Unmarshal(msg, &jsonMsg); err != nil {
-				log.Println("error converting message to correct format: " + err.Error())
-				return
-			}
-			if jsonMsg.Recipient != "" {
-				if err := m.ChatService.AddMessage(jsonMsg); err != nil {
-					log.Println("error adding message: " + err.Error())
-				}
-				var clientToSendTo Client
-				for client := range m.Clients {
-					if client.Id == jsonMsg.Recipient {
-						clientToSendTo = *client
-					}
-				}
-				if clientToSendTo.Id != "" {
-					clientToSendTo.Send <- msg
-				}
-			} else {
-				for conn := range m.Clients {
-					select {
-					case conn.Send <- msg:
-					default:
-						close(conn.Send)
-						delete(m.Clients, conn)
-					}
-				}
-			}
-		}
-	}
-}
-
-type Client struct {
-	Id     string
-	Socket *websocket.Conn
-	Send   chan []byte
-}
-
-func NewClient(id string, socket *websocket.Conn, send chan []byte) *Client {
-	return &Client{
-		Id:     id,
-		Socket: socket,
-		Send:   send,
-	}
-}
-
-func (c *Client) Read() {
-	defer func() {
-		manager.Unregister <- c
-		_ = c.Socket.Close()
-	}()
-
-	for {
-		_, message, err := c.Socket.ReadMessage()
-		if err != nil {
-			manager.Unregister <- c
-			_ = c.Socket.Close()
-			break
-		}
-
-		var jsonMsg models.Message
-		if err := json.Unmarshal(message, &jsonMsg); err != nil {
-			log.Println("error converting message to correct format: " + err.Error())
-			return
-		}
-
-		manager.Broadcast <- message
-	}
-}
-
-func (c *Client) Write() {
-	defer func() {
-		_ = c.Socket.Close()
-	}()
-
-	for {
-		select {
-		case message, ok := <-c.Send:
-			if !ok {
-				_ = c.Socket.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			_ = c.Socket.WriteMessage(websocket.TextMessage, message)
-		}
-	}
-}
-
-var upgrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
-}
-
-func HandleConnections(ctx *gin.Context) {
-	currentUser, _ := ctx.Params.Get("userId")
-	if currentUser == "" {
-		ctx.JSON(http.StatusBadRequest, gin.H{"error": "no user id provided"})
-		return
+// shutdownTimeout bounds how long a deploy waits for requests and gateway
+// connections to drain.
+const shutdownTimeout = 20 * time.Second
+
+// tokenParam matches a ?token= query parameter, the only way EventSource and
+// plain links can send a bearer token.
+var tokenParam = regexp.MustCompile(`([?&]token=)[^&]*`)
+
+// logFormatter is gin's default access log line, without tokens in it.
+func logFormatter(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
 	}
-
-	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
-	if err != nil {
-		fmt.Println(err)
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
 	}
 
-	client := &Client{
-		Id:     currentUser,
-		Socket: conn,
-		Send:   make(chan []byte),
-	}
-
-	manager.Register <- client
-
-	go client.Read()
-	go client.Write()
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		tokenParam.ReplaceAllString(param.Path, "${1}REDACTED"),
+		param.ErrorMessage,
+	)
 }
 
 func main() {
-	r := gin.Default()
+	r := gin.New()
+	r.Use(gin.LoggerWithFormatter(logFormatter), gin.Recovery())
 	allowedOriginsFromEnv := os.Getenv("ALLOWED_ORIGINS")
 	allowedOrigins := strings.Split(allowedOriginsFromEnv, ",")
 	r.Use(cors.New(cors.Config{
 		AllowOrigins: allowedOrigins,
 		AllowMethods: []string{"GET", "POST", "OPTIONS", "PUT", "DELETE"},
-		AllowHeaders: []string{"*"},
+		// a wildcard doesn't cover Authorization, so it's named
+		AllowHeaders: []string{"*", "Authorization"},
 	}))
 
 	conn, err := pgxpool.New(context.Background(), os.Getenv("DATABASE_URL"))
@@ -188,25 +81,118 @@ func main() {
 	userService := &user.Service{Store: store}
 	serverService := &server.Service{Store: store}
 	chatService := &chat.Service{Store: store}
-	manager.ChatService = chatService
+	authService := &auth.Service{Key: []byte(os.Getenv("GATEWAY_TOKEN_SECRET"))}
+	presenceService := presence.NewService(store)
+	var blobs attachment.BlobStore
+	if os.Getenv("BLOB_STORE") == "s3" {
+		blobs = attachment.NewS3BlobStore(os.Getenv("S3_ENDPOINT"), os.Getenv("S3_REGION"), os.Getenv("S3_BUCKET"), os.Getenv("S3_ACCESS_KEY_ID"), os.Getenv("S3_SECRET_ACCESS_KEY"))
+	} else {
+		blobDir := os.Getenv("BLOB_DIR")
+		if blobDir == "" {
+			blobDir = "attachments"
+		}
+		if blobs, err = attachment.NewLocalBlobStore(blobDir); err != nil {
+			panic("error creating blob store: " + err.Error())
+		}
+	}
+	attachmentService := &attachment.Service{Store: store, Blobs: blobs}
+	searchService := &search.Service{Store: store}
+	var bus gateway.Bus = gateway.NewLocalBus()
+	var registry *presence.PostgresRegistry
+	if os.Getenv("GATEWAY_BUS") == "postgres" {
+		bus = gateway.NewPostgresBus(conn, "gateway")
+		// instances sharing a bus share presence too
+		registry = presence.NewPostgresRegistry(conn)
+		if err := registry.Start(context.Background()); err != nil {
+			panic("error starting presence registry: " + err.Error())
+		}
+		presenceService.Registry = registry
+	}
+	manager := gateway.NewManager(chatService, serverService, authService, presenceService, bus)
 
 	go manager.Start()
 
-	ctrl := controller.New(userService, chatService, serverService)
-	r.GET("/ws/:userId", HandleConnections)
+	ctrl := controller.New(userService, chatService, serverService, presenceService, attachmentService, searchService, authService, manager)
+	r.GET("/ws/:userId", manager.HandleConnections)
+	r.GET("/api/v1/gateway/:userId/events", manager.HandleEvents)
+	r.POST("/api/v1/gateway/:userId/poll", manager.HandlePollConnect)
+	r.GET("/api/v1/gateway/:userId/poll/:connectionId", manager.HandlePoll)
+	r.POST("/api/v1/gateway/:userId/send/:connectionId", manager.HandleSend)
 	r.POST("/api/v1/users", ctrl.CreateUser)
+	r.GET("/api/v1/users/:userId/privacy", ctrl.GetPrivacySettings)
+	r.PUT("/api/v1/users/:userId/privacy", ctrl.UpdatePrivacySettings)
 	r.POST("/api/v1/friends", ctrl.SendFriendRequest)
 	r.PUT("/api/v1/friends", ctrl.UpdateFriendRequest)
 	r.GET("/api/v1/friends/requests/:userId", ctrl.GetFriendRequests)
 	r.GET("/api/v1/friends/:userId", ctrl.GetFriends)
 	r.DELETE("/api/v1/friends", ctrl.RemoveFriend)
 	r.POST("/api/v1/chats/info", ctrl.GetChatInfo)
+	r.POST("/api/v1/chats/messages", ctrl.GetMessages)
+	r.POST("/api/v1/chats/receipts", ctrl.GetReceipts)
 	r.GET("/api/v1/chats/:userId", ctrl.GetAllChats)
+	r.PUT("/api/v1/messages/:messageId", ctrl.EditMessage)
+	r.DELETE("/api/v1/messages/:messageId", ctrl.DeleteMessage)
+	r.GET("/api/v1/messages/:messageId/revisions", ctrl.GetRevisions)
+	r.PUT("/api/v1/messages/:messageId/reactions/:emoji", ctrl.AddReaction)
+	r.DELETE("/api/v1/messages/:messageId/reactions/:emoji", ctrl.RemoveReaction)
+	r.GET("/api/v1/messages/:messageId/reactions/:emoji", ctrl.GetReactors)
+	r.POST("/api/v1/attachments", ctrl.UploadAttachment)
+	r.GET("/api/v1/attachments/:attachmentId", ctrl.GetAttachment)
+	r.GET("/api/v1/attachments/:attachmentId/thumbnail", ctrl.GetThumbnail)
+	r.GET("/api/v1/search", ctrl.Search)
 	r.POST("/api/v1/servers", ctrl.CreateServer)
 	r.GET("/api/v1/servers", ctrl.GetServers)
 	r.POST("/api/v1/invites/:serverId", ctrl.CreateInvite)
+	r.POST("/api/v1/presences", ctrl.GetPresences)
+
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			panic("error creating server: " + err.Error())
+		}
+	}()
+
+	// metrics count every user's connections and queues, so they're only served
+	// on an internal address, and only if one is set
+	var metricsSrv *http.Server
+	if addr := os.Getenv("METRICS_ADDR"); addr != "" {
+		metrics := gin.New()
+		metrics.Use(gin.Recovery())
+		metrics.GET("/api/v1/gateway/metrics", manager.HandleMetrics)
+		metricsSrv = &http.Server{Addr: addr, Handler: metrics}
+		go func() {
+			if err := metricsSrv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				panic("error creating metrics server: " + err.Error())
+			}
+		}()
+	}
 
-	if err := r.Run(":8080"); err != nil {
-		panic("error creating server: " + err.Error())
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+
+	log.Println("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	// drain the gateway first, since SSE streams and long-polls are requests in
+	// flight that only end once their connections are closed. Then stop taking
+	// requests and let the rest finish. The pool is closed by the deferred
+	// conn.Close once both are done.
+	if err := manager.Shutdown(shutdownCtx); err != nil {
+		log.Println("error draining gateway: " + err.Error())
+	}
+	if registry != nil {
+		if err := registry.Close(shutdownCtx); err != nil {
+			log.Println("error closing presence registry: " + err.Error())
+		}
+	}
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("error shutting down http server: " + err.Error())
+	}
+	if metricsSrv != nil {
+		if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+			log.Println("error shutting down metrics server: " + err.Error())
+		}
 	}
 }
@@ -0,0 +1,12 @@
+create table if not exists server_members (
+    server_id integer not null references servers (id) on delete cascade,
+    user_id text not null references users (id) on delete cascade,
+    joined_at timestamptz not null default now(),
+    primary key (server_id, user_id)
+);
+
+create index if not exists server_members_user_id_idx on server_members (user_id);
+
+insert into server_members (server_id, user_id)
+select id, owner from servers
+on conflict do nothing;
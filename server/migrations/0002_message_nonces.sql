@@ -0,0 +1,3 @@
+alter table messages add column if not exists nonce text;
+
+create unique index if not exists messages_sender_nonce_idx on messages (sender_id, nonce) where nonce is not null;
@@ -0,0 +1,6 @@
+alter table messages add column if not exists delivered_at timestamptz;
+
+-- everything sent before delivery was tracked has been seen through chat history
+update messages set delivered_at = timestamp where delivered_at is null;
+
+create index if not exists messages_undelivered_idx on messages (recipient_id, id) where delivered_at is null;
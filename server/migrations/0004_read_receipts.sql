@@ -0,0 +1,3 @@
+alter table messages add column if not exists read_at timestamptz;
+
+alter table users add column if not exists read_receipts boolean not null default true;
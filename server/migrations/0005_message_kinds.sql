@@ -0,0 +1 @@
+alter table messages add column if not exists kind text not null default 'default';
@@ -0,0 +1,3 @@
+-- history is paged through by conversation and id, whichever side sent what
+create index if not exists messages_conversation_idx
+    on messages (least(sender_id, recipient_id), greatest(sender_id, recipient_id), id);
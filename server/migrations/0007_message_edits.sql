@@ -0,0 +1,12 @@
+alter table messages add column if not exists edited_at timestamptz;
+alter table messages add column if not exists deleted_at timestamptz;
+
+-- what a message said before each edit, and since when
+create table if not exists message_revisions (
+    id bigserial primary key,
+    message_id bigint not null references messages (id) on delete cascade,
+    content text not null,
+    revised_at timestamptz not null
+);
+
+create index if not exists message_revisions_message_id_idx on message_revisions (message_id, id);
@@ -0,0 +1,2 @@
+alter table messages add column if not exists reply_to bigint references messages (id);
+alter table messages add column if not exists mentions text[] not null default '{}';
@@ -0,0 +1,7 @@
+create table if not exists message_reactions (
+    message_id bigint not null references messages (id) on delete cascade,
+    user_id text not null references users (id) on delete cascade,
+    emoji text not null,
+    created_at timestamptz not null default now(),
+    primary key (message_id, emoji, user_id)
+);
@@ -0,0 +1,14 @@
+create table if not exists attachments (
+    id bigserial primary key,
+    uploader_id text not null references users (id) on delete cascade,
+    message_id bigint references messages (id) on delete cascade,
+    filename text not null,
+    content_type text not null,
+    size bigint not null,
+    blob_key text not null unique,
+    width integer,
+    height integer,
+    thumbnail_key text,
+    created_at timestamptz not null default now()
+);
+create index if not exists attachments_message_idx on attachments (message_id) where message_id is not null;
@@ -0,0 +1,4 @@
+alter table messages add column if not exists search tsvector
+    generated always as (to_tsvector('english', content)) stored;
+
+create index if not exists messages_search_idx on messages using gin (search);
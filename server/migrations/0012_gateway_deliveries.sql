@@ -0,0 +1,6 @@
+-- deliveries too large for a NOTIFY payload; the notification carries the id
+create table if not exists gateway_deliveries (
+    id bigserial primary key,
+    payload text not null,
+    created_at timestamptz not null default now()
+);
@@ -0,0 +1,21 @@
+-- gateway instances check in here; connections counted by one that stops
+-- checking in stop counting
+create table if not exists gateway_instances (
+    id text primary key,
+    seen_at timestamptz not null default now()
+);
+
+create table if not exists presence_connections (
+    instance_id text not null references gateway_instances (id) on delete cascade,
+    user_id text not null,
+    connections int not null,
+    primary key (instance_id, user_id)
+);
+
+create index if not exists presence_connections_user_idx on presence_connections (user_id);
+
+-- only statuses other than online are kept
+create table if not exists presence_statuses (
+    user_id text primary key references users (id) on delete cascade,
+    status text not null
+);
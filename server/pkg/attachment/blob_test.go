@@ -0,0 +1,69 @@
+package attachment
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLocalBlobStore_RoundTrip(t *testing.T) {
+	s, err := NewLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	ctx := context.Background()
+
+	if err := s.Put(ctx, "abc123", strings.NewReader("hello"), 5, "text/plain"); err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+
+	blob, err := s.Get(ctx, "abc123")
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	body, _ := io.ReadAll(blob)
+	blob.Close()
+	if string(body) != "hello" {
+		t.Errorf("blob should read back, got: %q", body)
+	}
+
+	if err := s.Delete(ctx, "abc123"); err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	if _, err := s.Get(ctx, "abc123"); !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("error should be ErrBlobNotFound, got: %v", err)
+	}
+	if err := s.Delete(ctx, "abc123"); err != nil {
+		t.Errorf("deleting twice should be fine, got: %v", err)
+	}
+}
+
+func TestLocalBlobStore_WrongSize_Failure(t *testing.T) {
+	root := t.TempDir()
+	s, _ := NewLocalBlobStore(root)
+
+	for _, body := range []string{"hell", "hello!"} {
+		if err := s.Put(context.Background(), "abc123", strings.NewReader(body), 5, "text/plain"); err == nil {
+			t.Errorf("%q should fail as 5 bytes", body)
+		}
+	}
+
+	// nothing is left behind, under the key or otherwise
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 0 {
+		t.Errorf("failed puts should leave nothing behind, got: %v", entries)
+	}
+}
+
+func TestLocalBlobStore_BadKey_Failure(t *testing.T) {
+	s, _ := NewLocalBlobStore(t.TempDir())
+
+	for _, key := range []string{"", "../escape", "nested/key", ".hidden"} {
+		if err := s.Put(context.Background(), key, strings.NewReader("hello"), 5, "text/plain"); err == nil {
+			t.Errorf("%q should be refused", key)
+		}
+	}
+}
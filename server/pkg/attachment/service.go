@@ -0,0 +1,200 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+type Service struct {
+	Store database.Store
+	Blobs BlobStore
+	// MaxSize bounds uploads in bytes. Left zero, it's DefaultMaxSize.
+	MaxSize int64
+}
+
+const (
+	DefaultMaxSize = 25 << 20
+	// maxImageSize bounds the images that get thumbnails, since they're held
+	// in memory to decode. Bigger ones are stored as plain files.
+	maxImageSize      = 20 << 20
+	maxFilenameLength = 255
+	// sniffLength is as much of an upload as http.DetectContentType looks at.
+	sniffLength = 512
+)
+
+var (
+	ErrTooLarge = errors.New("attachment too large")
+	ErrEmpty    = errors.New("attachment is empty")
+	// ErrAttachmentNotFound is returned for attachments that don't exist, or
+	// that the user can't see.
+	ErrAttachmentNotFound = errors.New("attachment not found")
+)
+
+// Upload streams size bytes of body into the blob store as an attachment of the
+// user's, and records it. The content type is sniffed from the bytes, whatever
+// the client says it is. Images get their dimensions and a thumbnail.
+func (s *Service) Upload(ctx context.Context, userId, filename string, body io.Reader, size int64) (models.Attachment, error) {
+	maxSize := s.MaxSize
+	if maxSize == 0 {
+		maxSize = DefaultMaxSize
+	}
+	if size > maxSize {
+		return models.Attachment{}, ErrTooLarge
+	}
+	if size <= 0 {
+		return models.Attachment{}, ErrEmpty
+	}
+
+	head := make([]byte, min(size, sniffLength))
+	if _, err := io.ReadFull(body, head); err != nil {
+		return models.Attachment{}, err
+	}
+	attachment := models.Attachment{
+		Uploader:    userId,
+		Filename:    cleanFilename(filename),
+		ContentType: http.DetectContentType(head),
+		Size:        size,
+		BlobKey:     newKey(),
+	}
+
+	content := io.MultiReader(bytes.NewReader(head), body)
+	// keep images as they stream past, to thumbnail once they're stored
+	var image bytes.Buffer
+	if thumbnailable(attachment.ContentType) && size <= maxImageSize {
+		image.Grow(int(size))
+		content = io.TeeReader(content, &image)
+	}
+	if err := s.Blobs.Put(ctx, attachment.BlobKey, content, size, attachment.ContentType); err != nil {
+		return models.Attachment{}, err
+	}
+
+	if image.Len() > 0 {
+		if err := s.addThumbnail(ctx, &attachment, image.Bytes()); err != nil {
+			// it's still a perfectly good file, just not one with a preview
+			log.Println("unable to thumbnail attachment: " + err.Error())
+		}
+	}
+
+	created, err := s.Store.CreateAttachment(attachment)
+	if err != nil {
+		s.discard(attachment)
+		return models.Attachment{}, err
+	}
+
+	return created, nil
+}
+
+// Open returns an attachment the user can see, and its bytes. The caller closes
+// them.
+func (s *Service) Open(ctx context.Context, userId string, attachmentId int64) (models.Attachment, io.ReadCloser, error) {
+	return s.open(ctx, userId, attachmentId, false)
+}
+
+// OpenThumbnail is Open for an image's thumbnail, whose content type is
+// ThumbnailType of the image's.
+func (s *Service) OpenThumbnail(ctx context.Context, userId string, attachmentId int64) (models.Attachment, io.ReadCloser, error) {
+	return s.open(ctx, userId, attachmentId, true)
+}
+
+func (s *Service) open(ctx context.Context, userId string, attachmentId int64, thumbnail bool) (models.Attachment, io.ReadCloser, error) {
+	attachment, err := s.Store.GetAttachment(userId, attachmentId)
+	if errors.Is(err, database.ErrNotFound) {
+		return models.Attachment{}, nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return models.Attachment{}, nil, err
+	}
+
+	key := attachment.BlobKey
+	if thumbnail {
+		if attachment.ThumbnailKey == "" {
+			return models.Attachment{}, nil, ErrAttachmentNotFound
+		}
+		key = attachment.ThumbnailKey
+	}
+
+	blob, err := s.Blobs.Get(ctx, key)
+	if errors.Is(err, ErrBlobNotFound) {
+		log.Println("attachment is missing its blob: " + key)
+		return models.Attachment{}, nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return models.Attachment{}, nil, err
+	}
+
+	return attachment, blob, nil
+}
+
+// addThumbnail fills in an image's dimensions and stores its thumbnail.
+func (s *Service) addThumbnail(ctx context.Context, attachment *models.Attachment, data []byte) error {
+	width, height, err := dimensions(data)
+	if err != nil {
+		return err
+	}
+	attachment.Width, attachment.Height = &width, &height
+
+	thumb, err := thumbnail(data, attachment.ContentType)
+	if err != nil {
+		return err
+	}
+	key := attachment.BlobKey + "-thumbnail"
+	if err := s.Blobs.Put(ctx, key, bytes.NewReader(thumb), int64(len(thumb)), ThumbnailType(attachment.ContentType)); err != nil {
+		return err
+	}
+	attachment.ThumbnailKey = key
+	attachment.Thumbnail = true
+
+	return nil
+}
+
+// discard removes the blobs of an upload that couldn't be recorded.
+func (s *Service) discard(attachment models.Attachment) {
+	for _, key := range []string{attachment.BlobKey, attachment.ThumbnailKey} {
+		if key == "" {
+			continue
+		}
+		if err := s.Blobs.Delete(context.Background(), key); err != nil {
+			log.Println("unable to delete blob: " + err.Error())
+		}
+	}
+}
+
+// cleanFilename keeps the last part of whatever path a client sent, without
+// anything that could break a Content-Disposition header.
+func cleanFilename(filename string) string {
+	if i := strings.LastIndexAny(filename, `/\`); i >= 0 {
+		filename = filename[i+1:]
+	}
+	filename = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || r == '"' {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(filename, ""))
+	filename = strings.TrimSpace(filename)
+
+	for len(filename) > maxFilenameLength {
+		_, n := utf8.DecodeLastRuneInString(filename)
+		filename = filename[:len(filename)-n]
+	}
+	if filename == "" || filename == "." || filename == ".." {
+		return "attachment"
+	}
+	return filename
+}
+
+func newKey() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,211 @@
+package attachment
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestService(t *testing.T, m *database.MockStore) (*Service, string) {
+	t.Helper()
+	root := t.TempDir()
+	blobs, err := NewLocalBlobStore(root)
+	if err != nil {
+		t.Fatalf("error creating blob store: %v", err)
+	}
+	return &Service{Store: m, Blobs: blobs}, root
+}
+
+// created returns the attachment a service asked the store to record.
+func created(t *testing.T, m *database.MockStore) models.Attachment {
+	t.Helper()
+	for _, call := range m.Calls {
+		if call.Method == "CreateAttachment" {
+			return call.Arguments.Get(0).(models.Attachment)
+		}
+	}
+	t.Fatalf("attachment should have been recorded")
+	return models.Attachment{}
+}
+
+func readBlob(t *testing.T, s *Service, key string) []byte {
+	t.Helper()
+	blob, err := s.Blobs.Get(context.Background(), key)
+	if err != nil {
+		t.Fatalf("error getting blob %q: %v", key, err)
+	}
+	defer blob.Close()
+	data, _ := io.ReadAll(blob)
+	return data
+}
+
+func TestService_Upload_File(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("CreateAttachment", mock.Anything).Return(models.Attachment{ID: 1}, nil)
+	s, _ := newTestService(t, m)
+
+	uploaded, err := s.Upload(context.Background(), "userId", "notes.txt", strings.NewReader("deploy failed"), 13)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	if uploaded.ID != 1 {
+		t.Errorf("recorded attachment should be returned, got: %+v", uploaded)
+	}
+
+	recorded := created(t, m)
+	if recorded.Uploader != "userId" || recorded.Filename != "notes.txt" || recorded.Size != 13 {
+		t.Errorf("attachment should be recorded as uploaded, got: %+v", recorded)
+	}
+	if recorded.ContentType != "text/plain; charset=utf-8" {
+		t.Errorf("content type should be sniffed, got: %q", recorded.ContentType)
+	}
+	if recorded.Width != nil || recorded.Thumbnail {
+		t.Errorf("only images get dimensions and thumbnails, got: %+v", recorded)
+	}
+	if data := readBlob(t, s, recorded.BlobKey); string(data) != "deploy failed" {
+		t.Errorf("blob should hold the upload, got: %q", data)
+	}
+}
+
+func TestService_Upload_Image(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 640, 480))
+	for y := 0; y < 480; y++ {
+		for x := 0; x < 640; x++ {
+			src.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 200, A: 255})
+		}
+	}
+	var encoded bytes.Buffer
+	_ = png.Encode(&encoded, src)
+
+	m := new(database.MockStore)
+	m.On("CreateAttachment", mock.Anything).Return(models.Attachment{ID: 1}, nil)
+	s, _ := newTestService(t, m)
+
+	// the client's idea of what it is doesn't come into it
+	_, err := s.Upload(context.Background(), "userId", "photo.txt", bytes.NewReader(encoded.Bytes()), int64(encoded.Len()))
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+
+	recorded := created(t, m)
+	if recorded.ContentType != "image/png" {
+		t.Errorf("content type should be sniffed, got: %q", recorded.ContentType)
+	}
+	if recorded.Width == nil || recorded.Height == nil || *recorded.Width != 640 || *recorded.Height != 480 {
+		t.Fatalf("image should have its dimensions, got: %+v", recorded)
+	}
+	if !recorded.Thumbnail || recorded.ThumbnailKey == "" {
+		t.Fatalf("image should have a thumbnail, got: %+v", recorded)
+	}
+
+	thumb, err := png.Decode(bytes.NewReader(readBlob(t, s, recorded.ThumbnailKey)))
+	if err != nil {
+		t.Fatalf("thumbnail should be a png, got: %v", err)
+	}
+	if bounds := thumb.Bounds(); bounds.Dx() != thumbnailSize || bounds.Dy() != 240 {
+		t.Errorf("thumbnail should fit in %d keeping its ratio, got: %v", thumbnailSize, bounds)
+	}
+}
+
+func TestService_Upload_TooLarge(t *testing.T) {
+	m := new(database.MockStore)
+	s, root := newTestService(t, m)
+	s.MaxSize = 10
+
+	_, err := s.Upload(context.Background(), "userId", "big.bin", strings.NewReader("more than ten bytes"), 19)
+
+	if !errors.Is(err, ErrTooLarge) {
+		t.Errorf("error should be ErrTooLarge, got: %v", err)
+	}
+	m.AssertNotCalled(t, "CreateAttachment", mock.Anything)
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("nothing should be stored, got: %v", entries)
+	}
+}
+
+func TestService_Upload_Truncated(t *testing.T) {
+	m := new(database.MockStore)
+	s, _ := newTestService(t, m)
+
+	_, err := s.Upload(context.Background(), "userId", "notes.txt", strings.NewReader("cut off"), 100)
+
+	if err == nil {
+		t.Errorf("an upload shorter than it said should fail")
+	}
+	m.AssertNotCalled(t, "CreateAttachment", mock.Anything)
+}
+
+func TestService_Upload_Failure(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("CreateAttachment", mock.Anything).Return(models.Attachment{}, errors.New("failed"))
+	s, root := newTestService(t, m)
+
+	_, err := s.Upload(context.Background(), "userId", "notes.txt", strings.NewReader("deploy failed"), 13)
+
+	if err == nil || err.Error() != "failed" {
+		t.Errorf("error should be 'failed', got: %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("blobs of an unrecorded upload should be deleted, got: %v", entries)
+	}
+}
+
+func TestService_Open_Success(t *testing.T) {
+	m := new(database.MockStore)
+	s, _ := newTestService(t, m)
+	_ = s.Blobs.Put(context.Background(), "key", strings.NewReader("hello"), 5, "text/plain")
+	m.On("GetAttachment", "userId", int64(1)).Return(models.Attachment{ID: 1, Filename: "hello.txt", BlobKey: "key"}, nil)
+
+	attachment, blob, err := s.Open(context.Background(), "userId", 1)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	defer blob.Close()
+
+	data, _ := io.ReadAll(blob)
+	if attachment.Filename != "hello.txt" || string(data) != "hello" {
+		t.Errorf("attachment should be opened, got: %+v %q", attachment, data)
+	}
+}
+
+func TestService_Open_NotFound(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("GetAttachment", "outsiderId", int64(1)).Return(models.Attachment{}, database.ErrNotFound)
+	m.On("GetAttachment", "userId", int64(2)).Return(models.Attachment{ID: 2, BlobKey: "key"}, nil)
+	s, _ := newTestService(t, m)
+
+	if _, _, err := s.Open(context.Background(), "outsiderId", 1); !errors.Is(err, ErrAttachmentNotFound) {
+		t.Errorf("error should be ErrAttachmentNotFound, got: %v", err)
+	}
+	// not an image, so there's no thumbnail to open
+	if _, _, err := s.OpenThumbnail(context.Background(), "userId", 2); !errors.Is(err, ErrAttachmentNotFound) {
+		t.Errorf("error should be ErrAttachmentNotFound, got: %v", err)
+	}
+}
+
+func TestCleanFilename(t *testing.T) {
+	for filename, expected := range map[string]string{
+		"report.pdf":             "report.pdf",
+		"../../etc/passwd":       "passwd",
+		`C:\Users\me\photo.jpg`:  "photo.jpg",
+		"bad\"name\r\n.txt":      "badname.txt",
+		"":                       "attachment",
+		"..":                     "attachment",
+		strings.Repeat("é", 200): strings.Repeat("é", 127),
+	} {
+		if cleaned := cleanFilename(filename); cleaned != expected {
+			t.Errorf("%q should be cleaned to %q, got: %q", filename, expected, cleaned)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package attachment
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+)
+
+const (
+	// thumbnailSize is the square thumbnails are scaled down to fit in.
+	thumbnailSize = 320
+	// maxImagePixels stops a small file that claims to be an enormous image from
+	// being decoded into more memory than it's worth.
+	maxImagePixels = 40_000_000
+)
+
+var errTooManyPixels = errors.New("image too large to thumbnail")
+
+// thumbnailable is whether images of a content type can be decoded here.
+func thumbnailable(contentType string) bool {
+	switch contentType {
+	case "image/png", "image/jpeg", "image/gif":
+		return true
+	}
+	return false
+}
+
+// ThumbnailType is the content type of the thumbnails of images of a content
+// type. Photos stay JPEG; anything that might be transparent becomes PNG.
+func ThumbnailType(contentType string) string {
+	if contentType == "image/jpeg" {
+		return "image/jpeg"
+	}
+	return "image/png"
+}
+
+// dimensions reads an image's width and height without decoding it.
+func dimensions(data []byte) (int, int, error) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, err
+	}
+	return config.Width, config.Height, nil
+}
+
+// thumbnail decodes an image, or the first frame of an animated one, and scales
+// it down to fit in thumbnailSize, encoded as ThumbnailType says.
+func thumbnail(data []byte, contentType string) ([]byte, error) {
+	width, height, err := dimensions(data)
+	if err != nil {
+		return nil, err
+	}
+	if width*height > maxImagePixels {
+		return nil, errTooManyPixels
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	scaled := scale(src, fit(width, height, thumbnailSize))
+
+	var out bytes.Buffer
+	if ThumbnailType(contentType) == "image/jpeg" {
+		err = jpeg.Encode(&out, scaled, &jpeg.Options{Quality: 80})
+	} else {
+		err = png.Encode(&out, scaled)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// fit scales width and height down, keeping their ratio, until both are at most
+// size. Images that already fit are left as they are.
+func fit(width, height, size int) image.Rectangle {
+	if width <= size && height <= size {
+		return image.Rect(0, 0, width, height)
+	}
+	if width >= height {
+		return image.Rect(0, 0, size, max(1, height*size/width))
+	}
+	return image.Rect(0, 0, max(1, width*size/height), size)
+}
+
+// scale resizes an image by averaging the pixels under each one of the result,
+// which is plenty for shrinking.
+func scale(src image.Image, bounds image.Rectangle) *image.RGBA {
+	from := image.NewRGBA(image.Rect(0, 0, src.Bounds().Dx(), src.Bounds().Dy()))
+	draw.Draw(from, from.Bounds(), src, src.Bounds().Min, draw.Src)
+	srcWidth, srcHeight := from.Bounds().Dx(), from.Bounds().Dy()
+
+	dst := image.NewRGBA(bounds)
+	width, height := bounds.Dx(), bounds.Dy()
+	for y := 0; y < height; y++ {
+		y0 := y * srcHeight / height
+		y1 := max((y+1)*srcHeight/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := x * srcWidth / width
+			x1 := max((x+1)*srcWidth/width, x0+1)
+
+			var sum [4]int
+			for sy := y0; sy < y1; sy++ {
+				row := from.Pix[sy*from.Stride:]
+				for sx := x0; sx < x1; sx++ {
+					for c := 0; c < 4; c++ {
+						sum[c] += int(row[sx*4+c])
+					}
+				}
+			}
+			n := (y1 - y0) * (x1 - x0)
+			i := dst.PixOffset(x, y)
+			for c := 0; c < 4; c++ {
+				dst.Pix[i+c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
@@ -0,0 +1,73 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestService_Verify_Success(t *testing.T) {
+	s := Service{Key: []byte("local-signing-key")}
+
+	token, err := s.Sign("userId1", time.Minute)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+
+	claims, err := s.Verify(token)
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if claims.Subject != "userId1" {
+		t.Errorf("subject should be 'userId1', got: %v", claims.Subject)
+	}
+}
+
+func TestService_Verify_WrongKey_Failure(t *testing.T) {
+	signer := Service{Key: []byte("local-signing-key")}
+	verifier := Service{Key: []byte("some-other-key")}
+
+	token, _ := signer.Sign("userId1", time.Minute)
+
+	if _, err := verifier.Verify(token); !errors.Is(err, ErrInvalidToken) {
+		t.Errorf("error should be ErrInvalidToken, got: %v", err)
+	}
+}
+
+func TestService_Verify_Expired_Failure(t *testing.T) {
+	issuedAt := time.Now().Add(-time.Hour)
+	s := Service{Key: []byte("local-signing-key"), Now: func() time.Time { return issuedAt }}
+
+	token, _ := s.Sign("userId1", time.Minute)
+	s.Now = nil
+
+	if _, err := s.Verify(token); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("error should be ErrTokenExpired, got: %v", err)
+	}
+}
+
+func TestService_Verify_Malformed_Failure(t *testing.T) {
+	s := Service{Key: []byte("local-signing-key")}
+
+	for _, token := range []string{"", "abc", "a.b.c"} {
+		if _, err := s.Verify(token); !errors.Is(err, ErrInvalidToken) {
+			t.Errorf("error for %q should be ErrInvalidToken, got: %v", token, err)
+		}
+	}
+}
+
+func TestBearerToken(t *testing.T) {
+	header := httptest.NewRequest(http.MethodGet, "/api/v1/search?token=query", nil)
+	header.Header.Set("Authorization", "Bearer header")
+	query := httptest.NewRequest(http.MethodGet, "/api/v1/attachments/1?token=query", nil)
+	none := httptest.NewRequest(http.MethodGet, "/api/v1/attachments/1", nil)
+	none.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+
+	for r, expected := range map[*http.Request]string{header: "header", query: "query", none: ""} {
+		if token := BearerToken(r); token != expected {
+			t.Errorf("token for %s should be %q, got: %q", r.URL, expected, token)
+		}
+	}
+}
@@ -1,22 +1,271 @@
 package chat
 
 import (
+	"errors"
 	"ivar/pkg/database"
 	"ivar/pkg/models"
+	"regexp"
+	"slices"
+	"unicode"
+	"unicode/utf8"
 )
 
 type Service struct {
 	Store database.Store
 }
 
-func (s *Service) AddMessage(message models.Message) error {
-	if err := s.Store.StoreMessage(message); err != nil {
+// ErrMessageNotFound is returned for messages that don't exist, or that the user
+// can't see or change.
+var ErrMessageNotFound = errors.New("message not found")
+
+// ErrInvalidReply is returned for replies to messages that aren't in the same
+// conversation, or have been deleted.
+var ErrInvalidReply = errors.New("invalid reply")
+
+var ErrInvalidEmoji = errors.New("invalid emoji")
+
+// ErrInvalidAttachment is returned for messages carrying attachments that aren't
+// the sender's to attach, or too many of them.
+var ErrInvalidAttachment = errors.New("invalid attachment")
+
+const (
+	// maxEmojiLength bounds unicode emoji in bytes, which is plenty for the
+	// longest ZWJ sequences.
+	maxEmojiLength         = 64
+	defaultReactorPageSize = 25
+	maxReactorPageSize     = 100
+	maxAttachments         = 10
+)
+
+// customEmoji is how custom emoji are written in reactions: name:id.
+var customEmoji = regexp.MustCompile(`^[A-Za-z0-9_]{2,32}:[0-9]+$`)
+
+// AddMessage stores a message and returns it with its id and timestamp. created
+// is false if it's a retry of a message the sender already stored, in which case
+// the original is returned. A reply comes back with a preview of what it
+// replies to, and mentions that message's author. Attachments have to be the
+// sender's own uploads that no other message has claimed.
+func (s *Service) AddMessage(message models.Message) (models.Message, bool, error) {
+	// these are the server's to work out
+	message.Reply = nil
+	message.Mentions = nil
+	message.Attachments = nil
+
+	if len(message.AttachmentIds) > 0 {
+		slices.Sort(message.AttachmentIds)
+		message.AttachmentIds = slices.Compact(message.AttachmentIds)
+		if len(message.AttachmentIds) > maxAttachments {
+			return models.Message{}, false, ErrInvalidAttachment
+		}
+		attachable, err := s.Store.CountAttachable(message)
+		if err != nil {
+			return models.Message{}, false, err
+		}
+		if attachable != len(message.AttachmentIds) {
+			return models.Message{}, false, ErrInvalidAttachment
+		}
+	}
+
+	var reply *models.MessagePreview
+	if message.ReplyTo != nil {
+		preview, err := s.Store.GetMessagePreview([]string{message.Sender, message.Recipient}, *message.ReplyTo)
+		if errors.Is(err, database.ErrNotFound) || preview.Deleted {
+			return models.Message{}, false, ErrInvalidReply
+		}
+		if err != nil {
+			return models.Message{}, false, err
+		}
+		reply = &preview
+
+		if preview.Sender != message.Sender {
+			message.Mentions = []string{preview.Sender}
+		}
+	}
+
+	stored, created, err := s.Store.StoreMessage(message)
+	if errors.Is(err, database.ErrAttachmentClaimed) {
+		return models.Message{}, false, ErrInvalidAttachment
+	}
+	if err != nil {
+		return models.Message{}, false, err
+	}
+	stored.Reply = reply
+
+	return stored, created, nil
+}
+
+// EditMessage changes the content of one of the user's own messages and returns
+// it as edited. What it said before is kept as a revision.
+func (s *Service) EditMessage(userId string, messageId int64, content string) (models.Message, error) {
+	edited, err := s.Store.EditMessage(userId, messageId, content)
+	if errors.Is(err, database.ErrNotFound) {
+		return models.Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	return edited, nil
+}
+
+// DeleteMessage deletes one of the user's own messages and returns its
+// tombstone.
+func (s *Service) DeleteMessage(userId string, messageId int64) (models.Message, error) {
+	deleted, err := s.Store.DeleteMessage(userId, messageId)
+	if errors.Is(err, database.ErrNotFound) {
+		return models.Message{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return models.Message{}, err
+	}
+
+	return deleted, nil
+}
+
+func (s *Service) GetRevisions(userId string, messageId int64) ([]models.Revision, error) {
+	revisions, err := s.Store.GetRevisions(userId, messageId)
+	if errors.Is(err, database.ErrNotFound) {
+		return []models.Revision{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return []models.Revision{}, err
+	}
+
+	return revisions, nil
+}
+
+// AddReaction reacts to a message on the user's behalf. changed is false if
+// they'd already reacted with that emoji, in which case nobody needs telling.
+func (s *Service) AddReaction(change models.ReactionChange) (models.ReactionChange, bool, error) {
+	if !validEmoji(change.Emoji) {
+		return models.ReactionChange{}, false, ErrInvalidEmoji
+	}
+
+	added, changed, err := s.Store.AddReaction(change)
+	if errors.Is(err, database.ErrNotFound) {
+		return models.ReactionChange{}, false, ErrMessageNotFound
+	}
+	if err != nil {
+		return models.ReactionChange{}, false, err
+	}
+
+	return added, changed, nil
+}
+
+// RemoveReaction takes back one of the user's reactions. changed is false if
+// there was nothing to take back.
+func (s *Service) RemoveReaction(change models.ReactionChange) (models.ReactionChange, bool, error) {
+	if !validEmoji(change.Emoji) {
+		return models.ReactionChange{}, false, ErrInvalidEmoji
+	}
+
+	removed, changed, err := s.Store.RemoveReaction(change)
+	if errors.Is(err, database.ErrNotFound) {
+		return models.ReactionChange{}, false, ErrMessageNotFound
+	}
+	if err != nil {
+		return models.ReactionChange{}, false, err
+	}
+
+	return removed, changed, nil
+}
+
+// GetReactors returns a page of the users who reacted to a message with an
+// emoji, starting after the user id in after.
+func (s *Service) GetReactors(userId string, messageId int64, emoji, after string, limit int) (models.ReactorPage, error) {
+	if limit <= 0 {
+		limit = defaultReactorPageSize
+	}
+	limit = min(limit, maxReactorPageSize)
+
+	// one more than the page holds says whether there's another
+	users, err := s.Store.GetReactors(userId, messageId, emoji, after, limit+1)
+	if errors.Is(err, database.ErrNotFound) {
+		return models.ReactorPage{}, ErrMessageNotFound
+	}
+	if err != nil {
+		return models.ReactorPage{}, err
+	}
+
+	page := models.ReactorPage{Users: users}
+	if len(users) > limit {
+		page.Users = users[:limit]
+		next := page.Users[limit-1].ID
+		page.After = &next
+	}
+
+	return page, nil
+}
+
+// validEmoji accepts custom emoji, and anything that could be a unicode one:
+// printable, no spaces, and not just ASCII.
+func validEmoji(emoji string) bool {
+	if customEmoji.MatchString(emoji) {
+		return true
+	}
+	if emoji == "" || len(emoji) > maxEmojiLength || !utf8.ValidString(emoji) {
+		return false
+	}
+
+	ascii := true
+	for _, r := range emoji {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+		ascii = ascii && r < utf8.RuneSelf
+	}
+	return !ascii
+}
+
+// GetUndelivered returns the oldest messages still waiting for the user, up to
+// limit, and how many are waiting in each conversation, keyed by the sender.
+func (s *Service) GetUndelivered(userId string, limit int) ([]models.Message, map[string]int, error) {
+	messages, err := s.Store.GetUndeliveredMessages(userId, limit)
+	if err != nil {
+		return []models.Message{}, nil, err
+	}
+
+	counts, err := s.Store.CountUndeliveredMessages(userId)
+	if err != nil {
+		return []models.Message{}, nil, err
+	}
+
+	return messages, counts, nil
+}
+
+func (s *Service) MarkDelivered(userId string, upTo int64) error {
+	if err := s.Store.MarkDelivered(userId, upTo); err != nil {
 		return err
 	}
 
 	return nil
 }
 
+// MarkRead records that the user has read everything the sender sent them up
+// to upTo, and reports whether the sender may be told, which they may not if
+// the user has turned read receipts off.
+func (s *Service) MarkRead(userId, senderId string, upTo int64) (bool, error) {
+	if err := s.Store.MarkRead(userId, senderId, upTo); err != nil {
+		return false, err
+	}
+
+	settings, err := s.Store.GetPrivacySettings(userId)
+	if err != nil {
+		return false, err
+	}
+
+	return settings.ReadReceipts, nil
+}
+
+func (s *Service) GetReceipts(users []string) ([]models.Receipt, error) {
+	receipts, err := s.Store.GetReceipts(users)
+	if err != nil {
+		return []models.Receipt{}, err
+	}
+
+	return receipts, nil
+}
+
 func (s *Service) GetAllChats(userId string) ([]models.User, error) {
 	users, err := s.Store.AllChats(userId)
 	if err != nil {
@@ -4,7 +4,11 @@ import (
 	"errors"
 	"ivar/pkg/database"
 	"ivar/pkg/models"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
 )
 
 func TestService_AddMessage_Success(t *testing.T) {
@@ -13,11 +17,16 @@ func TestService_AddMessage_Success(t *testing.T) {
 		Sender:    "senderId",
 		Recipient: "recipientId",
 		Content:   "test message 1",
-	}).Return(nil)
+	}).Return(models.Message{
+		ID:        1,
+		Sender:    "senderId",
+		Recipient: "recipientId",
+		Content:   "test message 1",
+	}, true, nil)
 
 	s := Service{m}
 
-	err := s.AddMessage(models.Message{
+	stored, created, err := s.AddMessage(models.Message{
 		Sender:    "senderId",
 		Recipient: "recipientId",
 		Content:   "test message 1",
@@ -28,6 +37,43 @@ func TestService_AddMessage_Success(t *testing.T) {
 	if err != nil {
 		t.Errorf("error should be nil, got: %v", err)
 	}
+	if stored.ID != 1 || !created {
+		t.Errorf("message should have been created with id 1, got: %v, %v", stored.ID, created)
+	}
+}
+
+func TestService_AddMessage_Duplicate(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("StoreMessage", models.Message{
+		Sender:    "senderId",
+		Recipient: "recipientId",
+		Content:   "test message 1",
+		Nonce:     "nonce1",
+	}).Return(models.Message{
+		ID:        1,
+		Sender:    "senderId",
+		Recipient: "recipientId",
+		Content:   "test message 1",
+		Nonce:     "nonce1",
+	}, false, nil)
+
+	s := Service{m}
+
+	stored, created, err := s.AddMessage(models.Message{
+		Sender:    "senderId",
+		Recipient: "recipientId",
+		Content:   "test message 1",
+		Nonce:     "nonce1",
+	})
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if stored.ID != 1 || created {
+		t.Errorf("the original message should have been returned, got: %v, %v", stored.ID, created)
+	}
 }
 
 func TestService_AddMessage_Failure(t *testing.T) {
@@ -36,11 +82,11 @@ func TestService_AddMessage_Failure(t *testing.T) {
 		Sender:    "senderId",
 		Recipient: "recipientId",
 		Content:   "test message 1",
-	}).Return(errors.New("failed"))
+	}).Return(models.Message{}, false, errors.New("failed"))
 
 	s := Service{m}
 
-	err := s.AddMessage(models.Message{
+	_, _, err := s.AddMessage(models.Message{
 		Sender:    "senderId",
 		Recipient: "recipientId",
 		Content:   "test message 1",
@@ -82,3 +128,447 @@ func TestService_GetAllChats_Failure(t *testing.T) {
 		t.Errorf("error should be 'failed', got: %v", err)
 	}
 }
+
+func TestService_GetUndelivered_Success(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("GetUndeliveredMessages", "userId1", 100).Return([]models.Message{{ID: 1, Sender: "userId2", Recipient: "userId1"}}, nil)
+	m.On("CountUndeliveredMessages", "userId1").Return(map[string]int{"userId2": 1}, nil)
+
+	s := Service{m}
+
+	messages, counts, err := s.GetUndelivered("userId1", 100)
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if len(messages) != 1 || counts["userId2"] != 1 {
+		t.Errorf("expected 1 undelivered message from userId2, got: %v, %v", messages, counts)
+	}
+}
+
+func TestService_GetUndelivered_Failure(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("GetUndeliveredMessages", "userId1", 100).Return([]models.Message{}, errors.New("failed"))
+
+	s := Service{m}
+
+	_, _, err := s.GetUndelivered("userId1", 100)
+
+	m.AssertExpectations(t)
+
+	if err.Error() != "failed" {
+		t.Errorf("error should be 'failed', got: %v", err)
+	}
+}
+
+func TestService_MarkDelivered_Success(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("MarkDelivered", "userId1", int64(5)).Return(nil)
+
+	s := Service{m}
+
+	err := s.MarkDelivered("userId1", 5)
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+}
+
+func TestService_MarkRead_Shared(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("MarkRead", "userId1", "userId2", int64(5)).Return(nil)
+	m.On("GetPrivacySettings", "userId1").Return(models.PrivacySettings{ReadReceipts: true}, nil)
+
+	s := Service{m}
+
+	shared, err := s.MarkRead("userId1", "userId2", 5)
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if !shared {
+		t.Errorf("read should be shared")
+	}
+}
+
+func TestService_MarkRead_ReceiptsOff(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("MarkRead", "userId1", "userId2", int64(5)).Return(nil)
+	m.On("GetPrivacySettings", "userId1").Return(models.PrivacySettings{ReadReceipts: false}, nil)
+
+	s := Service{m}
+
+	shared, err := s.MarkRead("userId1", "userId2", 5)
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if shared {
+		t.Errorf("read should not be shared")
+	}
+}
+
+func TestService_MarkRead_Failure(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("MarkRead", "userId1", "userId2", int64(5)).Return(errors.New("failed"))
+
+	s := Service{m}
+
+	_, err := s.MarkRead("userId1", "userId2", 5)
+
+	m.AssertExpectations(t)
+
+	if err.Error() != "failed" {
+		t.Errorf("error should be 'failed', got: %v", err)
+	}
+}
+
+func TestService_GetReceipts_Success(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("GetReceipts", []string{"userId1", "userId2"}).Return([]models.Receipt{{MessageId: 1, UserId: "userId2"}}, nil)
+
+	s := Service{m}
+
+	receipts, err := s.GetReceipts([]string{"userId1", "userId2"})
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if len(receipts) != 1 {
+		t.Errorf("expected 1 receipt, got: %v", receipts)
+	}
+}
+
+func TestService_EditMessage_Success(t *testing.T) {
+	m := new(database.MockStore)
+	editedAt := time.Now()
+	m.On("EditMessage", "senderId", int64(1), "edited").Return(models.Message{ID: 1, Sender: "senderId", Content: "edited", EditedAt: &editedAt}, nil)
+
+	s := Service{m}
+
+	edited, err := s.EditMessage("senderId", 1, "edited")
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if edited.Content != "edited" || edited.EditedAt == nil {
+		t.Errorf("message should be edited, got: %+v", edited)
+	}
+}
+
+func TestService_EditMessage_NotFound(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("EditMessage", "otherId", int64(1), "edited").Return(models.Message{}, database.ErrNotFound)
+
+	s := Service{m}
+
+	_, err := s.EditMessage("otherId", 1, "edited")
+
+	m.AssertExpectations(t)
+
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("error should be ErrMessageNotFound, got: %v", err)
+	}
+}
+
+func TestService_DeleteMessage_Success(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("DeleteMessage", "senderId", int64(1)).Return(models.Message{ID: 1, Sender: "senderId", Recipient: "recipientId", Deleted: true}, nil)
+
+	s := Service{m}
+
+	deleted, err := s.DeleteMessage("senderId", 1)
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if !deleted.Deleted || deleted.Content != "" {
+		t.Errorf("message should be a tombstone, got: %+v", deleted)
+	}
+}
+
+func TestService_DeleteMessage_Failure(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("DeleteMessage", "senderId", int64(1)).Return(models.Message{}, errors.New("failed"))
+
+	s := Service{m}
+
+	_, err := s.DeleteMessage("senderId", 1)
+
+	m.AssertExpectations(t)
+
+	if err.Error() != "failed" {
+		t.Errorf("error should be 'failed', got: %v", err)
+	}
+}
+
+func TestService_GetRevisions_NotFound(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("GetRevisions", "outsiderId", int64(1)).Return([]models.Revision{}, database.ErrNotFound)
+
+	s := Service{m}
+
+	_, err := s.GetRevisions("outsiderId", 1)
+
+	m.AssertExpectations(t)
+
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("error should be ErrMessageNotFound, got: %v", err)
+	}
+}
+
+func TestService_AddMessage_Reply(t *testing.T) {
+	replyTo := int64(3)
+	m := new(database.MockStore)
+	m.On("GetMessagePreview", []string{"senderId", "recipientId"}, replyTo).Return(models.MessagePreview{ID: 3, Sender: "recipientId", Snippet: "hello"}, nil)
+	m.On("StoreMessage", models.Message{
+		Sender:    "senderId",
+		Recipient: "recipientId",
+		Content:   "hi back",
+		ReplyTo:   &replyTo,
+		Mentions:  []string{"recipientId"},
+	}).Return(models.Message{ID: 4, Sender: "senderId", Recipient: "recipientId", Content: "hi back", ReplyTo: &replyTo, Mentions: []string{"recipientId"}}, true, nil)
+
+	s := Service{m}
+
+	stored, _, err := s.AddMessage(models.Message{Sender: "senderId", Recipient: "recipientId", Content: "hi back", ReplyTo: &replyTo, Mentions: []string{"someoneElse"}})
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if stored.Reply == nil || stored.Reply.Snippet != "hello" {
+		t.Errorf("reply should carry a preview, got: %+v", stored.Reply)
+	}
+}
+
+func TestService_AddMessage_ReplyToSelf(t *testing.T) {
+	replyTo := int64(3)
+	m := new(database.MockStore)
+	m.On("GetMessagePreview", []string{"senderId", "recipientId"}, replyTo).Return(models.MessagePreview{ID: 3, Sender: "senderId", Snippet: "hello"}, nil)
+	m.On("StoreMessage", models.Message{
+		Sender:    "senderId",
+		Recipient: "recipientId",
+		Content:   "and another thing",
+		ReplyTo:   &replyTo,
+	}).Return(models.Message{ID: 4, ReplyTo: &replyTo}, true, nil)
+
+	s := Service{m}
+
+	_, _, err := s.AddMessage(models.Message{Sender: "senderId", Recipient: "recipientId", Content: "and another thing", ReplyTo: &replyTo})
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+}
+
+func TestService_AddMessage_ReplyElsewhere(t *testing.T) {
+	replyTo := int64(3)
+	m := new(database.MockStore)
+	m.On("GetMessagePreview", []string{"senderId", "recipientId"}, replyTo).Return(models.MessagePreview{}, database.ErrNotFound)
+
+	s := Service{m}
+
+	_, _, err := s.AddMessage(models.Message{Sender: "senderId", Recipient: "recipientId", Content: "hi", ReplyTo: &replyTo})
+
+	m.AssertExpectations(t)
+	m.AssertNotCalled(t, "StoreMessage", mock.Anything)
+
+	if !errors.Is(err, ErrInvalidReply) {
+		t.Errorf("error should be ErrInvalidReply, got: %v", err)
+	}
+}
+
+func TestService_AddMessage_ReplyToDeleted(t *testing.T) {
+	replyTo := int64(3)
+	m := new(database.MockStore)
+	m.On("GetMessagePreview", []string{"senderId", "recipientId"}, replyTo).Return(models.MessagePreview{ID: 3, Sender: "recipientId", Deleted: true}, nil)
+
+	s := Service{m}
+
+	_, _, err := s.AddMessage(models.Message{Sender: "senderId", Recipient: "recipientId", Content: "hi", ReplyTo: &replyTo})
+
+	m.AssertExpectations(t)
+
+	if !errors.Is(err, ErrInvalidReply) {
+		t.Errorf("error should be ErrInvalidReply, got: %v", err)
+	}
+}
+
+func TestService_AddReaction_Success(t *testing.T) {
+	change := models.ReactionChange{MessageId: 1, UserId: "recipientId", Emoji: "👍"}
+	m := new(database.MockStore)
+	m.On("AddReaction", change).Return(models.ReactionChange{MessageId: 1, UserId: "recipientId", Emoji: "👍", Sender: "senderId", Recipient: "recipientId"}, true, nil)
+
+	s := Service{m}
+
+	added, changed, err := s.AddReaction(change)
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if !changed || added.Sender != "senderId" {
+		t.Errorf("reaction should be added to the conversation, got: %+v", added)
+	}
+}
+
+func TestService_AddReaction_CustomEmoji(t *testing.T) {
+	change := models.ReactionChange{MessageId: 1, UserId: "recipientId", Emoji: "party_parrot:1234"}
+	m := new(database.MockStore)
+	m.On("AddReaction", change).Return(change, true, nil)
+
+	s := Service{m}
+
+	_, _, err := s.AddReaction(change)
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+}
+
+func TestService_AddReaction_InvalidEmoji(t *testing.T) {
+	m := new(database.MockStore)
+
+	s := Service{m}
+
+	for _, emoji := range []string{"", "lol", "👍 👍", "bad:emoji", strings.Repeat("👍", 20)} {
+		_, _, err := s.AddReaction(models.ReactionChange{MessageId: 1, UserId: "recipientId", Emoji: emoji})
+		if !errors.Is(err, ErrInvalidEmoji) {
+			t.Errorf("%q should be ErrInvalidEmoji, got: %v", emoji, err)
+		}
+	}
+
+	m.AssertNotCalled(t, "AddReaction", mock.Anything)
+}
+
+func TestService_RemoveReaction_NotFound(t *testing.T) {
+	change := models.ReactionChange{MessageId: 1, UserId: "outsiderId", Emoji: "👍"}
+	m := new(database.MockStore)
+	m.On("RemoveReaction", change).Return(models.ReactionChange{}, false, database.ErrNotFound)
+
+	s := Service{m}
+
+	_, _, err := s.RemoveReaction(change)
+
+	m.AssertExpectations(t)
+
+	if !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("error should be ErrMessageNotFound, got: %v", err)
+	}
+}
+
+func TestService_GetReactors_Paged(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("GetReactors", "senderId", int64(1), "👍", "", 3).Return([]models.User{{ID: "a"}, {ID: "b"}, {ID: "c"}}, nil)
+	m.On("GetReactors", "senderId", int64(1), "👍", "b", 3).Return([]models.User{{ID: "c"}}, nil)
+
+	s := Service{m}
+
+	first, err := s.GetReactors("senderId", 1, "👍", "", 2)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	if len(first.Users) != 2 || first.After == nil || *first.After != "b" {
+		t.Errorf("first page should stop after b, got: %+v", first)
+	}
+
+	last, err := s.GetReactors("senderId", 1, "👍", *first.After, 2)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	if len(last.Users) != 1 || last.After != nil {
+		t.Errorf("last page should have no cursor, got: %+v", last)
+	}
+
+	m.AssertExpectations(t)
+}
+
+func TestService_AddMessage_Attachments(t *testing.T) {
+	m := new(database.MockStore)
+	message := models.Message{Sender: "senderId", Recipient: "recipientId", Content: "logs", AttachmentIds: []int64{2, 1}}
+	m.On("CountAttachable", models.Message{Sender: "senderId", Recipient: "recipientId", Content: "logs", AttachmentIds: []int64{1, 2}}).Return(2, nil)
+	m.On("StoreMessage", mock.Anything).Return(models.Message{ID: 1, Sender: "senderId", Recipient: "recipientId", Attachments: []models.Attachment{{ID: 1}, {ID: 2}}}, true, nil)
+
+	s := Service{m}
+
+	stored, _, err := s.AddMessage(message)
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if len(stored.Attachments) != 2 {
+		t.Errorf("message should carry its attachments, got: %+v", stored)
+	}
+}
+
+func TestService_AddMessage_InvalidAttachment(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("CountAttachable", mock.Anything).Return(1, nil)
+
+	s := Service{m}
+
+	// someone else's upload, or one already sent, doesn't count
+	_, _, err := s.AddMessage(models.Message{Sender: "senderId", Recipient: "recipientId", Content: "logs", AttachmentIds: []int64{1, 2}})
+
+	if !errors.Is(err, ErrInvalidAttachment) {
+		t.Errorf("error should be ErrInvalidAttachment, got: %v", err)
+	}
+	m.AssertNotCalled(t, "StoreMessage", mock.Anything)
+}
+
+func TestService_AddMessage_AttachmentClaimed(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("CountAttachable", mock.Anything).Return(2, nil)
+	m.On("StoreMessage", mock.Anything).Return(models.Message{}, false, database.ErrAttachmentClaimed)
+
+	s := Service{m}
+
+	// another message took one of them after they were counted
+	_, _, err := s.AddMessage(models.Message{Sender: "senderId", Recipient: "recipientId", Content: "logs", AttachmentIds: []int64{1, 2}})
+
+	m.AssertExpectations(t)
+
+	if !errors.Is(err, ErrInvalidAttachment) {
+		t.Errorf("error should be ErrInvalidAttachment, got: %v", err)
+	}
+}
+
+func TestService_AddMessage_TooManyAttachments(t *testing.T) {
+	m := new(database.MockStore)
+
+	s := Service{m}
+
+	ids := make([]int64, maxAttachments+1)
+	for i := range ids {
+		ids[i] = int64(i + 1)
+	}
+	_, _, err := s.AddMessage(models.Message{Sender: "senderId", Recipient: "recipientId", Content: "logs", AttachmentIds: ids})
+
+	if !errors.Is(err, ErrInvalidAttachment) {
+		t.Errorf("error should be ErrInvalidAttachment, got: %v", err)
+	}
+	m.AssertNotCalled(t, "CountAttachable", mock.Anything)
+}
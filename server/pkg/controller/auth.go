@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"ivar/pkg/auth"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// authenticate returns the user the request's bearer token was issued to, the
+// same gateway token the WebSocket takes. Without a valid one it responds 401
+// and returns false.
+func (c *controller) authenticate(ctx *gin.Context) (string, bool) {
+	claims, err := c.authService.Verify(auth.BearerToken(ctx.Request))
+	if err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return "", false
+	}
+
+	return claims.Subject, true
+}
+
+// authenticateAs is authenticate for routes that name the user they act on. A
+// token issued to anyone else gets 403.
+func (c *controller) authenticateAs(ctx *gin.Context, userId string) bool {
+	subject, ok := c.authenticate(ctx)
+	if !ok {
+		return false
+	}
+	if subject != userId {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "token was issued to another user"})
+		return false
+	}
+
+	return true
+}
@@ -1,13 +1,21 @@
 package controller
 
 import (
+	"errors"
+	"ivar/pkg/attachment"
+	"ivar/pkg/auth"
 	"ivar/pkg/chat"
 	"ivar/pkg/models"
+	"ivar/pkg/presence"
+	"ivar/pkg/search"
 	"ivar/pkg/server"
 	"ivar/pkg/user"
 	"log"
+	"mime"
 	"net/http"
+	"slices"
 	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
 )
@@ -20,25 +28,57 @@ type Controller interface {
 	GetFriends(ctx *gin.Context)
 	RemoveFriend(ctx *gin.Context)
 	GetChatInfo(ctx *gin.Context)
+	GetReceipts(ctx *gin.Context)
 	AddMessage(ctx *gin.Context)
+	EditMessage(ctx *gin.Context)
+	DeleteMessage(ctx *gin.Context)
+	GetRevisions(ctx *gin.Context)
+	AddReaction(ctx *gin.Context)
+	RemoveReaction(ctx *gin.Context)
+	GetReactors(ctx *gin.Context)
+	UploadAttachment(ctx *gin.Context)
+	GetAttachment(ctx *gin.Context)
+	GetThumbnail(ctx *gin.Context)
+	Search(ctx *gin.Context)
 	GetMessages(ctx *gin.Context)
 	GetAllChats(ctx *gin.Context)
 	CreateServer(ctx *gin.Context)
 	GetServers(ctx *gin.Context)
 	CreateInvite(ctx *gin.Context)
+	GetPresences(ctx *gin.Context)
+	GetPrivacySettings(ctx *gin.Context)
+	UpdatePrivacySettings(ctx *gin.Context)
+}
+
+// Notifier tells connected clients about changes made over REST.
+type Notifier interface {
+	MessageUpdated(message models.Message)
+	MessageDeleted(message models.Message)
+	ReactionAdded(change models.ReactionChange)
+	ReactionRemoved(change models.ReactionChange)
 }
 
 type controller struct {
-	userService   *user.Service
-	chatService   *chat.Service
-	serverService *server.Service
+	userService       *user.Service
+	chatService       *chat.Service
+	serverService     *server.Service
+	presenceService   *presence.Service
+	attachmentService *attachment.Service
+	searchService     *search.Service
+	authService       *auth.Service
+	notifier          Notifier
 }
 
-func New(userService *user.Service, chatService *chat.Service, serverService *server.Service) *controller {
+func New(userService *user.Service, chatService *chat.Service, serverService *server.Service, presenceService *presence.Service, attachmentService *attachment.Service, searchService *search.Service, authService *auth.Service, notifier Notifier) *controller {
 	return &controller{
-		userService:   userService,
-		chatService:   chatService,
-		serverService: serverService,
+		userService:       userService,
+		chatService:       chatService,
+		serverService:     serverService,
+		presenceService:   presenceService,
+		attachmentService: attachmentService,
+		searchService:     searchService,
+		authService:       authService,
+		notifier:          notifier,
 	}
 }
 
@@ -167,6 +207,82 @@ func (c *controller) GetChatInfo(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, gin.H{"data": chatInfo})
 }
 
+func (c *controller) GetMessages(ctx *gin.Context) {
+	userId, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+	var query models.MessageQuery
+	if err := ctx.BindJSON(&query); err != nil {
+		ctx.Status(http.StatusBadRequest)
+		return
+	}
+	if len(query.Users) != 2 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "a conversation needs two users"})
+		return
+	}
+	if !slices.Contains(query.Users, userId) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "not a conversation you're in"})
+		return
+	}
+	// reactions are marked as the first user's
+	if query.Users[1] == userId {
+		query.Users[0], query.Users[1] = query.Users[1], query.Users[0]
+	}
+
+	cursors := 0
+	for _, cursor := range []int64{query.Before, query.After, query.Around} {
+		if cursor < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid cursor"})
+			return
+		}
+		if cursor != 0 {
+			cursors++
+		}
+	}
+	if cursors > 1 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "only one of before, after and around can be set"})
+		return
+	}
+
+	page, err := c.userService.GetMessages(query)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error getting messages"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"data": page})
+}
+
+// GetReceipts only shows a conversation's receipts to the two users in it.
+func (c *controller) GetReceipts(ctx *gin.Context) {
+	userId, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+	var chatInfoRequest models.ChatInfoRequest
+	if err := ctx.BindJSON(&chatInfoRequest); err != nil {
+		ctx.Status(http.StatusBadRequest)
+		return
+	}
+	if len(chatInfoRequest.Users) != 2 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "a conversation needs two users"})
+		return
+	}
+	if !slices.Contains(chatInfoRequest.Users, userId) {
+		ctx.JSON(http.StatusForbidden, gin.H{"error": "not a conversation you're in"})
+		return
+	}
+
+	receipts, err := c.chatService.GetReceipts(chatInfoRequest.Users)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error getting receipts"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"data": receipts})
+}
+
 func (c *controller) AddMessage(ctx *gin.Context) {
 	var message models.Message
 	if err := ctx.BindJSON(&message); err != nil {
@@ -174,14 +290,289 @@ func (c *controller) AddMessage(ctx *gin.Context) {
 		return
 	}
 
-	if err := c.chatService.AddMessage(message); err != nil {
+	message.Kind = models.MessageKindDefault
+
+	stored, _, err := c.chatService.AddMessage(message)
+	if err != nil {
+		if errors.Is(err, chat.ErrInvalidReply) || errors.Is(err, chat.ErrInvalidAttachment) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
+	ctx.JSON(http.StatusOK, gin.H{"data": stored})
+}
+
+func (c *controller) EditMessage(ctx *gin.Context) {
+	messageId, err := strconv.ParseInt(ctx.Param("messageId"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad message id"})
+		return
+	}
+
+	userId, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+
+	var edit models.EditMessageRequest
+	if err := ctx.BindJSON(&edit); err != nil {
+		ctx.Status(http.StatusBadRequest)
+		return
+	}
+
+	edited, err := c.chatService.EditMessage(userId, messageId, edit.Content)
+	if err != nil {
+		if errors.Is(err, chat.ErrMessageNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error editing message"})
+		return
+	}
+	c.notifier.MessageUpdated(edited)
+
+	ctx.JSON(http.StatusOK, gin.H{"data": edited})
+}
+
+func (c *controller) DeleteMessage(ctx *gin.Context) {
+	messageId, err := strconv.ParseInt(ctx.Param("messageId"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad message id"})
+		return
+	}
+
+	userId, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+
+	deleted, err := c.chatService.DeleteMessage(userId, messageId)
+	if err != nil {
+		if errors.Is(err, chat.ErrMessageNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error deleting message"})
+		return
+	}
+	c.notifier.MessageDeleted(deleted)
+
+	ctx.Status(http.StatusOK)
+}
+
+func (c *controller) GetRevisions(ctx *gin.Context) {
+	messageId, err := strconv.ParseInt(ctx.Param("messageId"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad message id"})
+		return
+	}
+	userId, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+
+	revisions, err := c.chatService.GetRevisions(userId, messageId)
+	if err != nil {
+		if errors.Is(err, chat.ErrMessageNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error getting revisions"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"data": revisions})
+}
+
+func (c *controller) AddReaction(ctx *gin.Context) {
+	c.changeReaction(ctx, c.chatService.AddReaction, c.notifier.ReactionAdded)
+}
+
+func (c *controller) RemoveReaction(ctx *gin.Context) {
+	c.changeReaction(ctx, c.chatService.RemoveReaction, c.notifier.ReactionRemoved)
+}
+
+func (c *controller) changeReaction(ctx *gin.Context, change func(models.ReactionChange) (models.ReactionChange, bool, error), notify func(models.ReactionChange)) {
+	messageId, err := strconv.ParseInt(ctx.Param("messageId"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad message id"})
+		return
+	}
+
+	userId, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+
+	changed, ok, err := change(models.ReactionChange{MessageId: messageId, UserId: userId, Emoji: ctx.Param("emoji")})
+	if err != nil {
+		switch {
+		case errors.Is(err, chat.ErrInvalidEmoji):
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		case errors.Is(err, chat.ErrMessageNotFound):
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		default:
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error changing reaction"})
+		}
+		return
+	}
+	if ok {
+		notify(changed)
+	}
+
 	ctx.Status(http.StatusOK)
 }
 
+func (c *controller) GetReactors(ctx *gin.Context) {
+	messageId, err := strconv.ParseInt(ctx.Param("messageId"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad message id"})
+		return
+	}
+	userId, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+	limit := 0
+	if l := ctx.Query("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad limit"})
+			return
+		}
+	}
+
+	page, err := c.chatService.GetReactors(userId, messageId, ctx.Param("emoji"), ctx.Query("after"), limit)
+	if err != nil {
+		if errors.Is(err, chat.ErrMessageNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error getting reactions"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"data": page})
+}
+
+// UploadAttachment takes the file as the raw request body, which is streamed
+// through to storage, so it has to say how long it is up front.
+func (c *controller) UploadAttachment(ctx *gin.Context) {
+	userId, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+	if ctx.Request.ContentLength < 0 {
+		ctx.JSON(http.StatusLengthRequired, gin.H{"error": "content length required"})
+		return
+	}
+
+	uploaded, err := c.attachmentService.Upload(ctx.Request.Context(), userId, ctx.Query("filename"), ctx.Request.Body, ctx.Request.ContentLength)
+	if err != nil {
+		switch {
+		case errors.Is(err, attachment.ErrTooLarge):
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		case errors.Is(err, attachment.ErrEmpty):
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		default:
+			log.Println("error uploading attachment: " + err.Error())
+			ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error uploading attachment"})
+		}
+		return
+	}
+
+	ctx.JSON(http.StatusCreated, gin.H{"data": uploaded})
+}
+
+func (c *controller) GetAttachment(ctx *gin.Context) {
+	c.serveAttachment(ctx, false)
+}
+
+func (c *controller) GetThumbnail(ctx *gin.Context) {
+	c.serveAttachment(ctx, true)
+}
+
+func (c *controller) serveAttachment(ctx *gin.Context, thumbnail bool) {
+	attachmentId, err := strconv.ParseInt(ctx.Param("attachmentId"), 10, 64)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad attachment id"})
+		return
+	}
+	// an <img> can't set a header, so it passes ?token= instead
+	userId, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+
+	open := c.attachmentService.Open
+	if thumbnail {
+		open = c.attachmentService.OpenThumbnail
+	}
+	found, blob, err := open(ctx.Request.Context(), userId, attachmentId)
+	if err != nil {
+		if errors.Is(err, attachment.ErrAttachmentNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error getting attachment"})
+		return
+	}
+	defer blob.Close()
+
+	contentType, length, disposition := found.ContentType, found.Size, "attachment"
+	if thumbnail {
+		contentType, length = attachment.ThumbnailType(found.ContentType), -1
+	}
+	// only images are shown inline; anything else, html above all, is a download
+	if strings.HasPrefix(contentType, "image/") {
+		disposition = "inline"
+	}
+
+	ctx.DataFromReader(http.StatusOK, length, contentType, blob, map[string]string{
+		"Content-Disposition":    mime.FormatMediaType(disposition, map[string]string{"filename": found.Filename}),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=86400",
+	})
+}
+
+func (c *controller) Search(ctx *gin.Context) {
+	userId, ok := c.authenticate(ctx)
+	if !ok {
+		return
+	}
+	var (
+		before int64
+		limit  int
+		err    error
+	)
+	if b := ctx.Query("before"); b != "" {
+		if before, err = strconv.ParseInt(b, 10, 64); err != nil || before < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad cursor"})
+			return
+		}
+	}
+	if l := ctx.Query("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": "bad limit"})
+			return
+		}
+	}
+
+	page, err := c.searchService.Search(userId, ctx.Query("q"), before, limit)
+	if err != nil {
+		if errors.Is(err, search.ErrInvalidQuery) {
+			ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error searching messages"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"data": page})
+}
+
 func (c *controller) GetAllChats(ctx *gin.Context) {
 	userId, _ := ctx.Params.Get("userId")
 
@@ -216,3 +607,54 @@ func (c *controller) CreateInvite(ctx *gin.Context) {
 
 	ctx.JSON(http.StatusOK, gin.H{"data": inviteCode})
 }
+
+func (c *controller) GetPresences(ctx *gin.Context) {
+	var presenceRequest models.PresenceRequest
+	if err := ctx.BindJSON(&presenceRequest); err != nil {
+		ctx.Status(http.StatusBadRequest)
+		return
+	}
+
+	presences, err := c.presenceService.GetPresences(presenceRequest.Users)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error getting presences"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"data": presences})
+}
+
+func (c *controller) GetPrivacySettings(ctx *gin.Context) {
+	userId, _ := ctx.Params.Get("userId")
+	if !c.authenticateAs(ctx, userId) {
+		return
+	}
+
+	settings, err := c.userService.GetPrivacySettings(userId)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error getting privacy settings"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"data": settings})
+}
+
+func (c *controller) UpdatePrivacySettings(ctx *gin.Context) {
+	userId, _ := ctx.Params.Get("userId")
+	if !c.authenticateAs(ctx, userId) {
+		return
+	}
+
+	var settings models.PrivacySettings
+	if err := ctx.BindJSON(&settings); err != nil {
+		ctx.Status(http.StatusBadRequest)
+		return
+	}
+
+	if err := c.userService.UpdatePrivacySettings(userId, settings); err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error updating privacy settings"})
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
@@ -0,0 +1,141 @@
+package controller
+
+import (
+	"ivar/pkg/auth"
+	"ivar/pkg/chat"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"ivar/pkg/user"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestController(m *database.MockStore) (*controller, *auth.Service) {
+	authService := &auth.Service{Key: []byte("local-signing-key")}
+	return New(&user.Service{Store: m}, &chat.Service{Store: m}, nil, nil, nil, nil, authService, nil), authService
+}
+
+// serve runs handler for a request to path, which fills in route's parameters,
+// with a bearer token for tokenUser unless it's empty.
+func serve(handler gin.HandlerFunc, method, route, path, body string, authService *auth.Service, tokenUser string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Handle(method, route, handler)
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if tokenUser != "" {
+		token, _ := authService.Sign(tokenUser, time.Minute)
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestController_GetPrivacySettings_Success(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("GetPrivacySettings", "userId1").Return(models.PrivacySettings{ReadReceipts: true}, nil)
+	c, authService := newTestController(m)
+
+	w := serve(c.GetPrivacySettings, http.MethodGet, "/users/:userId/privacy", "/users/userId1/privacy", "", authService, "userId1")
+
+	m.AssertExpectations(t)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status should be 200, got: %v", w.Code)
+	}
+}
+
+func TestController_GetPrivacySettings_NoToken(t *testing.T) {
+	m := new(database.MockStore)
+	c, authService := newTestController(m)
+
+	w := serve(c.GetPrivacySettings, http.MethodGet, "/users/:userId/privacy", "/users/userId1/privacy", "", authService, "")
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status should be 401, got: %v", w.Code)
+	}
+	m.AssertNotCalled(t, "GetPrivacySettings", mock.Anything)
+}
+
+func TestController_UpdatePrivacySettings_NoToken(t *testing.T) {
+	m := new(database.MockStore)
+	c, authService := newTestController(m)
+
+	w := serve(c.UpdatePrivacySettings, http.MethodPut, "/users/:userId/privacy", "/users/userId1/privacy", `{"readReceipts": true}`, authService, "")
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status should be 401, got: %v", w.Code)
+	}
+	m.AssertNotCalled(t, "UpdatePrivacySettings", mock.Anything, mock.Anything)
+}
+
+func TestController_UpdatePrivacySettings_OtherUser(t *testing.T) {
+	m := new(database.MockStore)
+	c, authService := newTestController(m)
+
+	// userId2 turning userId1's receipts back on
+	w := serve(c.UpdatePrivacySettings, http.MethodPut, "/users/:userId/privacy", "/users/userId1/privacy", `{"readReceipts": true}`, authService, "userId2")
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status should be 403, got: %v", w.Code)
+	}
+	m.AssertNotCalled(t, "UpdatePrivacySettings", mock.Anything, mock.Anything)
+}
+
+func TestController_GetReceipts_NoToken(t *testing.T) {
+	m := new(database.MockStore)
+	c, authService := newTestController(m)
+
+	w := serve(c.GetReceipts, http.MethodPost, "/chats/receipts", "/chats/receipts", `{"users": ["userId1", "userId2"]}`, authService, "")
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status should be 401, got: %v", w.Code)
+	}
+	m.AssertNotCalled(t, "GetReceipts", mock.Anything)
+}
+
+func TestController_GetReceipts_NotInConversation(t *testing.T) {
+	m := new(database.MockStore)
+	c, authService := newTestController(m)
+
+	w := serve(c.GetReceipts, http.MethodPost, "/chats/receipts", "/chats/receipts", `{"users": ["userId1", "userId2"]}`, authService, "userId3")
+
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status should be 403, got: %v", w.Code)
+	}
+	m.AssertNotCalled(t, "GetReceipts", mock.Anything)
+}
+
+func TestController_GetMessages_ViewerFromToken(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("RetrieveMessages", []string{"userId2", "userId1"}, int64(0), int64(0), mock.Anything).Return([]models.Message{}, nil)
+	c, authService := newTestController(m)
+
+	w := serve(c.GetMessages, http.MethodPost, "/chats/messages", "/chats/messages", `{"users": ["userId1", "userId2"]}`, authService, "userId2")
+
+	m.AssertExpectations(t)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status should be 200, got: %v", w.Code)
+	}
+}
+
+func TestController_GetMessages_NoToken(t *testing.T) {
+	m := new(database.MockStore)
+	c, authService := newTestController(m)
+
+	w := serve(c.GetMessages, http.MethodPost, "/chats/messages", "/chats/messages", `{"users": ["userId1", "userId2"]}`, authService, "")
+
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("status should be 401, got: %v", w.Code)
+	}
+	m.AssertNotCalled(t, "RetrieveMessages", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
@@ -20,13 +20,101 @@ type Store interface {
 	GetFriends(username string) ([]models.User, error)
 	RemoveFriend(currentUserId, toRemoveUserId string) error
 	GetChatInfo(users []string) (models.ChatInfo, error)
-	StoreMessage(message models.Message) error
-	RetrieveMessages(users []string) ([]models.Message, error)
+	StoreMessage(message models.Message) (models.Message, bool, error)
+	RetrieveMessages(users []string, before, after int64, limit int) ([]models.Message, error)
+	GetMessagePreview(users []string, messageId int64) (models.MessagePreview, error)
+	EditMessage(userId string, messageId int64, content string) (models.Message, error)
+	AddReaction(change models.ReactionChange) (models.ReactionChange, bool, error)
+	RemoveReaction(change models.ReactionChange) (models.ReactionChange, bool, error)
+	GetReactors(userId string, messageId int64, emoji, after string, limit int) ([]models.User, error)
+	DeleteMessage(userId string, messageId int64) (models.Message, error)
+	GetRevisions(userId string, messageId int64) ([]models.Revision, error)
+	CreateAttachment(attachment models.Attachment) (models.Attachment, error)
+	GetAttachment(userId string, attachmentId int64) (models.Attachment, error)
+	CountAttachable(message models.Message) (int, error)
+	SearchMessages(userId string, query models.SearchQuery, before int64, limit int) ([]models.SearchResult, error)
+	GetUndeliveredMessages(userId string, limit int) ([]models.Message, error)
+	CountUndeliveredMessages(userId string) (map[string]int, error)
+	MarkDelivered(userId string, upTo int64) error
+	MarkRead(userId, senderId string, upTo int64) error
+	GetReceipts(users []string) ([]models.Receipt, error)
+	GetPrivacySettings(userId string) (models.PrivacySettings, error)
+	UpdatePrivacySettings(userId string, settings models.PrivacySettings) error
 	AllChats(userId string) ([]models.User, error)
 	CreateServer(name, userId string) error
 	GetServers() ([]models.Server, error)
 	GetInvite(serverId int) (string, error)
 	StoreInvite(code string, serverId int) error
+	GetMemberServers(userId string) ([]string, error)
+}
+
+// ErrNotFound is returned when a row doesn't exist, or isn't the caller's to see
+// or change.
+var ErrNotFound = errors.New("not found")
+
+// ErrAttachmentClaimed is returned when another message claimed some of a
+// message's attachments while it was being stored. Nothing is stored.
+var ErrAttachmentClaimed = errors.New("attachment claimed by another message")
+
+// snippetLength is how many characters of a message a reply's preview quotes.
+const snippetLength = 100
+
+// replyPreview selects the preview of the message m replies to as json, or null,
+// given the replied-to message joined as r.
+const replyPreview = `case when r.id is null then null else json_build_object(
+		'id', r.id,
+		'sender', r.sender_id,
+		'snippet', case when r.deleted_at is null then left(r.content, @snippetLength) else '' end,
+		'deleted', r.deleted_at is not null
+	) end`
+
+// reactionCounts selects the reactions to message m as a json array, or null,
+// marking the ones @viewer made.
+const reactionCounts = `case when m.deleted_at is null then (
+		select json_agg(json_build_object('emoji', emoji, 'count', count, 'me', me) order by first)
+		from (
+			select emoji, count(*) as count, bool_or(user_id = @viewer) as me, min(created_at) as first
+			from message_reactions where message_id = m.id
+			group by emoji
+		) counts
+	) end`
+
+// attachmentFields builds the json for an attachment joined as a.
+const attachmentFields = `json_build_object(
+		'id', a.id,
+		'uploader', a.uploader_id,
+		'filename', a.filename,
+		'contentType', a.content_type,
+		'size', a.size,
+		'width', a.width,
+		'height', a.height,
+		'thumbnail', a.thumbnail_key is not null
+	)`
+
+// attachmentList selects the attachments of message m as a json array, or null.
+const attachmentList = `case when m.deleted_at is null then (
+		select json_agg(` + attachmentFields + ` order by a.id)
+		from attachments a where a.message_id = m.id
+	) end`
+
+// highlightStart and highlightStop mark the matches in search snippets. They're
+// control characters nobody types, and stripped from content before it's
+// highlighted all the same.
+const (
+	highlightStart = "\x02"
+	highlightStop  = "\x03"
+)
+
+// headlineOptions has ts_headline quote a couple of fragments of a message
+// around what matched.
+const headlineOptions = `StartSel="` + highlightStart + `", StopSel="` + highlightStop + `", MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=" … "`
+
+// searchHas is what each has: filter asks of a message m.
+var searchHas = map[models.SearchHas]string{
+	models.HasAttachment: `exists (select 1 from attachments a where a.message_id = m.id)`,
+	models.HasImage:      `exists (select 1 from attachments a where a.message_id = m.id and a.content_type like 'image/%')`,
+	models.HasLink:       `m.content ~* 'https?://'`,
+	models.HasReply:      `m.reply_to is not null`,
 }
 
 type store struct {
@@ -40,7 +128,10 @@ func NewStore(db *pgxpool.Pool) Store {
 }
 
 func (s *store) CreateServer(name, userId string) error {
-	query := "insert into servers (name, owner) values (@name, @owner) on conflict do nothing"
+	query := `with server as (
+		insert into servers (name, owner) values (@name, @owner) on conflict do nothing returning id
+	)
+	insert into server_members (server_id, user_id) select id, @owner from server`
 	args := pgx.NamedArgs{
 		"name":  name,
 		"owner": userId,
@@ -198,24 +289,514 @@ func (s *store) GetChatInfo(users []string) (models.ChatInfo, error) {
 	return models.ChatInfo{Users: userDetails}, nil
 }
 
-func (s *store) StoreMessage(message models.Message) error {
-	query := "insert into messages (sender_id, recipient_id, content) values (@senderId, @recipientId, @content)"
+// StoreMessage inserts a message and returns it as stored, with its id and
+// timestamp. If the sender already stored a message with the same nonce nothing
+// is inserted; the earlier message is returned instead and created is false.
+func (s *store) StoreMessage(message models.Message) (models.Message, bool, error) {
+	query := `with inserted as (
+		insert into messages (sender_id, recipient_id, content, nonce, kind, reply_to, mentions)
+		values (@senderId, @recipientId, @content, nullif(@nonce, ''), coalesce(nullif(@kind, ''), 'default'), @replyTo, coalesce(@mentions::text[], '{}'))
+		on conflict (sender_id, nonce) where nonce is not null do nothing
+		returning id, timestamp, content, sender_id, recipient_id, kind, edited_at, deleted_at, reply_to, mentions
+	), attached as (
+		update attachments a set message_id = inserted.id
+		from inserted
+		where a.id = any(@attachmentIds) and a.uploader_id = @senderId and a.message_id is null
+		returning a.*
+	)
+	select id, timestamp, content, sender_id, recipient_id, kind, edited_at, deleted_at is not null, reply_to, mentions,
+	(select json_agg(` + attachmentFields + ` order by a.id) from attached a), true from inserted
+	union all
+	select id, timestamp, case when deleted_at is null then content else '' end, sender_id, recipient_id, kind, edited_at, deleted_at is not null, reply_to, mentions,
+	` + attachmentList + `, false from messages m
+	where sender_id = @senderId and nonce = nullif(@nonce, '') and not exists (select 1 from inserted)`
 	args := pgx.NamedArgs{
-		"senderId":    message.Sender,
-		"recipientId": message.Recipient,
-		"content":     message.Content,
+		"senderId":      message.Sender,
+		"recipientId":   message.Recipient,
+		"content":       message.Content,
+		"nonce":         message.Nonce,
+		"kind":          message.Kind,
+		"replyTo":       message.ReplyTo,
+		"mentions":      message.Mentions,
+		"attachmentIds": message.AttachmentIds,
 	}
 
-	if _, err := s.db.Exec(context.Background(), query, args); err != nil {
+	stored := models.Message{Nonce: message.Nonce}
+	var created bool
+	for attempt := 0; attempt < 2; attempt++ {
+		// the insert is rolled back if it couldn't claim every attachment
+		tx, err := s.db.Begin(context.Background())
+		if err != nil {
+			log.Println("unable to begin transaction: " + err.Error())
+			return models.Message{}, false, err
+		}
+
+		err = tx.QueryRow(context.Background(), query, args).Scan(&stored.ID, &stored.Timestamp, &stored.Content, &stored.Sender, &stored.Recipient, &stored.Kind, &stored.EditedAt, &stored.Deleted, &stored.ReplyTo, &stored.Mentions, &stored.Attachments, &created)
+		if err == nil && created && len(stored.Attachments) != len(message.AttachmentIds) {
+			err = ErrAttachmentClaimed
+		}
+		if err != nil {
+			_ = tx.Rollback(context.Background())
+			// a concurrent insert with the same nonce that commits after this
+			// statement started is neither inserted nor visible to it, so look
+			// again
+			if errors.Is(err, pgx.ErrNoRows) {
+				continue
+			}
+			log.Println("unable to insert row: " + err.Error())
+			return models.Message{}, false, err
+		}
+
+		if err := tx.Commit(context.Background()); err != nil {
+			log.Println("unable to commit transaction: " + err.Error())
+			return models.Message{}, false, err
+		}
+		return stored, created, nil
+	}
+
+	log.Println("unable to insert row: nonce conflict")
+	return models.Message{}, false, pgx.ErrNoRows
+}
+
+// RetrieveMessages returns up to limit messages from a DM, newest first. With
+// after set they're the ones right after it, otherwise the ones right before
+// before, or the latest if that isn't set either. Deleted messages come back as
+// tombstones, without their content. Reactions are marked as the first user's.
+func (s *store) RetrieveMessages(users []string, before, after int64, limit int) ([]models.Message, error) {
+	// page from the cursor outwards, so an after page starts right after it
+	order := "desc"
+	if after != 0 {
+		order = "asc"
+	}
+	query := `select * from (
+		select m.id, m.timestamp, case when m.deleted_at is null then m.content else '' end as content, m.sender_id as sender, m.recipient_id as recipient, m.kind,
+		m.edited_at as editedAt, m.deleted_at is not null as deleted, m.reply_to as replyTo, ` + replyPreview + ` as reply, m.mentions,
+		` + reactionCounts + ` as reactions, ` + attachmentList + ` as attachments
+		from messages m
+		left join messages r on r.id = m.reply_to
+		where least(m.sender_id, m.recipient_id) = least(@userA, @userB) and greatest(m.sender_id, m.recipient_id) = greatest(@userA, @userB)
+		and (@before = 0 or m.id < @before) and (@after = 0 or m.id > @after)
+		order by m.id ` + order + `
+		limit @limit
+	) page order by id desc`
+	args := pgx.NamedArgs{
+		"userA":         users[0],
+		"userB":         users[1],
+		"before":        before,
+		"after":         after,
+		"limit":         limit,
+		"snippetLength": snippetLength,
+		"viewer":        users[0],
+	}
+
+	rows, _ := s.db.Query(context.Background(), query, args)
+	messages, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.Message])
+	if err != nil {
+		log.Println("unable to fetch rows: " + err.Error())
+		return []models.Message{}, err
+	}
+
+	return messages, nil
+}
+
+// GetMessagePreview returns the preview of a message from the DM between users,
+// deleted or not.
+func (s *store) GetMessagePreview(users []string, messageId int64) (models.MessagePreview, error) {
+	query := `select id, sender_id, case when deleted_at is null then left(content, @snippetLength) else '' end, deleted_at is not null from messages
+	where id = @messageId
+	and least(sender_id, recipient_id) = least(@userA, @userB) and greatest(sender_id, recipient_id) = greatest(@userA, @userB)`
+	args := pgx.NamedArgs{
+		"messageId":     messageId,
+		"userA":         users[0],
+		"userB":         users[1],
+		"snippetLength": snippetLength,
+	}
+
+	var preview models.MessagePreview
+	err := s.db.QueryRow(context.Background(), query, args).Scan(&preview.ID, &preview.Sender, &preview.Snippet, &preview.Deleted)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.MessagePreview{}, ErrNotFound
+	}
+	if err != nil {
+		log.Println("unable to fetch row: " + err.Error())
+		return models.MessagePreview{}, err
+	}
+
+	return preview, nil
+}
+
+// EditMessage changes the content of one of the user's messages, keeping what it
+// said before as a revision. Only ordinary messages that haven't been deleted
+// can be edited.
+func (s *store) EditMessage(userId string, messageId int64, content string) (models.Message, error) {
+	query := `with previous as (
+		select id, content, coalesce(edited_at, timestamp) as revised_at from messages
+		where id = @messageId and sender_id = @userId and kind = 'default' and deleted_at is null
+		for update
+	), revision as (
+		insert into message_revisions (message_id, content, revised_at)
+		select id, content, revised_at from previous
+	)
+	update messages m set content = @content, edited_at = now()
+	from previous
+	where m.id = previous.id
+	returning m.id, m.timestamp, m.content, m.sender_id, m.recipient_id, m.kind, m.edited_at`
+	args := pgx.NamedArgs{
+		"userId":    userId,
+		"messageId": messageId,
+		"content":   content,
+	}
+
+	var edited models.Message
+	err := s.db.QueryRow(context.Background(), query, args).Scan(&edited.ID, &edited.Timestamp, &edited.Content, &edited.Sender, &edited.Recipient, &edited.Kind, &edited.EditedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Message{}, ErrNotFound
+	}
+	if err != nil {
+		log.Println("unable to update row: " + err.Error())
+		return models.Message{}, err
+	}
+
+	return edited, nil
+}
+
+// AddReaction records a user's reaction to a message on either side of their DM
+// that hasn't been deleted, and returns the change with the DM filled in.
+// changed is false if they had already reacted with that emoji.
+func (s *store) AddReaction(change models.ReactionChange) (models.ReactionChange, bool, error) {
+	query := `with target as (
+		select id, sender_id, recipient_id from messages
+		where id = @messageId and (sender_id = @userId or recipient_id = @userId) and deleted_at is null
+	), inserted as (
+		insert into message_reactions (message_id, user_id, emoji)
+		select id, @userId, @emoji from target
+		on conflict do nothing
+		returning message_id
+	)
+	select sender_id, recipient_id, exists (select 1 from inserted) from target`
+
+	return s.changeReaction(query, change)
+}
+
+// RemoveReaction takes back a user's reaction, like AddReaction.
+func (s *store) RemoveReaction(change models.ReactionChange) (models.ReactionChange, bool, error) {
+	query := `with target as (
+		select id, sender_id, recipient_id from messages
+		where id = @messageId and (sender_id = @userId or recipient_id = @userId) and deleted_at is null
+	), removed as (
+		delete from message_reactions
+		where message_id = (select id from target) and user_id = @userId and emoji = @emoji
+		returning message_id
+	)
+	select sender_id, recipient_id, exists (select 1 from removed) from target`
+
+	return s.changeReaction(query, change)
+}
+
+func (s *store) changeReaction(query string, change models.ReactionChange) (models.ReactionChange, bool, error) {
+	args := pgx.NamedArgs{
+		"messageId": change.MessageId,
+		"userId":    change.UserId,
+		"emoji":     change.Emoji,
+	}
+
+	var changed bool
+	err := s.db.QueryRow(context.Background(), query, args).Scan(&change.Sender, &change.Recipient, &changed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.ReactionChange{}, false, ErrNotFound
+	}
+	if err != nil {
+		log.Println("unable to update rows: " + err.Error())
+		return models.ReactionChange{}, false, err
+	}
+
+	return change, changed, nil
+}
+
+// GetReactors returns up to limit of the users who reacted to a message with an
+// emoji, in id order after the given id, as long as userId can see the message.
+func (s *store) GetReactors(userId string, messageId int64, emoji, after string, limit int) ([]models.User, error) {
+	var visible bool
+	if err := s.db.QueryRow(context.Background(), `select exists (
+		select 1 from messages where id = $1 and (sender_id = $2 or recipient_id = $2) and deleted_at is null
+	)`, messageId, userId).Scan(&visible); err != nil {
+		log.Println("unable to fetch row: " + err.Error())
+		return []models.User{}, err
+	}
+	if !visible {
+		return []models.User{}, ErrNotFound
+	}
+
+	query := `select u.id, u.username from message_reactions r
+	inner join users u
+	on u.id = r.user_id
+	where r.message_id = @messageId and r.emoji = @emoji and r.user_id > @after
+	order by r.user_id
+	limit @limit`
+	args := pgx.NamedArgs{
+		"messageId": messageId,
+		"emoji":     emoji,
+		"after":     after,
+		"limit":     limit,
+	}
+
+	rows, _ := s.db.Query(context.Background(), query, args)
+	users, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.User])
+	if err != nil {
+		log.Println("unable to fetch rows: " + err.Error())
+		return []models.User{}, err
+	}
+
+	return users, nil
+}
+
+// DeleteMessage leaves a tombstone in place of one of the user's messages. The
+// content stays in the table, and its revisions with it, but is never served.
+func (s *store) DeleteMessage(userId string, messageId int64) (models.Message, error) {
+	query := `update messages set deleted_at = now()
+	where id = @messageId and sender_id = @userId and deleted_at is null
+	returning id, timestamp, sender_id, recipient_id, kind, edited_at`
+	args := pgx.NamedArgs{
+		"userId":    userId,
+		"messageId": messageId,
+	}
+
+	deleted := models.Message{Deleted: true}
+	err := s.db.QueryRow(context.Background(), query, args).Scan(&deleted.ID, &deleted.Timestamp, &deleted.Sender, &deleted.Recipient, &deleted.Kind, &deleted.EditedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Message{}, ErrNotFound
+	}
+	if err != nil {
+		log.Println("unable to update row: " + err.Error())
+		return models.Message{}, err
+	}
+
+	return deleted, nil
+}
+
+// GetRevisions returns what a message said before each of its edits, oldest
+// first, as long as the user is on either side of it and it isn't deleted.
+func (s *store) GetRevisions(userId string, messageId int64) ([]models.Revision, error) {
+	var visible bool
+	if err := s.db.QueryRow(context.Background(), `select exists (
+		select 1 from messages where id = $1 and (sender_id = $2 or recipient_id = $2) and deleted_at is null
+	)`, messageId, userId).Scan(&visible); err != nil {
+		log.Println("unable to fetch row: " + err.Error())
+		return []models.Revision{}, err
+	}
+	if !visible {
+		return []models.Revision{}, ErrNotFound
+	}
+
+	rows, _ := s.db.Query(context.Background(), `select content, revised_at as revisedAt from message_revisions
+	where message_id = $1
+	order by id`, messageId)
+	revisions, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.Revision])
+	if err != nil {
+		log.Println("unable to fetch rows: " + err.Error())
+		return []models.Revision{}, err
+	}
+
+	return revisions, nil
+}
+
+// CreateAttachment records an upload whose blobs are already stored, and returns
+// it with its id.
+func (s *store) CreateAttachment(attachment models.Attachment) (models.Attachment, error) {
+	query := `insert into attachments (uploader_id, filename, content_type, size, blob_key, width, height, thumbnail_key)
+	values (@uploaderId, @filename, @contentType, @size, @blobKey, @width, @height, nullif(@thumbnailKey, ''))
+	returning id`
+	args := pgx.NamedArgs{
+		"uploaderId":   attachment.Uploader,
+		"filename":     attachment.Filename,
+		"contentType":  attachment.ContentType,
+		"size":         attachment.Size,
+		"blobKey":      attachment.BlobKey,
+		"width":        attachment.Width,
+		"height":       attachment.Height,
+		"thumbnailKey": attachment.ThumbnailKey,
+	}
+
+	if err := s.db.QueryRow(context.Background(), query, args).Scan(&attachment.ID); err != nil {
 		log.Println("unable to insert row: " + err.Error())
-		return err
+		return models.Attachment{}, err
 	}
+	attachment.Thumbnail = attachment.ThumbnailKey != ""
 
-	return nil
+	return attachment, nil
+}
+
+// GetAttachment returns an attachment the user can see: their own upload that no
+// message has claimed yet, or one on either side of their DM whose message
+// hasn't been deleted.
+func (s *store) GetAttachment(userId string, attachmentId int64) (models.Attachment, error) {
+	query := `select a.id, a.uploader_id, a.filename, a.content_type, a.size, a.width, a.height,
+	a.thumbnail_key is not null, a.blob_key, coalesce(a.thumbnail_key, '')
+	from attachments a
+	left join messages m
+	on m.id = a.message_id
+	where a.id = @attachmentId and (
+		(a.message_id is null and a.uploader_id = @userId)
+		or (m.deleted_at is null and (m.sender_id = @userId or m.recipient_id = @userId))
+	)`
+	args := pgx.NamedArgs{
+		"userId":       userId,
+		"attachmentId": attachmentId,
+	}
+
+	var a models.Attachment
+	err := s.db.QueryRow(context.Background(), query, args).Scan(&a.ID, &a.Uploader, &a.Filename, &a.ContentType, &a.Size, &a.Width, &a.Height, &a.Thumbnail, &a.BlobKey, &a.ThumbnailKey)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return models.Attachment{}, ErrNotFound
+	}
+	if err != nil {
+		log.Println("unable to fetch row: " + err.Error())
+		return models.Attachment{}, err
+	}
+
+	return a, nil
 }
 
-func (s *store) RetrieveMessages(users []string) ([]models.Message, error) {
-	rows, _ := s.db.Query(context.Background(), `select id, timestamp, content, sender_id as sender, recipient_id as recipient from messages m where (sender_id = $1 or recipient_id = $1) and (sender_id = $2 or recipient_id = $2) order by timestamp desc`, users[0], users[1])
+// CountAttachable counts how many of a message's attachment ids it can carry:
+// the sender's uploads that no message has claimed, or that a message with the
+// same nonce already did, so a retry can carry them again.
+func (s *store) CountAttachable(message models.Message) (int, error) {
+	query := `select count(*) from attachments a
+	left join messages m
+	on m.id = a.message_id
+	where a.id = any(@attachmentIds) and a.uploader_id = @senderId
+	and (a.message_id is null or (m.sender_id = @senderId and m.nonce = nullif(@nonce, '')))`
+	args := pgx.NamedArgs{
+		"attachmentIds": message.AttachmentIds,
+		"senderId":      message.Sender,
+		"nonce":         message.Nonce,
+	}
+
+	var count int
+	if err := s.db.QueryRow(context.Background(), query, args).Scan(&count); err != nil {
+		log.Println("unable to fetch row: " + err.Error())
+		return 0, err
+	}
+
+	return count, nil
+}
+
+// SearchMessages returns up to limit messages from the user's DMs that match a
+// search, newest first, starting before the given id if it isn't 0. Deleted
+// messages are never found.
+func (s *store) SearchMessages(userId string, query models.SearchQuery, before int64, limit int) ([]models.SearchResult, error) {
+	conditions := []string{"(m.sender_id = @userId or m.recipient_id = @userId)", "m.deleted_at is null"}
+	snippet := `left(translate(m.content, @markers, ''), @snippetLength)`
+	if query.Terms != "" {
+		conditions = append(conditions, `m.search @@ websearch_to_tsquery('english', @terms)`)
+		snippet = `ts_headline('english', translate(m.content, @markers, ''), websearch_to_tsquery('english', @terms), @headlineOptions)`
+	}
+	if len(query.From) > 0 {
+		conditions = append(conditions, `exists (select 1 from users u where u.id = m.sender_id and lower(u.username) = any(@from))`)
+	}
+	if len(query.In) > 0 {
+		conditions = append(conditions, `exists (
+			select 1 from users u
+			where u.id = case when m.sender_id = @userId then m.recipient_id else m.sender_id end and lower(u.username) = any(@in)
+		)`)
+	}
+	for _, has := range query.Has {
+		condition, ok := searchHas[has]
+		if !ok {
+			return []models.SearchResult{}, errors.New("unknown has filter: " + string(has))
+		}
+		conditions = append(conditions, condition)
+	}
+	if query.Since != nil {
+		conditions = append(conditions, "m.timestamp >= @since")
+	}
+	if query.Until != nil {
+		conditions = append(conditions, "m.timestamp < @until")
+	}
+	if before != 0 {
+		conditions = append(conditions, "m.id < @before")
+	}
+
+	sql := `select m.id, m.timestamp, m.content, m.sender_id as sender, m.recipient_id as recipient, m.kind,
+	m.edited_at as editedAt, false as deleted, m.reply_to as replyTo, ` + replyPreview + ` as reply, m.mentions,
+	` + reactionCounts + ` as reactions, ` + attachmentList + ` as attachments,
+	` + snippet + ` as headline
+	from messages m
+	left join messages r on r.id = m.reply_to
+	where ` + strings.Join(conditions, " and ") + `
+	order by m.id desc
+	limit @limit`
+	args := pgx.NamedArgs{
+		"userId":          userId,
+		"terms":           query.Terms,
+		"from":            query.From,
+		"in":              query.In,
+		"since":           query.Since,
+		"until":           query.Until,
+		"before":          before,
+		"limit":           limit,
+		"markers":         highlightStart + highlightStop,
+		"headlineOptions": headlineOptions,
+		"snippetLength":   snippetLength,
+		"viewer":          userId,
+	}
+
+	type row struct {
+		models.Message
+		Headline string
+	}
+	rows, _ := s.db.Query(context.Background(), sql, args)
+	found, err := pgx.CollectRows(rows, pgx.RowToStructByName[row])
+	if err != nil {
+		log.Println("unable to fetch rows: " + err.Error())
+		return []models.SearchResult{}, err
+	}
+
+	results := make([]models.SearchResult, len(found))
+	for i, r := range found {
+		results[i] = models.SearchResult{Message: r.Message, Snippet: highlights(r.Headline)}
+	}
+	return results, nil
+}
+
+// highlights splits a ts_headline snippet into the runs between its markers.
+func highlights(headline string) []models.SnippetPart {
+	parts := []models.SnippetPart{}
+	match := false
+	for headline != "" {
+		marker := highlightStart
+		if match {
+			marker = highlightStop
+		}
+		text, rest, found := strings.Cut(headline, marker)
+		if text != "" {
+			parts = append(parts, models.SnippetPart{Text: text, Match: match})
+		}
+		headline = rest
+		if found {
+			match = !match
+		}
+	}
+	return parts
+}
+
+func (s *store) GetUndeliveredMessages(userId string, limit int) ([]models.Message, error) {
+	query := `select m.id, m.timestamp, m.content, m.sender_id as sender, m.recipient_id as recipient, m.kind,
+	m.edited_at as editedAt, false as deleted, m.reply_to as replyTo, ` + replyPreview + ` as reply, m.mentions,
+	` + reactionCounts + ` as reactions, ` + attachmentList + ` as attachments
+	from messages m
+	left join messages r on r.id = m.reply_to
+	where m.recipient_id = @userId and m.delivered_at is null and m.deleted_at is null
+	order by m.id
+	limit @limit`
+	args := pgx.NamedArgs{
+		"userId":        userId,
+		"limit":         limit,
+		"snippetLength": snippetLength,
+		"viewer":        userId,
+	}
+
+	rows, _ := s.db.Query(context.Background(), query, args)
 	messages, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.Message])
 	if err != nil {
 		log.Println("unable to fetch rows: " + err.Error())
@@ -225,6 +806,105 @@ func (s *store) RetrieveMessages(users []string) ([]models.Message, error) {
 	return messages, nil
 }
 
+// CountUndeliveredMessages counts the messages waiting for a user, keyed by who
+// sent them.
+func (s *store) CountUndeliveredMessages(userId string) (map[string]int, error) {
+	rows, _ := s.db.Query(context.Background(), `select sender_id, count(*) from messages
+	where recipient_id = $1 and delivered_at is null and deleted_at is null
+	group by sender_id`, userId)
+	counts := make(map[string]int)
+	var (
+		sender string
+		count  int
+	)
+	if _, err := pgx.ForEachRow(rows, []any{&sender, &count}, func() error {
+		counts[sender] = count
+		return nil
+	}); err != nil {
+		log.Println("unable to fetch rows: " + err.Error())
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+// MarkDelivered marks every message to the user up to and including upTo as
+// delivered.
+func (s *store) MarkDelivered(userId string, upTo int64) error {
+	query := "update messages set delivered_at = now() where recipient_id = @userId and id <= @upTo and delivered_at is null"
+	args := pgx.NamedArgs{
+		"userId": userId,
+		"upTo":   upTo,
+	}
+
+	if _, err := s.db.Exec(context.Background(), query, args); err != nil {
+		log.Println("unable to update rows: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// MarkRead marks every message the sender sent the user, up to and including
+// upTo, as read. Anything read has been delivered too.
+func (s *store) MarkRead(userId, senderId string, upTo int64) error {
+	query := `update messages set read_at = now(), delivered_at = coalesce(delivered_at, now())
+	where recipient_id = @userId and sender_id = @senderId and id <= @upTo and read_at is null`
+	args := pgx.NamedArgs{
+		"userId":   userId,
+		"senderId": senderId,
+		"upTo":     upTo,
+	}
+
+	if _, err := s.db.Exec(context.Background(), query, args); err != nil {
+		log.Println("unable to update rows: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
+func (s *store) GetReceipts(users []string) ([]models.Receipt, error) {
+	rows, _ := s.db.Query(context.Background(), `select m.id as messageId, m.recipient_id as userId, m.delivered_at as deliveredAt, case when u.read_receipts then m.read_at end as readAt
+	from messages m
+	inner join users u
+	on u.id = m.recipient_id
+	where ((m.sender_id = $1 and m.recipient_id = $2) or (m.sender_id = $2 and m.recipient_id = $1)) and m.delivered_at is not null
+	order by m.id desc`, users[0], users[1])
+	receipts, err := pgx.CollectRows(rows, pgx.RowToStructByName[models.Receipt])
+	if err != nil {
+		log.Println("unable to fetch rows: " + err.Error())
+		return []models.Receipt{}, err
+	}
+
+	return receipts, nil
+}
+
+func (s *store) GetPrivacySettings(userId string) (models.PrivacySettings, error) {
+	var settings models.PrivacySettings
+	if err := s.db.QueryRow(context.Background(), "select read_receipts from users where id = $1", userId).Scan(&settings.ReadReceipts); err != nil {
+		log.Println("unable to query row: " + err.Error())
+		return models.PrivacySettings{}, err
+	}
+
+	return settings, nil
+}
+
+func (s *store) UpdatePrivacySettings(userId string, settings models.PrivacySettings) error {
+	query := "update users set read_receipts = @readReceipts where id = @id"
+	args := pgx.NamedArgs{
+		"readReceipts": settings.ReadReceipts,
+		"id":           userId,
+	}
+
+	if _, err := s.db.Exec(context.Background(), query, args); err != nil {
+		log.Println("unable to update row: " + err.Error())
+		return err
+	}
+
+	return nil
+}
+
 func (s *store) AllChats(userId string) ([]models.User, error) {
 	rows, _ := s.db.Query(context.Background(), `select
 	json_agg(
@@ -284,3 +964,14 @@ func (s *store) StoreInvite(code string, serverId int) error {
 
 	return nil
 }
+
+func (s *store) GetMemberServers(userId string) ([]string, error) {
+	rows, _ := s.db.Query(context.Background(), "select server_id::text from server_members where user_id = $1", userId)
+	servers, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	if err != nil {
+		log.Println("unable to fetch rows: " + err.Error())
+		return nil, err
+	}
+
+	return servers, nil
+}
@@ -0,0 +1,55 @@
+package database
+
+import (
+	"context"
+	"ivar/pkg/models"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestStore_StoreMessage_Mentions(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer db.Close()
+
+	s := NewStore(db)
+	for _, id := range []string{"storeSender", "storeRecipient"} {
+		if err := s.CreateUser(id, id); err != nil {
+			t.Fatalf("error creating user: %v", err)
+		}
+	}
+	defer db.Exec(context.Background(), "delete from messages where sender_id = 'storeSender'")
+
+	tests := []struct {
+		name     string
+		mentions []string
+		want     []string
+	}{
+		{"without mentions", nil, []string{}},
+		{"with mentions", []string{"storeRecipient"}, []string{"storeRecipient"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stored, created, err := s.StoreMessage(models.Message{Sender: "storeSender", Recipient: "storeRecipient", Content: "hi", Mentions: test.mentions})
+			if err != nil {
+				t.Fatalf("error should be nil, got: %v", err)
+			}
+			if !created {
+				t.Errorf("message should be created")
+			}
+			if !slices.Equal(stored.Mentions, test.want) {
+				t.Errorf("mentions should be %v, got: %v", test.want, stored.Mentions)
+			}
+		})
+	}
+}
@@ -58,16 +58,104 @@ func (m *MockStore) GetChatInfo(users []string) (models.ChatInfo, error) {
 	return returnVals.Get(0).(models.ChatInfo), returnVals.Error(1)
 }
 
-func (m *MockStore) StoreMessage(message models.Message) error {
+func (m *MockStore) StoreMessage(message models.Message) (models.Message, bool, error) {
 	returnVals := m.Called(message)
 
+	// tests that don't care about ids can return a func to derive the stored message
+	if store, ok := returnVals.Get(0).(func(models.Message) models.Message); ok {
+		return store(message), returnVals.Bool(1), returnVals.Error(2)
+	}
+	return returnVals.Get(0).(models.Message), returnVals.Bool(1), returnVals.Error(2)
+}
+
+func (m *MockStore) RetrieveMessages(users []string, before, after int64, limit int) ([]models.Message, error) {
+	returnVals := m.Called(users, before, after, limit)
+
+	return returnVals.Get(0).([]models.Message), returnVals.Error(1)
+}
+
+func (m *MockStore) GetMessagePreview(users []string, messageId int64) (models.MessagePreview, error) {
+	returnVals := m.Called(users, messageId)
+
+	return returnVals.Get(0).(models.MessagePreview), returnVals.Error(1)
+}
+
+func (m *MockStore) EditMessage(userId string, messageId int64, content string) (models.Message, error) {
+	returnVals := m.Called(userId, messageId, content)
+
+	return returnVals.Get(0).(models.Message), returnVals.Error(1)
+}
+
+func (m *MockStore) AddReaction(change models.ReactionChange) (models.ReactionChange, bool, error) {
+	returnVals := m.Called(change)
+
+	return returnVals.Get(0).(models.ReactionChange), returnVals.Bool(1), returnVals.Error(2)
+}
+
+func (m *MockStore) RemoveReaction(change models.ReactionChange) (models.ReactionChange, bool, error) {
+	returnVals := m.Called(change)
+
+	return returnVals.Get(0).(models.ReactionChange), returnVals.Bool(1), returnVals.Error(2)
+}
+
+func (m *MockStore) GetReactors(userId string, messageId int64, emoji, after string, limit int) ([]models.User, error) {
+	returnVals := m.Called(userId, messageId, emoji, after, limit)
+
+	return returnVals.Get(0).([]models.User), returnVals.Error(1)
+}
+
+func (m *MockStore) DeleteMessage(userId string, messageId int64) (models.Message, error) {
+	returnVals := m.Called(userId, messageId)
+
+	return returnVals.Get(0).(models.Message), returnVals.Error(1)
+}
+
+func (m *MockStore) GetRevisions(userId string, messageId int64) ([]models.Revision, error) {
+	returnVals := m.Called(userId, messageId)
+
+	return returnVals.Get(0).([]models.Revision), returnVals.Error(1)
+}
+
+func (m *MockStore) GetUndeliveredMessages(userId string, limit int) ([]models.Message, error) {
+	returnVals := m.Called(userId, limit)
+
+	return returnVals.Get(0).([]models.Message), returnVals.Error(1)
+}
+
+func (m *MockStore) CountUndeliveredMessages(userId string) (map[string]int, error) {
+	returnVals := m.Called(userId)
+
+	return returnVals.Get(0).(map[string]int), returnVals.Error(1)
+}
+
+func (m *MockStore) MarkDelivered(userId string, upTo int64) error {
+	returnVals := m.Called(userId, upTo)
+
 	return returnVals.Error(0)
 }
 
-func (m *MockStore) RetrieveMessages(users []string) ([]models.Message, error) {
+func (m *MockStore) MarkRead(userId, senderId string, upTo int64) error {
+	returnVals := m.Called(userId, senderId, upTo)
+
+	return returnVals.Error(0)
+}
+
+func (m *MockStore) GetReceipts(users []string) ([]models.Receipt, error) {
 	returnVals := m.Called(users)
 
-	return returnVals.Get(0).([]models.Message), returnVals.Error(1)
+	return returnVals.Get(0).([]models.Receipt), returnVals.Error(1)
+}
+
+func (m *MockStore) GetPrivacySettings(userId string) (models.PrivacySettings, error) {
+	returnVals := m.Called(userId)
+
+	return returnVals.Get(0).(models.PrivacySettings), returnVals.Error(1)
+}
+
+func (m *MockStore) UpdatePrivacySettings(userId string, settings models.PrivacySettings) error {
+	returnVals := m.Called(userId, settings)
+
+	return returnVals.Error(0)
 }
 
 func (m *MockStore) AllChats(userId string) ([]models.User, error) {
@@ -87,3 +175,45 @@ func (m *MockStore) GetServers() ([]models.Server, error) {
 
 	return returnVals.Get(0).([]models.Server), returnVals.Error(1)
 }
+
+func (m *MockStore) GetInvite(serverId int) (string, error) {
+	returnVals := m.Called(serverId)
+
+	return returnVals.String(0), returnVals.Error(1)
+}
+
+func (m *MockStore) StoreInvite(code string, serverId int) error {
+	returnVals := m.Called(code, serverId)
+
+	return returnVals.Error(0)
+}
+
+func (m *MockStore) GetMemberServers(userId string) ([]string, error) {
+	returnVals := m.Called(userId)
+
+	return returnVals.Get(0).([]string), returnVals.Error(1)
+}
+
+func (m *MockStore) CreateAttachment(attachment models.Attachment) (models.Attachment, error) {
+	returnVals := m.Called(attachment)
+
+	return returnVals.Get(0).(models.Attachment), returnVals.Error(1)
+}
+
+func (m *MockStore) GetAttachment(userId string, attachmentId int64) (models.Attachment, error) {
+	returnVals := m.Called(userId, attachmentId)
+
+	return returnVals.Get(0).(models.Attachment), returnVals.Error(1)
+}
+
+func (m *MockStore) CountAttachable(message models.Message) (int, error) {
+	returnVals := m.Called(message)
+
+	return returnVals.Int(0), returnVals.Error(1)
+}
+
+func (m *MockStore) SearchMessages(userId string, query models.SearchQuery, before int64, limit int) ([]models.SearchResult, error) {
+	returnVals := m.Called(userId, query, before, limit)
+
+	return returnVals.Get(0).([]models.SearchResult), returnVals.Error(1)
+}
@@ -0,0 +1,117 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
+// Delivery is a dispatch addressed to every session a user has, or every session
+// subscribed to a topic, wherever in the cluster those sessions live.
+type Delivery struct {
+	UserId string `json:"userId,omitempty"`
+	Topic  string `json:"topic,omitempty"`
+	// UserIds and Topics address several users and topics at once. A session
+	// that's addressed more than once still gets the event once.
+	UserIds []string `json:"userIds,omitempty"`
+	Topics  []string `json:"topics,omitempty"`
+	// Session narrows a delivery to one session, for events meant for a single
+	// device rather than everywhere the user is.
+	Session string `json:"session,omitempty"`
+	// Except is the id of the session the event came from, which already has it.
+	Except string `json:"except,omitempty"`
+	// ExceptUsers are users whose sessions skip the event, because they hear
+	// about it some other way.
+	ExceptUsers []string `json:"exceptUsers,omitempty"`
+	// Instance addresses a Manager instead, for commands that have to reach the
+	// instance that holds some state, like a call.
+	Instance string `json:"instance,omitempty"`
+	// Join is a topic every addressed session subscribes to, Except included,
+	// before the event is dispatched.
+	Join string `json:"join,omitempty"`
+	// Intent is the intent a session needs for the event, when it isn't the
+	// one its type belongs to.
+	Intent Intents         `json:"intent,omitempty"`
+	Type   string          `json:"t"`
+	Data   json.RawMessage `json:"d,omitempty"`
+}
+
+// Bus carries deliveries between gateway instances. Every instance publishes
+// what it wants sent and delivers whatever it hears to its own sessions, so it
+// doesn't matter which instance holds a recipient's socket.
+type Bus interface {
+	Publish(ctx context.Context, delivery Delivery) error
+	// Subscribe calls handler for every delivery published on the bus, by any
+	// instance including this one, until ctx is done. The handler must not block.
+	Subscribe(ctx context.Context, handler func(Delivery)) error
+}
+
+// LocalBus is a Bus for a single instance, or several Managers in one process.
+type LocalBus struct {
+	mu       sync.RWMutex
+	handlers map[int]func(Delivery)
+	next     int
+}
+
+func NewLocalBus() *LocalBus {
+	return &LocalBus{handlers: make(map[int]func(Delivery))}
+}
+
+func (b *LocalBus) Publish(ctx context.Context, delivery Delivery) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	for _, handler := range b.handlers {
+		handler(delivery)
+	}
+	return nil
+}
+
+func (b *LocalBus) Subscribe(ctx context.Context, handler func(Delivery)) error {
+	b.mu.Lock()
+	id := b.next
+	b.next++
+	b.handlers[id] = handler
+	b.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		delete(b.handlers, id)
+		b.mu.Unlock()
+	}()
+	return nil
+}
+
+// deliveryQueue hands deliveries from the bus to the Manager goroutine, and from
+// the Manager goroutine to the bus. It's unbounded so neither side ever waits on
+// the other.
+type deliveryQueue struct {
+	mu     sync.Mutex
+	items  []Delivery
+	notify chan struct{}
+}
+
+func newDeliveryQueue() *deliveryQueue {
+	return &deliveryQueue{notify: make(chan struct{}, 1)}
+}
+
+func (q *deliveryQueue) push(delivery Delivery) {
+	q.mu.Lock()
+	q.items = append(q.items, delivery)
+	q.mu.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (q *deliveryQueue) drain() []Delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	items := q.items
+	q.items = nil
+	return items
+}
@@ -0,0 +1,118 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"ivar/pkg/models"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestBus_DeliversAcrossInstances(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+
+	bus := NewLocalBus()
+	useBus := func(m *Manager) { m.Bus = bus }
+	_, urlA := newTestServer(t, store, useBus)
+	_, urlB := newTestServer(t, store, useBus)
+
+	recipient := dial(t, urlA, "recipient")
+	senderOtherDevice := dial(t, urlA, "sender")
+	sender := dial(t, urlB, "sender")
+
+	sendMessage(t, sender, "recipient", "across the cluster")
+
+	for _, conn := range []struct {
+		name string
+		got  Event
+	}{
+		{"recipient", readEvent(t, recipient)},
+		{"sender's other device", readEvent(t, senderOtherDevice)},
+	} {
+		var message models.Message
+		_ = json.Unmarshal(conn.got.Data, &message)
+		if conn.got.Type != EventMessageCreate || message.Content != "across the cluster" {
+			t.Errorf("%s should have the message, got: %+v", conn.name, conn.got)
+		}
+	}
+}
+
+func TestPostgresBus_PublishSubscribe(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := NewPostgresBus(db, "gateway_test")
+	received := make(chan Delivery, 1)
+	if err := bus.Subscribe(ctx, func(d Delivery) { received <- d }); err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+
+	if err := bus.Publish(ctx, Delivery{UserId: "userId1", Type: EventMessageCreate, Data: json.RawMessage(`{}`)}); err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+
+	select {
+	case d := <-received:
+		if d.UserId != "userId1" || d.Type != EventMessageCreate {
+			t.Errorf("unexpected delivery: %+v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("delivery should have arrived")
+	}
+}
+
+func TestPostgresBus_SpillsLargeDeliveries(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bus := NewPostgresBus(db, "gateway_test")
+	received := make(chan Delivery, 1)
+	if err := bus.Subscribe(ctx, func(d Delivery) { received <- d }); err != nil {
+		t.Fatalf("error subscribing: %v", err)
+	}
+
+	// every < is escaped to six bytes, so a frame-sized message is far bigger
+	// than a notification
+	data, _ := json.Marshal(models.Message{Content: strings.Repeat("<", 6000)})
+	if err := bus.Publish(ctx, Delivery{UserId: "userId1", Type: EventMessageCreate, Data: data}); err != nil {
+		t.Fatalf("error publishing: %v", err)
+	}
+
+	select {
+	case d := <-received:
+		var message models.Message
+		_ = json.Unmarshal(d.Data, &message)
+		if d.UserId != "userId1" || len(message.Content) != 6000 {
+			t.Errorf("delivery should arrive whole, got: %+v", d.UserId)
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("delivery should have arrived")
+	}
+}
@@ -0,0 +1,308 @@
+package gateway
+
+import (
+	"encoding/json"
+	"ivar/pkg/models"
+	"log"
+	"strings"
+	"time"
+)
+
+// The gateway only does signaling for calls: it rings people, keeps track of who
+// has picked up, and relays SDP and ICE between them. Media goes peer to peer.
+//
+// A call lives on the Manager that started it. Its id starts with that
+// Manager's instance id, and everything anyone does in the call is sent there
+// over the bus, wherever they're connected.
+
+const (
+	// callLeave is the command a session's instance sends when the session
+	// drops out of a call without hanging up. Clients can't send it.
+	callLeave = "CALL_LEAVE"
+
+	defaultRingTimeout = 30 * time.Second
+	callSweepInterval  = time.Second
+	// maxCallSize is the most people in one call, caller included.
+	maxCallSize = 10
+)
+
+var signalTypes = map[string]bool{
+	"offer":     true,
+	"answer":    true,
+	"candidate": true,
+}
+
+type callParticipant struct {
+	state CallState
+	// session is the one the participant answered on, which signals go to
+	session string
+}
+
+type call struct {
+	id           string
+	caller       string
+	video        bool
+	state        CallState
+	participants map[string]*callParticipant
+	ringingUntil time.Time
+	answered     bool
+}
+
+func (c *call) snapshot() Call {
+	participants := make(map[string]CallState, len(c.participants))
+	for userId, p := range c.participants {
+		participants[userId] = p.state
+	}
+	return Call{ID: c.id, Caller: c.caller, Video: c.video, State: c.state, Participants: participants}
+}
+
+// callCommand is something a participant did, on its way to the instance that
+// holds the call.
+type callCommand struct {
+	CallId  string      `json:"callId"`
+	UserId  string      `json:"userId"`
+	Session string      `json:"session"`
+	Signal  *CallSignal `json:"signal,omitempty"`
+}
+
+func (m *Manager) startCall(from *Client, start CallStart) {
+	if from.session == nil {
+		return
+	}
+
+	id, err := randomId()
+	if err != nil {
+		log.Println("error creating call: " + err.Error())
+		from.sendError(Error{Code: ErrorCallNotStarted, Message: "call could not be started"})
+		return
+	}
+
+	c := &call{
+		id:     m.instance + "." + id,
+		caller: from.Id,
+		video:  start.Video,
+		state:  CallRinging,
+		participants: map[string]*callParticipant{
+			from.Id: {state: CallAccepted, session: from.session.ID},
+		},
+		ringingUntil: time.Now().Add(m.RingTimeout),
+	}
+	for _, userId := range start.Users {
+		c.participants[userId] = &callParticipant{state: CallRinging}
+	}
+	m.calls[c.id] = c
+	from.session.calls[c.id] = true
+
+	m.broadcastCall(c)
+}
+
+// forwardCall sends what a participant did to the instance holding the call.
+func (m *Manager) forwardCall(from *Client, eventType, callId string, signal *CallSignal) {
+	if from.session == nil {
+		return
+	}
+
+	switch eventType {
+	case EventCallAccept:
+		from.session.calls[callId] = true
+	case EventCallDecline, EventCallEnd:
+		delete(from.session.calls, callId)
+	}
+
+	m.commandCall(eventType, callCommand{CallId: callId, UserId: from.Id, Session: from.session.ID, Signal: signal})
+}
+
+// leaveCalls takes a session that dropped out of every call it was in, so the
+// others aren't left waiting on it. Its signals would have nowhere to go.
+func (m *Manager) leaveCalls(session *Session) {
+	for callId := range session.calls {
+		m.commandCall(callLeave, callCommand{CallId: callId, UserId: session.UserId, Session: session.ID})
+	}
+	clear(session.calls)
+}
+
+func (m *Manager) commandCall(eventType string, command callCommand) {
+	instance, _, ok := strings.Cut(command.CallId, ".")
+	if !ok {
+		return
+	}
+
+	data, err := json.Marshal(command)
+	if err != nil {
+		log.Println("error encoding call command: " + err.Error())
+		return
+	}
+	m.publish(Delivery{Instance: instance, Type: eventType, Data: data}, nil)
+}
+
+func (m *Manager) handleCallCommand(delivery Delivery) {
+	var command callCommand
+	if err := json.Unmarshal(delivery.Data, &command); err != nil {
+		log.Println("error decoding call command: " + err.Error())
+		return
+	}
+
+	c, ok := m.calls[command.CallId]
+	if !ok {
+		return
+	}
+	p, ok := c.participants[command.UserId]
+	if !ok {
+		return
+	}
+
+	switch delivery.Type {
+	case EventCallAccept:
+		if p.state != CallRinging {
+			return
+		}
+		p.state = CallAccepted
+		p.session = command.Session
+		c.answered = true
+		c.state = CallAccepted
+	case EventCallDecline:
+		if p.state != CallRinging {
+			return
+		}
+		p.state = CallDeclined
+	case EventCallEnd:
+		switch p.state {
+		case CallAccepted:
+			p.state = CallEnded
+		case CallRinging:
+			p.state = CallDeclined
+		default:
+			return
+		}
+		// hanging up before anyone answers is giving up on everyone
+		if command.UserId == c.caller && !c.answered {
+			m.missCall(c)
+		}
+	case callLeave:
+		// the user may have picked up on another device since
+		if p.state != CallAccepted || p.session != command.Session {
+			return
+		}
+		p.state = CallEnded
+		if command.UserId == c.caller && !c.answered {
+			m.missCall(c)
+		}
+	case EventCallSignal:
+		m.relaySignal(c, command)
+		return
+	default:
+		return
+	}
+
+	m.settleCall(c)
+}
+
+// relaySignal passes a signal on to the session its recipient answered on, as
+// long as both of them are in the call.
+func (m *Manager) relaySignal(c *call, command callCommand) {
+	signal := command.Signal
+	if signal == nil {
+		return
+	}
+	from, to := c.participants[command.UserId], c.participants[signal.To]
+	if from.state != CallAccepted || to == nil || to.state != CallAccepted {
+		return
+	}
+
+	data, err := json.Marshal(signal)
+	if err != nil {
+		log.Println("error encoding call signal: " + err.Error())
+		return
+	}
+	m.publish(Delivery{UserId: signal.To, Session: to.session, Type: EventCallSignal, Data: data}, nil)
+}
+
+// missCall marks everyone still ringing as having missed the call, and leaves
+// each of them a message saying so.
+func (m *Manager) missCall(c *call) {
+	content := "Missed call"
+	if c.video {
+		content = "Missed video call"
+	}
+
+	for userId, p := range c.participants {
+		if p.state != CallRinging {
+			continue
+		}
+		p.state = CallMissed
+
+		stored, _, err := m.ChatService.AddMessage(models.Message{Sender: c.caller, Recipient: userId, Content: content, Kind: models.MessageKindMissedCall})
+		if err != nil {
+			log.Println("error adding missed call: " + err.Error())
+			continue
+		}
+		m.dispatchMessage(nil, stored)
+	}
+}
+
+// settleCall works out where the call stands after a change, tells everyone in
+// it, and forgets it once it's over.
+func (m *Manager) settleCall(c *call) {
+	var ringing, accepted, missed int
+	for _, p := range c.participants {
+		switch p.state {
+		case CallRinging:
+			ringing++
+		case CallAccepted:
+			accepted++
+		case CallMissed:
+			missed++
+		}
+	}
+
+	if ringing == 0 && accepted < 2 {
+		switch {
+		case c.answered:
+			c.state = CallEnded
+		case missed > 0:
+			c.state = CallMissed
+		default:
+			c.state = CallDeclined
+		}
+		for _, p := range c.participants {
+			if p.state == CallAccepted {
+				p.state = CallEnded
+			}
+		}
+		delete(m.calls, c.id)
+	}
+
+	m.broadcastCall(c)
+}
+
+func (m *Manager) broadcastCall(c *call) {
+	data, err := json.Marshal(c.snapshot())
+	if err != nil {
+		log.Println("error encoding call: " + err.Error())
+		return
+	}
+
+	for userId := range c.participants {
+		m.dispatchToUser(userId, nil, EventCallUpdate, data)
+	}
+}
+
+// expireCalls stops ringing anyone who hasn't answered in time.
+func (m *Manager) expireCalls(now time.Time) {
+	for _, c := range m.calls {
+		if now.Before(c.ringingUntil) {
+			continue
+		}
+
+		ringing := false
+		for _, p := range c.participants {
+			ringing = ringing || p.state == CallRinging
+		}
+		if !ringing {
+			continue
+		}
+
+		m.missCall(c)
+		m.settleCall(c)
+	}
+}
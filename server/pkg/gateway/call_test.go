@@ -0,0 +1,184 @@
+package gateway
+
+import (
+	"encoding/json"
+	"ivar/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/mock"
+)
+
+func sendCallEvent(t *testing.T, conn *websocket.Conn, eventType string, data any) {
+	t.Helper()
+	event, _ := NewEvent(OpDispatch, eventType, data)
+	if err := conn.WriteJSON(event); err != nil {
+		t.Fatalf("error writing %s: %v", eventType, err)
+	}
+}
+
+// readCall reads events until the next call update, skipping anything else.
+func readCall(t *testing.T, conn *websocket.Conn) Call {
+	t.Helper()
+	for {
+		event := readEvent(t, conn)
+		if event.Type != EventCallUpdate {
+			continue
+		}
+		var call Call
+		_ = json.Unmarshal(event.Data, &call)
+		return call
+	}
+}
+
+func TestCall_AcceptSignalEnd(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	alice := dial(t, url, "alice")
+	bobLaptop := dial(t, url, "bob")
+	bobPhone := dial(t, url, "bob")
+
+	sendCallEvent(t, alice, EventCallStart, CallStart{Users: []string{"bob"}, Video: true})
+
+	ringing := readCall(t, bobLaptop)
+	if ringing.State != CallRinging || ringing.Caller != "alice" || ringing.Participants["bob"] != CallRinging {
+		t.Fatalf("bob should be ringing, got: %+v", ringing)
+	}
+	readCall(t, bobPhone)
+	readCall(t, alice)
+
+	sendCallEvent(t, bobLaptop, EventCallAccept, CallAction{CallId: ringing.ID})
+	for _, conn := range []*websocket.Conn{alice, bobLaptop, bobPhone} {
+		if call := readCall(t, conn); call.State != CallAccepted || call.Participants["bob"] != CallAccepted {
+			t.Errorf("call should be accepted, got: %+v", call)
+		}
+	}
+
+	sendCallEvent(t, alice, EventCallSignal, CallSignal{CallId: ringing.ID, To: "bob", Type: "offer", Data: json.RawMessage(`{"sdp":"v=0"}`)})
+	event := readEvent(t, bobLaptop)
+	var signal CallSignal
+	_ = json.Unmarshal(event.Data, &signal)
+	if event.Type != EventCallSignal || signal.From != "alice" || string(signal.Data) != `{"sdp":"v=0"}` {
+		t.Errorf("bob's laptop should get the offer, got: %+v", event)
+	}
+
+	sendCallEvent(t, bobLaptop, EventCallSignal, CallSignal{CallId: ringing.ID, To: "alice", Type: "answer", Data: json.RawMessage(`{"sdp":"v=0"}`)})
+	if event := readEvent(t, alice); event.Type != EventCallSignal {
+		t.Errorf("alice should get the answer, got: %+v", event)
+	}
+
+	sendCallEvent(t, alice, EventCallEnd, CallAction{CallId: ringing.ID})
+	if call := readCall(t, bobPhone); call.State != CallEnded {
+		t.Errorf("call should be over, got: %+v", call)
+	}
+
+	// the phone never answered, so it isn't sent signals
+	_ = bobPhone.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, msg, err := bobPhone.ReadMessage(); err == nil {
+		t.Errorf("bob's phone should have nothing else, got: %s", msg)
+	}
+}
+
+func TestCall_EndsWhenParticipantDrops(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	alice := dial(t, url, "alice")
+	bobLaptop := dial(t, url, "bob")
+	bobPhone := dial(t, url, "bob")
+
+	sendCallEvent(t, alice, EventCallStart, CallStart{Users: []string{"bob"}})
+	ringing := readCall(t, bobLaptop)
+	readCall(t, bobPhone)
+	readCall(t, alice)
+
+	sendCallEvent(t, bobLaptop, EventCallAccept, CallAction{CallId: ringing.ID})
+	readCall(t, alice)
+	readCall(t, bobPhone)
+
+	// the phone never answered, so losing it changes nothing
+	_ = bobPhone.Close()
+	_ = bobLaptop.Close()
+	call := readCall(t, alice)
+	if call.State != CallEnded || call.Participants["bob"] != CallEnded || call.Participants["alice"] != CallEnded {
+		t.Errorf("call should be over once bob's laptop drops, got: %+v", call)
+	}
+
+	// the call is gone, so it can't be picked back up
+	bob := dial(t, url, "bob")
+	sendCallEvent(t, bob, EventCallAccept, CallAction{CallId: ringing.ID})
+	_ = alice.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	for {
+		var event Event
+		if err := alice.ReadJSON(&event); err != nil {
+			break
+		}
+		if event.Type == EventCallUpdate {
+			t.Errorf("alice should hear nothing more about the call, got: %+v", event)
+		}
+	}
+}
+
+func TestCall_Declined(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	alice := dial(t, url, "alice")
+	bob := dial(t, url, "bob")
+
+	sendCallEvent(t, alice, EventCallStart, CallStart{Users: []string{"bob"}})
+	ringing := readCall(t, bob)
+	readCall(t, alice)
+
+	sendCallEvent(t, bob, EventCallDecline, CallAction{CallId: ringing.ID})
+	if call := readCall(t, alice); call.State != CallDeclined || call.Participants["bob"] != CallDeclined {
+		t.Errorf("call should be declined, got: %+v", call)
+	}
+}
+
+func TestCall_MissedWritesHistory(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+	_, url := newTestServer(t, store, func(m *Manager) {
+		m.RingTimeout = 10 * time.Millisecond
+	})
+
+	alice := dial(t, url, "alice")
+	bob := dial(t, url, "bob")
+
+	sendCallEvent(t, alice, EventCallStart, CallStart{Users: []string{"bob"}})
+	readCall(t, bob)
+
+	event := readEvent(t, bob)
+	var message models.Message
+	_ = json.Unmarshal(event.Data, &message)
+	if event.Type != EventMessageCreate || message.Kind != models.MessageKindMissedCall || message.Sender != "alice" {
+		t.Errorf("bob should get a missed call message, got: %+v", event)
+	}
+	if call := readCall(t, bob); call.State != CallMissed || call.Participants["bob"] != CallMissed {
+		t.Errorf("call should be missed, got: %+v", call)
+	}
+
+	store.AssertCalled(t, "StoreMessage", mock.MatchedBy(func(m models.Message) bool {
+		return m.Kind == models.MessageKindMissedCall && m.Recipient == "bob"
+	}))
+}
+
+func TestCall_SignalFromOutsider_Dropped(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	alice := dial(t, url, "alice")
+	bob := dial(t, url, "bob")
+	mallory := dial(t, url, "mallory")
+
+	sendCallEvent(t, alice, EventCallStart, CallStart{Users: []string{"bob"}})
+	ringing := readCall(t, bob)
+	sendCallEvent(t, bob, EventCallAccept, CallAction{CallId: ringing.ID})
+	readCall(t, bob)
+
+	sendCallEvent(t, mallory, EventCallSignal, CallSignal{CallId: ringing.ID, To: "bob", Type: "offer", Data: json.RawMessage(`{}`)})
+
+	_ = bob.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, msg, err := bob.ReadMessage(); err == nil {
+		t.Errorf("signals from outside the call should be dropped, got: %s", msg)
+	}
+}
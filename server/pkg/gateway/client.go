@@ -0,0 +1,473 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"ivar/pkg/models"
+	"log"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait bounds how long a single write to the socket may take.
+	writeWait = 10 * time.Second
+	// heartbeatGrace is how much longer than the heartbeat interval we wait for
+	// any sign of life before reaping a connection.
+	heartbeatGrace = 1.5
+	// controlQueueSize is how many acks and errors can wait to be written.
+	controlQueueSize = 8
+	// maxNonceLength bounds the nonces clients attach to messages.
+	maxNonceLength = 64
+)
+
+type Client struct {
+	Id      string
+	Socket  *websocket.Conn
+	Send    chan []byte
+	manager *Manager
+	// control carries frames the read side needs to answer with directly, like
+	// heartbeat acks. Unlike Send it is never closed, so Read can't panic on it.
+	control chan []byte
+	// owned by the Read goroutine
+	limit      bucket
+	strikes    int
+	lastStrike time.Time
+
+	// encoding is what the socket speaks. Fallback connections always use JSON.
+	encoding Encoding
+	// granted are the privileged intents the client's token allows it
+	granted Intents
+	// intents are what it identified with, set before it's registered
+	intents Intents
+
+	// identified is set once the client has sent Identify or Resume, and cleared
+	// again by the Manager if a resume is rejected.
+	identified atomic.Bool
+
+	// owned by the Manager goroutine
+	session    *Session
+	sendClosed bool
+	attached   bool
+	// set before Send is closed, read by Write after
+	closeCode   int
+	closeReason string
+}
+
+func NewClient(id string, socket *websocket.Conn, send chan []byte, manager *Manager) *Client {
+	return &Client{
+		Id:      id,
+		Socket:  socket,
+		Send:    send,
+		manager: manager,
+		control: make(chan []byte, controlQueueSize),
+		intents: DefaultIntents,
+	}
+}
+
+// opHandlers handle frames coming in from a client, keyed by op.
+var opHandlers = map[Op]func(c *Client, event Event) error{
+	OpDispatch:  (*Client).handleDispatch,
+	OpHeartbeat: (*Client).handleHeartbeat,
+	OpIdentify:  (*Client).handleIdentify,
+	OpResume:    (*Client).handleResume,
+
+	OpPresenceUpdate: (*Client).handlePresenceUpdate,
+	OpDeliveryAck:    (*Client).handleDeliveryAck,
+	OpReadAck:        (*Client).handleReadAck,
+}
+
+// dispatchHandlers handle the dispatch events a client is allowed to send, keyed
+// by event type. The payload has already been decoded by DecodePayload.
+var dispatchHandlers = map[string]func(c *Client, payload any) error{
+	EventMessageCreate:  (*Client).handleMessageCreate,
+	EventMessageUpdate:  (*Client).handleMessageUpdate,
+	EventMessageDelete:  (*Client).handleMessageDelete,
+	EventReactionAdd:    reactionHandler(EventReactionAdd),
+	EventReactionRemove: reactionHandler(EventReactionRemove),
+	EventTypingStart:    (*Client).handleTypingStart,
+	EventCallStart:      (*Client).handleCallStart,
+	EventCallAccept:     callActionHandler(EventCallAccept),
+	EventCallDecline:    callActionHandler(EventCallDecline),
+	EventCallEnd:        callActionHandler(EventCallEnd),
+	EventCallSignal:     (*Client).handleCallSignal,
+}
+
+func (c *Client) readTimeout() time.Duration {
+	return time.Duration(float64(c.manager.HeartbeatInterval) * heartbeatGrace)
+}
+
+func (c *Client) Read() {
+	defer func() {
+		submit(c.manager, c.manager.Unregister, c)
+		_ = c.Socket.Close()
+	}()
+
+	c.Socket.SetReadLimit(c.manager.MaxFrameSize)
+	_ = c.Socket.SetReadDeadline(time.Now().Add(c.readTimeout()))
+	c.Socket.SetPongHandler(func(string) error {
+		return c.Socket.SetReadDeadline(time.Now().Add(c.readTimeout()))
+	})
+
+	for {
+		_, message, err := c.Socket.ReadMessage()
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				c.manager.Metrics.Reaped.Add(1)
+			}
+			break
+		}
+		_ = c.Socket.SetReadDeadline(time.Now().Add(c.readTimeout()))
+
+		message, err = c.encoding.decode(message)
+		if err != nil {
+			log.Println("error decoding frame: " + err.Error())
+			closeWithCode(c.Socket, CloseDecodeError, "invalid payload")
+			return
+		}
+
+		var event Event
+		if err := json.Unmarshal(message, &event); err != nil {
+			log.Println("error decoding event: " + err.Error())
+			closeWithCode(c.Socket, CloseDecodeError, "invalid payload")
+			return
+		}
+
+		handle, ok := opHandlers[event.Op]
+		if !ok {
+			closeWithCode(c.Socket, CloseUnknownOp, ErrUnknownOp.Error())
+			return
+		}
+
+		// heartbeats are exempt, so a busy client isn't also reaped
+		if event.Op != OpHeartbeat {
+			allowed, err := c.allow(time.Now())
+			if err != nil {
+				closeWithCode(c.Socket, CloseRateLimited, err.Error())
+				return
+			}
+			if !allowed {
+				continue
+			}
+		}
+
+		if err := handle(c, event); err != nil {
+			log.Println("error handling event: " + err.Error())
+			closeWithCode(c.Socket, closeCodeFor(err), err.Error())
+			return
+		}
+	}
+}
+
+// closeCodeFor picks the close code for a frame that couldn't be handled.
+func closeCodeFor(err error) int {
+	switch {
+	case errors.Is(err, ErrNotIdentified):
+		return CloseNotIdentified
+	case errors.Is(err, ErrAlreadyIdentified):
+		return CloseAlreadyIdentified
+	case errors.Is(err, ErrInvalidIntents):
+		return CloseInvalidIntents
+	case errors.Is(err, ErrDisallowedIntents):
+		return CloseDisallowedIntents
+	default:
+		return CloseDecodeError
+	}
+}
+
+func (c *Client) handleHeartbeat(event Event) error {
+	ack, err := encodeEvent(OpHeartbeatAck, "", nil)
+	if err != nil {
+		return err
+	}
+
+	c.sendControl(ack)
+	return nil
+}
+
+// sendControl queues a frame on the control channel. If it's full the frame is
+// dropped: acks are interchangeable and errors are advisory.
+func (c *Client) sendControl(frame []byte) {
+	select {
+	case c.control <- frame:
+	default:
+	}
+}
+
+func (c *Client) sendError(e Error) {
+	frame, err := encodeEvent(OpError, "", e)
+	if err != nil {
+		log.Println("error encoding error: " + err.Error())
+		return
+	}
+
+	c.sendControl(frame)
+}
+
+func (c *Client) handleIdentify(event Event) error {
+	var identify Identify
+	if len(event.Data) > 0 {
+		if err := json.Unmarshal(event.Data, &identify); err != nil {
+			return err
+		}
+	}
+
+	intents := DefaultIntents
+	if identify.Intents != nil {
+		intents = *identify.Intents
+	}
+	if err := intents.check(c.granted); err != nil {
+		return err
+	}
+
+	if !c.identified.CompareAndSwap(false, true) {
+		return ErrAlreadyIdentified
+	}
+	// the Manager only reads this once it has been handed the client
+	c.intents = intents
+
+	submit(c.manager, c.manager.Register, c)
+	return nil
+}
+
+func (c *Client) handleResume(event Event) error {
+	var resume Resume
+	if err := json.Unmarshal(event.Data, &resume); err != nil {
+		return err
+	}
+	if !c.identified.CompareAndSwap(false, true) {
+		return ErrAlreadyIdentified
+	}
+
+	submit(c.manager, c.manager.Resume, ResumeRequest{Client: c, Resume: resume})
+	return nil
+}
+
+func (c *Client) handlePresenceUpdate(event Event) error {
+	if !c.identified.Load() {
+		return ErrNotIdentified
+	}
+
+	var update PresenceUpdate
+	if err := json.Unmarshal(event.Data, &update); err != nil {
+		return err
+	}
+
+	submit(c.manager, c.manager.Broadcast, Inbound{From: c, Type: EventPresenceUpdate, Payload: &update})
+	return nil
+}
+
+func (c *Client) handleDeliveryAck(event Event) error {
+	if !c.identified.Load() {
+		return ErrNotIdentified
+	}
+
+	var ack DeliveryAck
+	if err := json.Unmarshal(event.Data, &ack); err != nil {
+		return err
+	}
+
+	submit(c.manager, c.manager.Broadcast, Inbound{From: c, Payload: &ack})
+	return nil
+}
+
+func (c *Client) handleReadAck(event Event) error {
+	if !c.identified.Load() {
+		return ErrNotIdentified
+	}
+
+	var ack ReadAck
+	if err := json.Unmarshal(event.Data, &ack); err != nil {
+		return err
+	}
+	if ack.UserId == "" {
+		return errors.New("read ack needs a user id")
+	}
+
+	submit(c.manager, c.manager.Broadcast, Inbound{From: c, Payload: &ack})
+	return nil
+}
+
+func (c *Client) handleDispatch(event Event) error {
+	if !c.identified.Load() {
+		return ErrNotIdentified
+	}
+
+	handle, ok := dispatchHandlers[event.Type]
+	if !ok {
+		return ErrUnknownEvent
+	}
+
+	payload, err := DecodePayload(event)
+	if err != nil {
+		return err
+	}
+
+	return handle(c, payload)
+}
+
+func (c *Client) handleMessageCreate(payload any) error {
+	message := payload.(*models.Message)
+	if message.Recipient == "" {
+		return errors.New("message needs a recipient")
+	}
+	if len(message.Nonce) > maxNonceLength {
+		return ErrNonceTooLong
+	}
+	// the socket is authenticated, so the sender is whoever the token says it is
+	message.Sender = c.Id
+	message.Kind = models.MessageKindDefault
+
+	submit(c.manager, c.manager.Broadcast, Inbound{From: c, Type: EventMessageCreate, Payload: message})
+	return nil
+}
+
+func (c *Client) handleMessageUpdate(payload any) error {
+	message := payload.(*models.Message)
+	if message.ID == 0 || message.Content == "" {
+		return errors.New("message update needs an id and content")
+	}
+
+	submit(c.manager, c.manager.Broadcast, Inbound{From: c, Type: EventMessageUpdate, Payload: message})
+	return nil
+}
+
+func (c *Client) handleMessageDelete(payload any) error {
+	message := payload.(*MessageDelete)
+	if message.ID == 0 {
+		return errors.New("message delete needs an id")
+	}
+
+	submit(c.manager, c.manager.Broadcast, Inbound{From: c, Type: EventMessageDelete, Payload: message})
+	return nil
+}
+
+func reactionHandler(eventType string) func(c *Client, payload any) error {
+	return func(c *Client, payload any) error {
+		change := payload.(*models.ReactionChange)
+		if change.MessageId == 0 || change.Emoji == "" {
+			return errors.New("reaction needs a message id and an emoji")
+		}
+		change.UserId = c.Id
+
+		submit(c.manager, c.manager.Broadcast, Inbound{From: c, Type: eventType, Payload: change})
+		return nil
+	}
+}
+
+func (c *Client) handleTypingStart(payload any) error {
+	typing := payload.(*TypingStart)
+	if typing.Recipient == "" {
+		return errors.New("typing start needs a recipient")
+	}
+	typing.UserId = c.Id
+
+	submit(c.manager, c.manager.Broadcast, Inbound{From: c, Type: EventTypingStart, Payload: typing})
+	return nil
+}
+
+func (c *Client) handleCallStart(payload any) error {
+	start := payload.(*CallStart)
+	if len(start.Users) == 0 || len(start.Users) >= maxCallSize {
+		return errors.New("a call needs between 1 and " + strconv.Itoa(maxCallSize-1) + " other users")
+	}
+	for _, userId := range start.Users {
+		if userId == "" || userId == c.Id {
+			return errors.New("invalid call user")
+		}
+	}
+
+	submit(c.manager, c.manager.Broadcast, Inbound{From: c, Type: EventCallStart, Payload: start})
+	return nil
+}
+
+func callActionHandler(eventType string) func(c *Client, payload any) error {
+	return func(c *Client, payload any) error {
+		action := payload.(*CallAction)
+		if action.CallId == "" {
+			return errors.New("call action needs a call id")
+		}
+
+		submit(c.manager, c.manager.Broadcast, Inbound{From: c, Type: eventType, Payload: action})
+		return nil
+	}
+}
+
+func (c *Client) handleCallSignal(payload any) error {
+	signal := payload.(*CallSignal)
+	if signal.CallId == "" || signal.To == "" {
+		return errors.New("call signal needs a call id and a recipient")
+	}
+	if !signalTypes[signal.Type] {
+		return errors.New("unknown call signal type")
+	}
+	signal.From = c.Id
+
+	submit(c.manager, c.manager.Broadcast, Inbound{From: c, Type: EventCallSignal, Payload: signal})
+	return nil
+}
+
+func (c *Client) Write() {
+	ticker := time.NewTicker(c.manager.HeartbeatInterval / 2)
+	defer func() {
+		ticker.Stop()
+		_ = c.Socket.Close()
+		c.manager.writers.Done()
+	}()
+
+	done := c.manager.done
+	for {
+		select {
+		case <-done:
+			done = nil
+			// the Manager has drained and stopped. Clients it closed are still
+			// flushing their queues; anything else, like a client that never
+			// identified, just gets told to go elsewhere.
+			if !c.sendClosed {
+				_ = c.Socket.SetWriteDeadline(time.Now().Add(writeWait))
+				_ = c.Socket.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting"))
+				return
+			}
+		case message, ok := <-c.Send:
+			_ = c.Socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if !ok {
+				closeMessage := []byte{}
+				if c.closeCode != 0 {
+					closeMessage = websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+				}
+				_ = c.Socket.WriteMessage(websocket.CloseMessage, closeMessage)
+				return
+			}
+
+			if err := c.writeFrame(message); err != nil {
+				return
+			}
+		case message := <-c.control:
+			_ = c.Socket.SetWriteDeadline(time.Now().Add(writeWait))
+			if err := c.writeFrame(message); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := c.Socket.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// writeFrame writes a JSON frame to the socket in the client's encoding. A frame
+// that can't be transcoded is dropped rather than taking the connection down.
+func (c *Client) writeFrame(frame []byte) error {
+	encoded, err := c.encoding.encode(frame)
+	if err != nil {
+		log.Println("error encoding frame: " + err.Error())
+		return nil
+	}
+
+	return c.Socket.WriteMessage(c.encoding.messageType(), encoded)
+}
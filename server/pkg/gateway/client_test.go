@@ -0,0 +1,162 @@
+package gateway
+
+import (
+	"encoding/json"
+	"ivar/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func dial(t *testing.T, url, userId string) *websocket.Conn {
+	t.Helper()
+	conn := connect(t, url, userId)
+
+	if err := conn.WriteJSON(Event{Op: OpIdentify}); err != nil {
+		t.Fatalf("error identifying: %v", err)
+	}
+	if ready := readEvent(t, conn); ready.Type != EventReady {
+		t.Fatalf("expected ready, got: %+v", ready)
+	}
+	return conn
+}
+
+// connect opens a connection and reads Hello, without identifying.
+func connect(t *testing.T, url, userId string) *websocket.Conn {
+	t.Helper()
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/"+userId+"?token="+signToken(t, userId, time.Minute), nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if hello := readEvent(t, conn); hello.Op != OpHello {
+		t.Fatalf("first frame should be hello, got: %+v", hello)
+	}
+	return conn
+}
+
+func readEvent(t *testing.T, conn *websocket.Conn) Event {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event Event
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("error reading event: %v", err)
+	}
+	return event
+}
+
+func TestClient_Read_DispatchesMessageCreate(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+	_, url := newTestServer(t, store)
+
+	recipient := dial(t, url, "recipient")
+	sender := dial(t, url, "sender")
+	time.Sleep(50 * time.Millisecond)
+
+	event, _ := NewEvent(OpDispatch, EventMessageCreate, models.Message{Sender: "spoofed", Recipient: "recipient", Content: "hi"})
+	if err := sender.WriteJSON(event); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+
+	received := readEvent(t, recipient)
+	if received.Op != OpDispatch || received.Type != EventMessageCreate {
+		t.Fatalf("expected MESSAGE_CREATE dispatch, got: %+v", received)
+	}
+
+	var message models.Message
+	_ = json.Unmarshal(received.Data, &message)
+	if message.Sender != "sender" {
+		t.Errorf("sender should be taken from the token, got: %v", message.Sender)
+	}
+	if message.Content != "hi" {
+		t.Errorf("content should be 'hi', got: %v", message.Content)
+	}
+}
+
+func TestClient_Read_DispatchBeforeIdentify_Failure(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn := connect(t, url, "userId1")
+	event, _ := NewEvent(OpDispatch, EventMessageCreate, models.Message{Recipient: "userId2", Content: "hi"})
+	if err := conn.WriteJSON(event); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+
+	expectCloseCode(t, conn, CloseNotIdentified)
+}
+
+func TestClient_Read_MessageWithoutRecipient_Failure(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn := dial(t, url, "userId1")
+	event, _ := NewEvent(OpDispatch, EventMessageCreate, models.Message{Content: "to everyone"})
+	if err := conn.WriteJSON(event); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+
+	expectCloseCode(t, conn, CloseDecodeError)
+}
+
+func TestClient_Read_UnknownOp_Failure(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn := dial(t, url, "userId1")
+	if err := conn.WriteJSON(Event{Op: 99}); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+
+	expectCloseCode(t, conn, CloseUnknownOp)
+}
+
+func TestClient_Read_UnknownEvent_Failure(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn := dial(t, url, "userId1")
+	if err := conn.WriteJSON(Event{Op: OpDispatch, Type: "NOT_A_THING"}); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+
+	expectCloseCode(t, conn, CloseDecodeError)
+}
+
+func TestClient_Heartbeat_Acked(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn := dial(t, url, "userId1")
+	if err := conn.WriteJSON(Event{Op: OpHeartbeat}); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+
+	if ack := readEvent(t, conn); ack.Op != OpHeartbeatAck {
+		t.Errorf("expected heartbeat ack, got: %+v", ack)
+	}
+}
+
+func TestClient_MissedHeartbeats_Reaped(t *testing.T) {
+	m, url := newTestServer(t, newTestStore(), func(m *Manager) {
+		m.HeartbeatInterval = 100 * time.Millisecond
+	})
+
+	conn := dial(t, url, "userId1")
+	// stop answering pings, like a half-open connection would
+	conn.SetPingHandler(func(string) error { return nil })
+	go func() {
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for m.Metrics.Reaped.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if m.Metrics.Reaped.Load() != 1 {
+		t.Errorf("reaped should be 1, got: %d", m.Metrics.Reaped.Load())
+	}
+}
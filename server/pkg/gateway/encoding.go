@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+// Encoding is how a websocket client wants frames written and will write its
+// own, picked with ?encoding= on connect. Whatever it is, frames are the same
+// Event envelope; they're JSON everywhere inside the gateway, the bus and
+// replay buffers included, and only transcoded on the way in and out.
+type Encoding string
+
+const (
+	EncodingJSON Encoding = "json"
+	// EncodingMsgpack sends the envelope, payload and all, as one MessagePack
+	// map in a binary frame.
+	EncodingMsgpack Encoding = "msgpack"
+)
+
+var ErrUnknownEncoding = errors.New("unknown encoding")
+
+var msgpackHandle = func() *codec.MsgpackHandle {
+	h := &codec.MsgpackHandle{}
+	h.RawToString = true
+	h.WriteExt = true
+	h.MapType = reflect.TypeOf(map[string]any(nil))
+	return h
+}()
+
+// parseEncoding reads the encoding a client asked for, which is JSON if it
+// didn't ask.
+func parseEncoding(value string) (Encoding, error) {
+	switch Encoding(value) {
+	case "", EncodingJSON:
+		return EncodingJSON, nil
+	case EncodingMsgpack:
+		return EncodingMsgpack, nil
+	default:
+		return "", ErrUnknownEncoding
+	}
+}
+
+func (e Encoding) messageType() int {
+	if e == EncodingMsgpack {
+		return websocket.BinaryMessage
+	}
+	return websocket.TextMessage
+}
+
+// encode turns a JSON frame into what goes on the wire.
+func (e Encoding) encode(frame []byte) ([]byte, error) {
+	if e != EncodingMsgpack {
+		return frame, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(frame))
+	decoder.UseNumber()
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	var out []byte
+	if err := codec.NewEncoderBytes(&out, msgpackHandle).Encode(numbers(value)); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// decode turns a frame read off the wire into JSON.
+func (e Encoding) decode(message []byte) ([]byte, error) {
+	if e != EncodingMsgpack {
+		return message, nil
+	}
+
+	var value any
+	if err := codec.NewDecoderBytes(message, msgpackHandle).Decode(&value); err != nil {
+		return nil, err
+	}
+	return json.Marshal(value)
+}
+
+// numbers replaces the json.Numbers in a decoded value with integers where
+// they fit and floats where they don't, so they're encoded as such.
+func numbers(value any) any {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]any:
+		for key, item := range v {
+			v[key] = numbers(item)
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = numbers(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/ugorji/go/codec"
+)
+
+func TestEncoding_Msgpack_RoundTrip(t *testing.T) {
+	frame := []byte(`{"op":0,"t":"MESSAGE_ACK","s":3,"d":{"nonce":"abc","id":12,"timestamp":"2026-01-01T00:00:00Z"}}`)
+
+	encoded, err := EncodingMsgpack.encode(frame)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+
+	var raw map[string]any
+	if err := codec.NewDecoderBytes(encoded, msgpackHandle).Decode(&raw); err != nil {
+		t.Fatalf("frame should be msgpack, got: %v", err)
+	}
+	if op, ok := raw["op"].(int64); !ok || op != 0 {
+		t.Errorf("op should be an integer 0, got: %#v", raw["op"])
+	}
+
+	decoded, err := EncodingMsgpack.decode(encoded)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	var event Event
+	if err := json.Unmarshal(decoded, &event); err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	payload, err := DecodePayload(event)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	if ack := payload.(*MessageAck); event.Seq != 3 || ack.ID != 12 || ack.Nonce != "abc" {
+		t.Errorf("frame should survive the round trip, got: %+v %+v", event, ack)
+	}
+}
+
+func TestHandleConnections_Msgpack_Compressed(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial(url+"/ws/userId1?encoding=msgpack&token="+signToken(t, "userId1", time.Minute), nil)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	defer conn.Close()
+
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext == "" {
+		t.Errorf("compression should be negotiated")
+	}
+
+	readMsgpack := func() Event {
+		t.Helper()
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		messageType, message, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("error reading event: %v", err)
+		}
+		if messageType != websocket.BinaryMessage {
+			t.Fatalf("frame should be binary, got: %d", messageType)
+		}
+		decoded, err := EncodingMsgpack.decode(message)
+		if err != nil {
+			t.Fatalf("error decoding frame: %v", err)
+		}
+		var event Event
+		_ = json.Unmarshal(decoded, &event)
+		return event
+	}
+
+	if hello := readMsgpack(); hello.Op != OpHello {
+		t.Fatalf("first frame should be hello, got: %+v", hello)
+	}
+
+	identify, _ := EncodingMsgpack.encode([]byte(`{"op":2}`))
+	if err := conn.WriteMessage(websocket.BinaryMessage, identify); err != nil {
+		t.Fatalf("error identifying: %v", err)
+	}
+	if ready := readMsgpack(); ready.Type != EventReady {
+		t.Errorf("expected ready, got: %+v", ready)
+	}
+}
+
+func TestHandleConnections_UnknownEncoding_Failure(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/userId1?encoding=xml&token="+signToken(t, "userId1", time.Minute), nil)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	defer conn.Close()
+
+	expectCloseCode(t, conn, CloseInvalidEncoding)
+}
@@ -0,0 +1,282 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"ivar/pkg/models"
+	"time"
+)
+
+// Version is the gateway protocol version. Clients may pin it with ?v= on connect.
+const Version = 1
+
+// Op says what kind of frame an Event is. Dispatch frames carry a typed payload
+// in Data, named by Type.
+type Op int
+
+const (
+	OpDispatch       Op = 0
+	OpHeartbeat      Op = 1
+	OpIdentify       Op = 2
+	OpPresenceUpdate Op = 3
+	OpResume         Op = 6
+	OpReconnect      Op = 7
+	OpInvalidSession Op = 9
+	OpHello          Op = 10
+	OpHeartbeatAck   Op = 11
+	OpError          Op = 12
+	OpDeliveryAck    Op = 13
+	OpReadAck        Op = 14
+)
+
+// Event is the envelope every gateway frame is wrapped in, in both directions.
+type Event struct {
+	Op   Op              `json:"op"`
+	Type string          `json:"t,omitempty"`
+	Seq  int64           `json:"s,omitempty"`
+	Data json.RawMessage `json:"d,omitempty"`
+}
+
+const (
+	EventReady          = "READY"
+	EventResumed        = "RESUMED"
+	EventMessageCreate  = "MESSAGE_CREATE"
+	EventMessageAck     = "MESSAGE_ACK"
+	EventMessageUpdate  = "MESSAGE_UPDATE"
+	EventMessageDelete  = "MESSAGE_DELETE"
+	EventReactionAdd    = "MESSAGE_REACTION_ADD"
+	EventReactionRemove = "MESSAGE_REACTION_REMOVE"
+	EventMessageRead    = "MESSAGE_READ"
+	EventPresenceUpdate = "PRESENCE_UPDATE"
+	EventTypingStart    = "TYPING_START"
+	EventCallStart      = "CALL_START"
+	EventCallAccept     = "CALL_ACCEPT"
+	EventCallDecline    = "CALL_DECLINE"
+	EventCallEnd        = "CALL_END"
+	EventCallSignal     = "CALL_SIGNAL"
+	EventCallUpdate     = "CALL_UPDATE"
+)
+
+// Hello is the first frame on every connection. Clients should send OpHeartbeat
+// at least once per interval; connections that go quiet for longer than the
+// interval plus some grace are reaped.
+//
+// Over SSE and long-polling, ConnectionId is what the client sends its frames
+// and polls with.
+type Hello struct {
+	HeartbeatInterval int64  `json:"heartbeat_interval"`
+	ConnectionId      string `json:"connection_id,omitempty"`
+}
+
+// Error tells a client something it sent was refused, without closing the
+// connection. Nonce is set when the refused frame was a message that had one.
+type Error struct {
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+	RetryAfter int64  `json:"retry_after,omitempty"`
+	Nonce      string `json:"nonce,omitempty"`
+}
+
+const (
+	ErrorRateLimited       = 1
+	ErrorMessageNotStored  = 2
+	ErrorCallNotStarted    = 3
+	ErrorMessageNotChanged = 4
+	ErrorInvalidReply      = 5
+	ErrorInvalidAttachment = 6
+)
+
+// Identify starts a new session. It must be the first thing a client sends after
+// Hello, unless it's resuming. Intents picks the events the session gets; left
+// out, it's DefaultIntents.
+type Identify struct {
+	Intents *Intents `json:"intents,omitempty"`
+}
+
+// Resume picks an existing session back up on a new connection. Seq is the last
+// sequence number the client saw; everything after it is replayed.
+type Resume struct {
+	SessionId string `json:"session_id"`
+	Seq       int64  `json:"seq"`
+}
+
+// PresenceUpdate is sent by a client to change its own status.
+type PresenceUpdate struct {
+	Status models.Status `json:"status"`
+}
+
+// TypingStart is sent by a client while its user is typing in a DM, and relayed
+// to the other side with UserId and ExpiresAt filled in. It's never stored.
+type TypingStart struct {
+	UserId    string    `json:"userId"`
+	Recipient string    `json:"recipient"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// CallStart is sent by a client to ring one or more users.
+type CallStart struct {
+	Users []string `json:"users"`
+	Video bool     `json:"video"`
+}
+
+// CallAction is sent by someone in a call to accept, decline or leave it.
+type CallAction struct {
+	CallId string `json:"callId"`
+}
+
+// CallSignal carries an SDP offer or answer, or an ICE candidate, between two
+// people in a call. The server checks who it's between and passes Data on as
+// it is; From is filled in from the sender.
+type CallSignal struct {
+	CallId string          `json:"callId"`
+	From   string          `json:"from"`
+	To     string          `json:"to"`
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data"`
+}
+
+type CallState string
+
+const (
+	CallRinging  CallState = "ringing"
+	CallAccepted CallState = "accepted"
+	CallDeclined CallState = "declined"
+	CallMissed   CallState = "missed"
+	CallEnded    CallState = "ended"
+)
+
+// Call is dispatched to everyone in a call whenever anything about it changes,
+// with where the call as a whole stands and where each person in it does.
+type Call struct {
+	ID           string               `json:"id"`
+	Caller       string               `json:"caller"`
+	Video        bool                 `json:"video"`
+	State        CallState            `json:"state"`
+	Participants map[string]CallState `json:"participants"`
+}
+
+// MessageAck is dispatched to the connection a message was sent from once it has
+// been stored, so the client can swap its optimistic copy for the real one.
+type MessageAck struct {
+	Nonce     string    `json:"nonce,omitempty"`
+	ID        int64     `json:"id"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// MessageDelete is sent by a client to delete one of its user's messages, and
+// dispatched to both sides of the DM once it's gone, with Sender and Recipient
+// filled in. Edits go the other way as MESSAGE_UPDATE, with a models.Message
+// carrying just the id and new content.
+type MessageDelete struct {
+	ID        int64  `json:"id"`
+	Sender    string `json:"sender,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+}
+
+// DeliveryAck is sent by a client to say it has every message addressed to its
+// user up to and including MessageId, whether it got them live or in Ready.
+type DeliveryAck struct {
+	MessageId int64 `json:"message_id"`
+}
+
+// ReadAck is sent by a client when its user has read the DM with UserId up to
+// and including MessageId.
+type ReadAck struct {
+	UserId    string `json:"user_id"`
+	MessageId int64  `json:"message_id"`
+}
+
+// MessageRead is dispatched to both sides of a DM when UserId reads it up to
+// MessageId. The other side only gets it if UserId sends read receipts.
+type MessageRead struct {
+	UserId    string    `json:"userId"`
+	Recipient string    `json:"recipient"`
+	MessageId int64     `json:"messageId"`
+	ReadAt    time.Time `json:"readAt"`
+}
+
+// Ready is dispatched once a session has been created. It carries the oldest
+// messages sent to the user that no device has acked yet, and how many are
+// waiting in each conversation, keyed by sender, in case that's not all of them.
+type Ready struct {
+	SessionId         string           `json:"session_id"`
+	UserId            string           `json:"user_id"`
+	Undelivered       []models.Message `json:"undelivered"`
+	UndeliveredCounts map[string]int   `json:"undelivered_counts"`
+}
+
+// Resumed is dispatched after a successful resume, once every missed event has
+// been replayed.
+type Resumed struct{}
+
+var (
+	ErrUnknownOp         = errors.New("unknown op")
+	ErrUnknownEvent      = errors.New("unknown event type")
+	ErrNotIdentified     = errors.New("not identified")
+	ErrAlreadyIdentified = errors.New("already identified")
+	ErrRateLimited       = errors.New("rate limited")
+	ErrNonceTooLong      = errors.New("nonce too long")
+	ErrInvalidIntents    = errors.New("invalid intents")
+	ErrDisallowedIntents = errors.New("disallowed intents")
+)
+
+// eventTypes maps every dispatch event type to a constructor for its payload.
+var eventTypes = map[string]func() any{
+	EventReady:          func() any { return new(Ready) },
+	EventResumed:        func() any { return new(Resumed) },
+	EventMessageCreate:  func() any { return new(models.Message) },
+	EventMessageAck:     func() any { return new(MessageAck) },
+	EventMessageUpdate:  func() any { return new(models.Message) },
+	EventMessageDelete:  func() any { return new(MessageDelete) },
+	EventReactionAdd:    func() any { return new(models.ReactionChange) },
+	EventReactionRemove: func() any { return new(models.ReactionChange) },
+	EventMessageRead:    func() any { return new(MessageRead) },
+	EventPresenceUpdate: func() any { return new(models.Presence) },
+	EventTypingStart:    func() any { return new(TypingStart) },
+	EventCallStart:      func() any { return new(CallStart) },
+	EventCallAccept:     func() any { return new(CallAction) },
+	EventCallDecline:    func() any { return new(CallAction) },
+	EventCallEnd:        func() any { return new(CallAction) },
+	EventCallSignal:     func() any { return new(CallSignal) },
+	EventCallUpdate:     func() any { return new(Call) },
+}
+
+func NewEvent(op Op, eventType string, data any) (Event, error) {
+	event := Event{Op: op, Type: eventType}
+	if data == nil {
+		return event, nil
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return Event{}, err
+	}
+	event.Data = raw
+
+	return event, nil
+}
+
+// DecodePayload unmarshals a dispatch event's data into the payload struct
+// registered for its type.
+func DecodePayload(event Event) (any, error) {
+	newPayload, ok := eventTypes[event.Type]
+	if !ok {
+		return nil, ErrUnknownEvent
+	}
+
+	payload := newPayload()
+	if err := json.Unmarshal(event.Data, payload); err != nil {
+		return nil, err
+	}
+
+	return payload, nil
+}
+
+func encodeEvent(op Op, eventType string, data any) ([]byte, error) {
+	event, err := NewEvent(op, eventType, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(event)
+}
@@ -0,0 +1,393 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ivar/pkg/auth"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Clients behind proxies that won't let a websocket through can speak the same
+// protocol over plain HTTP: frames come down as Server-Sent Events or by
+// long-polling, and go up one POST at a time. To the Manager these connections
+// are Clients like any other. They just have no socket, and the HTTP handlers
+// below stand in for Read and Write.
+
+const defaultPollTimeout = 25 * time.Second
+
+type fallbackConn struct {
+	id     string
+	client *Client
+	// streaming is set for SSE, which is alive for as long as its request is.
+	// Long-polling connections are reaped once they stop polling.
+	streaming bool
+	lastSeen  atomic.Int64
+	// in is held while a frame sent up is handled, since unlike Read several
+	// requests can arrive at once
+	in sync.Mutex
+	// polling is held by the long-poll waiting on the connection, if any
+	polling sync.Mutex
+}
+
+func (c *fallbackConn) touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// fallbackConns finds a connection again for each request made on it.
+type fallbackConns struct {
+	mu    sync.Mutex
+	conns map[string]*fallbackConn
+}
+
+func newFallbackConns() *fallbackConns {
+	return &fallbackConns{conns: make(map[string]*fallbackConn)}
+}
+
+func (f *fallbackConns) add(conn *fallbackConn) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.conns[conn.id] = conn
+}
+
+// get returns the connection with the id, as long as it belongs to the user.
+func (f *fallbackConns) get(userId, id string) (*fallbackConn, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	conn, ok := f.conns[id]
+	if !ok || conn.client.Id != userId {
+		return nil, false
+	}
+	return conn, true
+}
+
+func (f *fallbackConns) remove(id string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.conns, id)
+}
+
+// stale removes and returns the long-polling connections nobody has polled
+// since before the cutoff.
+func (f *fallbackConns) stale(cutoff time.Time) []*fallbackConn {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var stale []*fallbackConn
+	for id, conn := range f.conns {
+		if !conn.streaming && conn.lastSeen.Load() < cutoff.UnixNano() {
+			delete(f.conns, id)
+			stale = append(stale, conn)
+		}
+	}
+	return stale
+}
+
+// reapPolls unregisters long-polling connections that have gone quiet. It runs
+// on the Manager goroutine.
+func (m *Manager) reapPolls(now time.Time) {
+	timeout := m.PollTimeout + time.Duration(float64(m.HeartbeatInterval)*heartbeatGrace)
+	for _, conn := range m.fallbacks.stale(now.Add(-timeout)) {
+		m.Metrics.Reaped.Add(1)
+		m.remove(conn.client)
+	}
+}
+
+// openFallback creates a connection for the user and queues its Hello. Like a
+// websocket it has to identify or resume before anything else.
+func (m *Manager) openFallback(claims auth.Claims, streaming bool) (*fallbackConn, error) {
+	id, err := randomId()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &fallbackConn{
+		id:        id,
+		client:    NewClient(claims.Subject, nil, make(chan []byte, m.SendQueueSize), m),
+		streaming: streaming,
+	}
+	conn.client.granted = Intents(claims.Intents)
+	conn.touch()
+
+	hello, err := encodeEvent(OpHello, "", Hello{HeartbeatInterval: m.HeartbeatInterval.Milliseconds(), ConnectionId: id})
+	if err != nil {
+		return nil, err
+	}
+	conn.client.sendControl(hello)
+
+	m.fallbacks.add(conn)
+	return conn, nil
+}
+
+func (m *Manager) closeFallback(conn *fallbackConn) {
+	m.fallbacks.remove(conn.id)
+	submit(m, m.Unregister, conn.client)
+}
+
+// checkFallback authenticates a request to open a connection, writing the
+// response if it can't be.
+func (m *Manager) checkFallback(ctx *gin.Context) (auth.Claims, bool) {
+	userId, _ := ctx.Params.Get("userId")
+	claims, err := m.authenticate(ctx.Request, userId)
+	if err != nil {
+		if errors.Is(err, auth.ErrTokenExpired) {
+			ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "code": CloseTokenExpired})
+			return auth.Claims{}, false
+		}
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "code": CloseAuthenticationFailed})
+		return auth.Claims{}, false
+	}
+
+	if m.draining.Load() {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "server restarting", "code": websocket.CloseServiceRestart})
+		return auth.Claims{}, false
+	}
+
+	return claims, true
+}
+
+// HandleEvents streams a new connection's frames as Server-Sent Events. The
+// first is Hello, with the connection id to send frames up with.
+func (m *Manager) HandleEvents(ctx *gin.Context) {
+	claims, ok := m.checkFallback(ctx)
+	if !ok {
+		return
+	}
+
+	if !m.addWriter() {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": "server restarting", "code": websocket.CloseServiceRestart})
+		return
+	}
+	conn, err := m.openFallback(claims, true)
+	if err != nil {
+		m.writers.Done()
+		log.Println("error opening connection: " + err.Error())
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error opening connection"})
+		return
+	}
+
+	defer func() {
+		m.closeFallback(conn)
+		m.writers.Done()
+	}()
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	// keep reverse proxies from buffering the stream
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+
+	ticker := time.NewTicker(m.HeartbeatInterval / 2)
+	defer ticker.Stop()
+
+	client := conn.client
+	done := m.done
+	for {
+		var err error
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case <-done:
+			done = nil
+			// see Client.Write
+			if !client.sendClosed {
+				writeSSEClose(ctx.Writer, websocket.CloseServiceRestart, "server restarting")
+				return
+			}
+		case frame, ok := <-client.Send:
+			if !ok {
+				writeSSEClose(ctx.Writer, client.closeCode, client.closeReason)
+				return
+			}
+			_, err = fmt.Fprintf(ctx.Writer, "data: %s\n\n", frame)
+		case frame := <-client.control:
+			_, err = fmt.Fprintf(ctx.Writer, "data: %s\n\n", frame)
+		case <-ticker.C:
+			// a comment, so proxies don't time out a quiet stream
+			_, err = fmt.Fprint(ctx.Writer, ": ping\n\n")
+		}
+		if err != nil {
+			return
+		}
+		ctx.Writer.Flush()
+	}
+}
+
+func writeSSEClose(w gin.ResponseWriter, code int, reason string) {
+	data, _ := json.Marshal(gin.H{"code": code, "reason": reason})
+	_, _ = fmt.Fprintf(w, "event: close\ndata: %s\n\n", data)
+	w.Flush()
+}
+
+// HandlePollConnect opens a long-polling connection. Its Hello is the first
+// thing the first poll returns.
+func (m *Manager) HandlePollConnect(ctx *gin.Context) {
+	claims, ok := m.checkFallback(ctx)
+	if !ok {
+		return
+	}
+
+	conn, err := m.openFallback(claims, false)
+	if err != nil {
+		log.Println("error opening connection: " + err.Error())
+		ctx.JSON(http.StatusInternalServerError, gin.H{"error": "error opening connection"})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"data": gin.H{"connectionId": conn.id}})
+}
+
+// HandlePoll waits up to PollTimeout for frames on a long-polling connection
+// and returns everything queued. Once the connection has been closed it
+// answers 410 with the close code.
+func (m *Manager) HandlePoll(ctx *gin.Context) {
+	conn, ok := m.findFallback(ctx)
+	if !ok {
+		return
+	}
+
+	if !conn.polling.TryLock() {
+		ctx.JSON(http.StatusConflict, gin.H{"error": "already polling"})
+		return
+	}
+	defer conn.polling.Unlock()
+
+	conn.touch()
+	frames, closed := conn.poll(ctx.Request.Context(), m.PollTimeout, m.done)
+	conn.touch()
+
+	// connections that never identified aren't closed by the drain
+	if len(frames) == 0 && !closed && m.draining.Load() {
+		m.fallbacks.remove(conn.id)
+		ctx.JSON(http.StatusGone, gin.H{"error": "server restarting", "code": websocket.CloseServiceRestart})
+		return
+	}
+	if closed && len(frames) == 0 {
+		m.fallbacks.remove(conn.id)
+		ctx.JSON(http.StatusGone, gin.H{"error": conn.client.closeReason, "code": conn.client.closeCode})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, gin.H{"data": frames})
+}
+
+// poll waits for a frame, then takes whatever else is already queued. It
+// reports whether the connection has been closed. It gives up early if ctx or
+// done are.
+func (c *fallbackConn) poll(ctx context.Context, timeout time.Duration, done <-chan struct{}) ([]json.RawMessage, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	frames := make([]json.RawMessage, 0)
+	select {
+	case frame := <-c.client.control:
+		frames = append(frames, frame)
+	case frame, ok := <-c.client.Send:
+		if !ok {
+			return frames, true
+		}
+		frames = append(frames, frame)
+	case <-timer.C:
+		return frames, false
+	case <-ctx.Done():
+		return frames, false
+	case <-done:
+		// take what the drain queued, if anything
+	}
+
+	for {
+		select {
+		case frame := <-c.client.control:
+			frames = append(frames, frame)
+		case frame, ok := <-c.client.Send:
+			if !ok {
+				return frames, true
+			}
+			frames = append(frames, frame)
+		default:
+			return frames, false
+		}
+	}
+}
+
+// HandleSend takes one frame from an SSE or long-polling connection and handles
+// it the way Read would. Errors that would close a websocket are only returned,
+// since the client can see them.
+func (m *Manager) HandleSend(ctx *gin.Context) {
+	conn, ok := m.findFallback(ctx)
+	if !ok {
+		return
+	}
+
+	var event Event
+	body := http.MaxBytesReader(ctx.Writer, ctx.Request.Body, m.MaxFrameSize)
+	if err := json.NewDecoder(body).Decode(&event); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			ctx.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "frame too large"})
+			return
+		}
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "invalid payload", "code": CloseDecodeError})
+		return
+	}
+
+	conn.in.Lock()
+	defer conn.in.Unlock()
+	conn.touch()
+
+	handle, ok := opHandlers[event.Op]
+	if !ok {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": ErrUnknownOp.Error(), "code": CloseUnknownOp})
+		return
+	}
+
+	if event.Op != OpHeartbeat {
+		allowed, err := conn.client.allow(time.Now())
+		if err != nil {
+			m.closeFallback(conn)
+			ctx.JSON(http.StatusTooManyRequests, gin.H{"error": err.Error(), "code": CloseRateLimited})
+			return
+		}
+		if !allowed {
+			ctx.JSON(http.StatusTooManyRequests, gin.H{"error": ErrRateLimited.Error()})
+			return
+		}
+	}
+
+	if err := handle(conn.client, event); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": err.Error(), "code": closeCodeFor(err)})
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
+// findFallback authenticates a request made on an open connection and looks the
+// connection up, writing the response if either fails.
+func (m *Manager) findFallback(ctx *gin.Context) (*fallbackConn, bool) {
+	userId, _ := ctx.Params.Get("userId")
+	if _, err := m.authenticate(ctx.Request, userId); err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return nil, false
+	}
+
+	conn, ok := m.fallbacks.get(userId, ctx.Param("connectionId"))
+	if !ok {
+		ctx.JSON(http.StatusNotFound, gin.H{"error": "unknown connection"})
+		return nil, false
+	}
+
+	return conn, true
+}
@@ -0,0 +1,206 @@
+package gateway
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"ivar/pkg/models"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func httpURL(url string) string {
+	return "http" + strings.TrimPrefix(url, "ws")
+}
+
+// streamEvents opens an SSE connection and returns its frames as they arrive.
+func streamEvents(t *testing.T, url, userId string) <-chan Event {
+	t.Helper()
+	resp, err := http.Get(httpURL(url) + "/api/v1/gateway/" + userId + "/events?token=" + signToken(t, userId, time.Minute))
+	if err != nil {
+		t.Fatalf("error opening stream: %v", err)
+	}
+	t.Cleanup(func() { _ = resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got: %d", resp.StatusCode)
+	}
+
+	events := make(chan Event, 16)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+			if !ok {
+				continue
+			}
+			var event Event
+			if err := json.Unmarshal([]byte(data), &event); err == nil {
+				events <- event
+			}
+		}
+	}()
+	return events
+}
+
+func nextEvent(t *testing.T, events <-chan Event) Event {
+	t.Helper()
+	select {
+	case event := <-events:
+		return event
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected an event")
+	}
+	return Event{}
+}
+
+func sendFrame(t *testing.T, url, userId, connectionId string, event Event) int {
+	t.Helper()
+	body, _ := json.Marshal(event)
+	req, _ := http.NewRequest(http.MethodPost, httpURL(url)+"/api/v1/gateway/"+userId+"/send/"+connectionId, bytes.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+signToken(t, userId, time.Minute))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error sending frame: %v", err)
+	}
+	_ = resp.Body.Close()
+	return resp.StatusCode
+}
+
+func pollFrames(t *testing.T, url, userId, connectionId string) []Event {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, httpURL(url)+"/api/v1/gateway/"+userId+"/poll/"+connectionId, nil)
+	req.Header.Set("Authorization", "Bearer "+signToken(t, userId, time.Minute))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error polling: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Data []Event `json:"data"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&result)
+	return result.Data
+}
+
+func TestFallback_SSE(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+	_, url := newTestServer(t, store)
+
+	recipient := dial(t, url, "recipient")
+	events := streamEvents(t, url, "sender")
+
+	var hello Hello
+	if event := nextEvent(t, events); event.Op != OpHello || json.Unmarshal(event.Data, &hello) != nil || hello.ConnectionId == "" {
+		t.Fatalf("first frame should be hello with a connection id, got: %+v", event)
+	}
+
+	if code := sendFrame(t, url, "sender", hello.ConnectionId, Event{Op: OpIdentify}); code != http.StatusOK {
+		t.Fatalf("identify should be accepted, got: %d", code)
+	}
+	if event := nextEvent(t, events); event.Type != EventReady {
+		t.Fatalf("expected ready, got: %+v", event)
+	}
+
+	message, _ := NewEvent(OpDispatch, EventMessageCreate, models.Message{Recipient: "recipient", Content: "through a proxy"})
+	if code := sendFrame(t, url, "sender", hello.ConnectionId, message); code != http.StatusOK {
+		t.Fatalf("message should be accepted, got: %d", code)
+	}
+
+	if event := nextEvent(t, events); event.Type != EventMessageAck {
+		t.Errorf("sender should get an ack, got: %+v", event)
+	}
+	if event := readEvent(t, recipient); event.Type != EventMessageCreate {
+		t.Errorf("recipient should get the message, got: %+v", event)
+	}
+}
+
+func TestFallback_LongPoll(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+	_, url := newTestServer(t, store, func(m *Manager) {
+		m.PollTimeout = 200 * time.Millisecond
+	})
+
+	req, _ := http.NewRequest(http.MethodPost, httpURL(url)+"/api/v1/gateway/recipient/poll", nil)
+	req.Header.Set("Authorization", "Bearer "+signToken(t, "recipient", time.Minute))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("error connecting: %v", err)
+	}
+	var connected struct {
+		Data struct {
+			ConnectionId string `json:"connectionId"`
+		} `json:"data"`
+	}
+	_ = json.NewDecoder(resp.Body).Decode(&connected)
+	_ = resp.Body.Close()
+	id := connected.Data.ConnectionId
+
+	if frames := pollFrames(t, url, "recipient", id); len(frames) != 1 || frames[0].Op != OpHello {
+		t.Fatalf("first poll should return hello, got: %+v", frames)
+	}
+	sendFrame(t, url, "recipient", id, Event{Op: OpIdentify})
+	if frames := pollFrames(t, url, "recipient", id); len(frames) != 1 || frames[0].Type != EventReady {
+		t.Fatalf("expected ready, got: %+v", frames)
+	}
+
+	if frames := pollFrames(t, url, "recipient", id); len(frames) != 0 {
+		t.Errorf("a quiet poll should time out empty, got: %+v", frames)
+	}
+
+	sender := dial(t, url, "sender")
+	sendMessage(t, sender, "recipient", "one")
+	sendMessage(t, sender, "recipient", "two")
+	time.Sleep(50 * time.Millisecond)
+
+	frames := pollFrames(t, url, "recipient", id)
+	if len(frames) != 2 || frames[0].Type != EventMessageCreate || frames[1].Type != EventMessageCreate {
+		t.Errorf("poll should return both messages, got: %+v", frames)
+	}
+}
+
+func TestFallback_Unauthenticated(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	resp, err := http.Get(httpURL(url) + "/api/v1/gateway/userId1/events?token=" + signToken(t, "userId2", time.Minute))
+	if err != nil {
+		t.Fatalf("error opening stream: %v", err)
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected 401, got: %d", resp.StatusCode)
+	}
+}
+
+func TestFallback_UnknownConnection(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	if code := sendFrame(t, url, "userId1", "nope", Event{Op: OpIdentify}); code != http.StatusNotFound {
+		t.Errorf("expected 404, got: %d", code)
+	}
+}
+
+func TestFallbackConns_Stale(t *testing.T) {
+	f := newFallbackConns()
+	polling := &fallbackConn{id: "polling", client: &Client{Id: "userId1"}}
+	streaming := &fallbackConn{id: "streaming", client: &Client{Id: "userId1"}, streaming: true}
+	f.add(polling)
+	f.add(streaming)
+
+	stale := f.stale(time.Now())
+	if len(stale) != 1 || stale[0] != polling {
+		t.Errorf("only the quiet poller should be stale, got: %v", stale)
+	}
+	if _, ok := f.get("userId1", "streaming"); !ok {
+		t.Errorf("streaming connections aren't reaped")
+	}
+	if _, ok := f.get("userId2", "streaming"); ok {
+		t.Errorf("connections should only be found by their own user")
+	}
+}
@@ -0,0 +1,139 @@
+package gateway
+
+import (
+	"errors"
+	"ivar/pkg/auth"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Close codes sent to clients we disconnect. Browsers can't see the HTTP status
+// of a failed upgrade, so handshake failures upgrade first and close with these too.
+const (
+	CloseAuthenticationFailed = 4001
+	CloseTokenExpired         = 4002
+	CloseDecodeError          = 4003
+	CloseUnknownOp            = 4004
+	CloseInvalidVersion       = 4005
+	CloseNotIdentified        = 4006
+	CloseAlreadyIdentified    = 4007
+	CloseSlowConsumer         = 4008
+	CloseRateLimited          = 4009
+	CloseInvalidIntents       = 4010
+	CloseDisallowedIntents    = 4011
+	CloseInvalidEncoding      = 4012
+)
+
+// BearerProtocol is the Sec-WebSocket-Protocol a client offers alongside its token,
+// e.g. ["ivar.bearer", "<token>"]. Browsers should use it, since they can't set an
+// Authorization header on a WebSocket; ?token= is for EventSource, which can't
+// do either.
+const BearerProtocol = "ivar.bearer"
+
+// upgrader negotiates permessage-deflate with any client that offers it.
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:    1024,
+	WriteBufferSize:   1024,
+	Subprotocols:      []string{BearerProtocol},
+	EnableCompression: true,
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+func (m *Manager) HandleConnections(ctx *gin.Context) {
+	currentUser, _ := ctx.Params.Get("userId")
+	if currentUser == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{"error": "no user id provided"})
+		return
+	}
+
+	claims, authErr := m.authenticate(ctx.Request, currentUser)
+
+	conn, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		log.Println("error upgrading connection: " + err.Error())
+		return
+	}
+
+	if v := ctx.Query("v"); v != "" && v != strconv.Itoa(Version) {
+		closeWithCode(conn, CloseInvalidVersion, "unsupported gateway version")
+		return
+	}
+
+	encoding, err := parseEncoding(ctx.Query("encoding"))
+	if err != nil {
+		closeWithCode(conn, CloseInvalidEncoding, err.Error())
+		return
+	}
+	// only applies if the client negotiated compression
+	_ = conn.SetCompressionLevel(m.CompressionLevel)
+
+	if authErr != nil {
+		code := CloseAuthenticationFailed
+		if errors.Is(authErr, auth.ErrTokenExpired) {
+			code = CloseTokenExpired
+		}
+		closeWithCode(conn, code, authErr.Error())
+		return
+	}
+
+	client := NewClient(currentUser, conn, make(chan []byte, m.SendQueueSize), m)
+	client.encoding = encoding
+	client.granted = Intents(claims.Intents)
+
+	hello, err := encodeEvent(OpHello, "", Hello{HeartbeatInterval: m.HeartbeatInterval.Milliseconds()})
+	if err != nil {
+		log.Println("error encoding hello: " + err.Error())
+		_ = conn.Close()
+		return
+	}
+
+	if !m.addWriter() {
+		closeWithCode(conn, websocket.CloseServiceRestart, "server restarting")
+		return
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := client.writeFrame(hello); err != nil {
+		m.writers.Done()
+		_ = conn.Close()
+		return
+	}
+
+	go client.Read()
+	go client.Write()
+}
+
+// authenticate checks the request carries a valid token issued to userId.
+func (m *Manager) authenticate(r *http.Request, userId string) (auth.Claims, error) {
+	claims, err := m.Auth.Verify(tokenFromRequest(r))
+	if err != nil {
+		return auth.Claims{}, err
+	}
+	if claims.Subject != userId {
+		return auth.Claims{}, auth.ErrInvalidToken
+	}
+
+	return claims, nil
+}
+
+func tokenFromRequest(r *http.Request) string {
+	protocols := websocket.Subprotocols(r)
+	for i, protocol := range protocols {
+		if protocol == BearerProtocol && i+1 < len(protocols) {
+			return protocols[i+1]
+		}
+	}
+
+	return auth.BearerToken(r)
+}
+
+func closeWithCode(conn *websocket.Conn, code int, reason string) {
+	_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	_ = conn.Close()
+}
@@ -0,0 +1,173 @@
+package gateway
+
+import (
+	"ivar/pkg/auth"
+	"ivar/pkg/chat"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"ivar/pkg/presence"
+	"ivar/pkg/server"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/mock"
+)
+
+var testKey = []byte("local-signing-key")
+
+// newTestStore is a mock store with nobody's friends with anybody, for tests
+// that don't care about presence fan-out.
+func newTestStore() *database.MockStore {
+	store := new(database.MockStore)
+	store.On("GetFriends", mock.Anything).Return([]models.User{}, nil).Maybe()
+	nothingUndelivered(store)
+	noMemberships(store)
+	return store
+}
+
+// noMemberships has every user connect with no servers and no DM history.
+func noMemberships(store *database.MockStore) {
+	store.On("GetMemberServers", mock.Anything).Return([]string{}, nil).Maybe()
+	store.On("AllChats", mock.Anything).Return([]models.User{}, nil).Maybe()
+}
+
+// nothingUndelivered has every user connect with nothing waiting for them.
+func nothingUndelivered(store *database.MockStore) {
+	store.On("GetUndeliveredMessages", mock.Anything, mock.Anything).Return([]models.Message{}, nil).Maybe()
+	store.On("CountUndeliveredMessages", mock.Anything).Return(map[string]int{}, nil).Maybe()
+}
+
+// storeMessages has the mock store accept every message, giving each the next id.
+func storeMessages(store *database.MockStore) {
+	var id atomic.Int64
+	store.On("StoreMessage", mock.Anything).Return(func(message models.Message) models.Message {
+		message.ID = id.Add(1)
+		message.Timestamp = time.Now()
+		return message
+	}, true, nil)
+}
+
+func newTestServer(t *testing.T, store database.Store, configure ...func(m *Manager)) (*Manager, string) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{Key: testKey}, presence.NewService(store), NewLocalBus())
+	for _, c := range configure {
+		c(m)
+	}
+	go m.Start()
+
+	r := gin.New()
+	r.GET("/ws/:userId", m.HandleConnections)
+	r.GET("/api/v1/gateway/metrics", m.HandleMetrics)
+	r.GET("/api/v1/gateway/:userId/events", m.HandleEvents)
+	r.POST("/api/v1/gateway/:userId/poll", m.HandlePollConnect)
+	r.GET("/api/v1/gateway/:userId/poll/:connectionId", m.HandlePoll)
+	r.POST("/api/v1/gateway/:userId/send/:connectionId", m.HandleSend)
+	srv := httptest.NewServer(r)
+	t.Cleanup(srv.Close)
+
+	return m, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func signToken(t *testing.T, userId string, ttl time.Duration) string {
+	t.Helper()
+	s := auth.Service{Key: testKey}
+	token, err := s.Sign(userId, ttl)
+	if err != nil {
+		t.Fatalf("error signing token: %v", err)
+	}
+	return token
+}
+
+func expectCloseCode(t *testing.T, conn *websocket.Conn, code int) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, code) {
+		t.Errorf("expected close code %d, got: %v", code, err)
+	}
+}
+
+func TestHandleConnections_QueryToken_Success(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/userId1?token="+signToken(t, "userId1", time.Minute), nil)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := conn.ReadMessage(); websocket.IsCloseError(err, CloseAuthenticationFailed, CloseTokenExpired) {
+		t.Errorf("connection should stay open, got: %v", err)
+	}
+}
+
+func TestHandleConnections_Subprotocol_Success(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	dialer := websocket.Dialer{Subprotocols: []string{BearerProtocol, signToken(t, "userId1", time.Minute)}}
+	conn, _, err := dialer.Dial(url+"/ws/userId1", nil)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != BearerProtocol {
+		t.Errorf("subprotocol should be %q, got: %q", BearerProtocol, conn.Subprotocol())
+	}
+}
+
+func TestHandleConnections_MissingToken_Failure(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/userId1", nil)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	defer conn.Close()
+
+	expectCloseCode(t, conn, CloseAuthenticationFailed)
+}
+
+func TestHandleConnections_OtherUsersToken_Failure(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/userId2?token="+signToken(t, "userId1", time.Minute), nil)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	defer conn.Close()
+
+	expectCloseCode(t, conn, CloseAuthenticationFailed)
+}
+
+func TestHandleConnections_ExpiredToken_Failure(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/userId1?token="+signToken(t, "userId1", -time.Minute), nil)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	defer conn.Close()
+
+	expectCloseCode(t, conn, CloseTokenExpired)
+}
+
+func TestHandleConnections_UnsupportedVersion_Failure(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/userId1?v=99&token="+signToken(t, "userId1", time.Minute), nil)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	defer conn.Close()
+
+	expectCloseCode(t, conn, CloseInvalidVersion)
+}
@@ -0,0 +1,75 @@
+package gateway
+
+// Intents is a bitmask of the event categories a session wants dispatched to it.
+// Clients pick them in Identify so they aren't sent what they'd throw away, like
+// a bot that only handles messages getting every presence change.
+//
+// Events that are about the session itself, like READY or MESSAGE_ACK, don't
+// belong to an intent and are always sent.
+type Intents uint64
+
+const (
+	// IntentMessages covers MESSAGE_CREATE, MESSAGE_UPDATE, MESSAGE_DELETE and
+	// MESSAGE_READ.
+	IntentMessages Intents = 1 << iota
+	// IntentTyping covers TYPING_START.
+	IntentTyping
+	// IntentPresence covers PRESENCE_UPDATE for the user's own devices and
+	// their friends.
+	IntentPresence
+	// IntentServerPresence covers PRESENCE_UPDATE for people the user only
+	// shares a server with. On big servers that's most of the traffic, so it's
+	// privileged.
+	IntentServerPresence
+	// IntentCalls covers CALL_UPDATE and CALL_SIGNAL.
+	IntentCalls
+	// IntentReactions covers MESSAGE_REACTION_ADD and MESSAGE_REACTION_REMOVE.
+	IntentReactions
+
+	// AllIntents is every intent there is, privileged or not.
+	AllIntents = IntentMessages | IntentTyping | IntentPresence | IntentServerPresence | IntentCalls | IntentReactions
+	// PrivilegedIntents can only be asked for by users whose token grants them.
+	PrivilegedIntents = IntentServerPresence
+	// DefaultIntents is what a session gets if it doesn't ask for anything.
+	DefaultIntents = AllIntents &^ PrivilegedIntents
+)
+
+// eventIntents maps the event types that belong to an intent to it.
+var eventIntents = map[string]Intents{
+	EventMessageCreate:  IntentMessages,
+	EventMessageUpdate:  IntentMessages,
+	EventMessageDelete:  IntentMessages,
+	EventMessageRead:    IntentMessages,
+	EventTypingStart:    IntentTyping,
+	EventPresenceUpdate: IntentPresence,
+	EventCallUpdate:     IntentCalls,
+	EventCallSignal:     IntentCalls,
+	EventReactionAdd:    IntentReactions,
+	EventReactionRemove: IntentReactions,
+}
+
+// Has reports whether every intent in other is set.
+func (i Intents) Has(other Intents) bool {
+	return i&other == other
+}
+
+// check makes sure the intents a client asked for exist and that it's allowed
+// the privileged ones among them.
+func (i Intents) check(granted Intents) error {
+	if i&^AllIntents != 0 {
+		return ErrInvalidIntents
+	}
+	if privileged := i & PrivilegedIntents; !granted.Has(privileged) {
+		return ErrDisallowedIntents
+	}
+	return nil
+}
+
+// wants reports whether a delivery should be dispatched to the session.
+func (s *Session) wants(delivery Delivery) bool {
+	intent := delivery.Intent
+	if intent == 0 {
+		intent = eventIntents[delivery.Type]
+	}
+	return s.Intents.Has(intent)
+}
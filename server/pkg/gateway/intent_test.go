@@ -0,0 +1,137 @@
+package gateway
+
+import (
+	"ivar/pkg/auth"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/mock"
+)
+
+// connectGranted opens a connection with a token granting the given privileged
+// intents and reads Hello, without identifying.
+func connectGranted(t *testing.T, url, userId string, granted Intents) *websocket.Conn {
+	t.Helper()
+	s := auth.Service{Key: testKey}
+	token, err := s.SignClaims(auth.Claims{Subject: userId, Intents: uint64(granted)}, time.Minute)
+	if err != nil {
+		t.Fatalf("error signing token: %v", err)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(url+"/ws/"+userId+"?token="+token, nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+
+	if hello := readEvent(t, conn); hello.Op != OpHello {
+		t.Fatalf("first frame should be hello, got: %+v", hello)
+	}
+	return conn
+}
+
+func identifyWith(t *testing.T, conn *websocket.Conn, intents Intents) {
+	t.Helper()
+	event, _ := NewEvent(OpIdentify, "", Identify{Intents: &intents})
+	if err := conn.WriteJSON(event); err != nil {
+		t.Fatalf("error identifying: %v", err)
+	}
+}
+
+func TestIntents_FiltersDispatch(t *testing.T) {
+	store := friendsStore()
+	storeMessages(store)
+	_, url := newTestServer(t, store)
+
+	alice := dial(t, url, "alice")
+	bob := connect(t, url, "bob")
+	identifyWith(t, bob, IntentMessages)
+	if ready := readEvent(t, bob); ready.Type != EventReady {
+		t.Fatalf("expected ready, got: %+v", ready)
+	}
+
+	typing, _ := NewEvent(OpDispatch, EventTypingStart, TypingStart{Recipient: "bob"})
+	_ = alice.WriteJSON(typing)
+	sendMessage(t, alice, "bob", "hi")
+
+	// no presence for alice, no typing, just the message
+	if event := readEvent(t, bob); event.Type != EventMessageCreate {
+		t.Errorf("bob should only get the message, got: %+v", event)
+	}
+}
+
+func TestIntents_ServerPresence_Granted(t *testing.T) {
+	store := new(database.MockStore)
+	for _, userId := range []string{"alice", "carol", "dave"} {
+		store.On("GetMemberServers", userId).Return([]string{"serverId1"}, nil)
+	}
+	store.On("GetFriends", mock.Anything).Return([]models.User{}, nil)
+	nothingUndelivered(store)
+	noMemberships(store)
+	_, url := newTestServer(t, store)
+
+	carol := connectGranted(t, url, "carol", IntentServerPresence)
+	identifyWith(t, carol, DefaultIntents|IntentServerPresence)
+	readEvent(t, carol)
+	dave := dial(t, url, "dave")
+	if p := readPresence(t, carol); p.UserId != "dave" {
+		t.Errorf("carol should see dave come online, got: %+v", p)
+	}
+
+	dial(t, url, "alice")
+
+	if p := readPresence(t, carol); p.UserId != "alice" || p.Status != models.StatusOnline {
+		t.Errorf("carol should see alice online, got: %+v", p)
+	}
+	_ = dave.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, frame, err := dave.ReadMessage(); err == nil {
+		t.Errorf("dave should not hear about alice, got: %s", frame)
+	}
+}
+
+func TestIntents_ServerPresence_NotGranted(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn := connect(t, url, "userId1")
+	identifyWith(t, conn, IntentServerPresence)
+
+	expectCloseCode(t, conn, CloseDisallowedIntents)
+}
+
+func TestIntents_Unknown(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn := connect(t, url, "userId1")
+	identifyWith(t, conn, AllIntents+1)
+
+	expectCloseCode(t, conn, CloseInvalidIntents)
+}
+
+func TestIntents_ServerPresence_FriendsHearOnce(t *testing.T) {
+	store := new(database.MockStore)
+	store.On("GetFriends", "alice").Return([]models.User{{ID: "bob"}}, nil)
+	store.On("GetFriends", mock.Anything).Return([]models.User{}, nil)
+	store.On("GetMemberServers", "alice").Return([]string{"serverId1", "serverId2"}, nil)
+	store.On("GetMemberServers", "bob").Return([]string{"serverId1", "serverId2"}, nil)
+	nothingUndelivered(store)
+	noMemberships(store)
+	_, url := newTestServer(t, store)
+
+	bob := connectGranted(t, url, "bob", IntentServerPresence)
+	identifyWith(t, bob, DefaultIntents|IntentServerPresence)
+	readEvent(t, bob)
+
+	dial(t, url, "alice")
+
+	if p := readPresence(t, bob); p.UserId != "alice" || p.Status != models.StatusOnline {
+		t.Errorf("bob should see alice online, got: %+v", p)
+	}
+	// bob is her friend and shares two servers with her, but hears it once
+	_ = bob.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, frame, err := bob.ReadMessage(); err == nil {
+		t.Errorf("bob should hear about alice once, got: %s", frame)
+	}
+}
@@ -0,0 +1,811 @@
+package gateway
+
+import (
+	"compress/flate"
+	"context"
+	"encoding/json"
+	"errors"
+	"ivar/pkg/auth"
+	"ivar/pkg/chat"
+	"ivar/pkg/models"
+	"ivar/pkg/presence"
+	"ivar/pkg/server"
+	"log"
+	"maps"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Inbound is a decoded dispatch event read off a client's socket, tagged with the
+// connection it came from so the sender's other devices can be told about it.
+type Inbound struct {
+	From    *Client
+	Type    string
+	Payload any
+}
+
+// ResumeRequest asks the Manager to attach a client to an existing session.
+type ResumeRequest struct {
+	Client *Client
+	Resume Resume
+}
+
+type Manager struct {
+	// Sessions indexes every session by user id. A user has one entry per
+	// device they're connected from, plus any recently dropped sessions that
+	// can still be resumed.
+	Sessions    map[string]map[*Session]bool
+	Broadcast   chan Inbound
+	Register    chan *Client
+	Resume      chan ResumeRequest
+	Unregister  chan *Client
+	ChatService *chat.Service
+	Servers     *server.Service
+	Auth        *auth.Service
+	Presence    *presence.Service
+	Bus         Bus
+	Metrics     *Metrics
+	// HeartbeatInterval is announced to clients in Hello and drives the socket
+	// read deadlines and ping schedule.
+	HeartbeatInterval time.Duration
+	// ResumeTimeout is how long a session is kept after its connection drops.
+	ResumeTimeout time.Duration
+	// ReplayBufferSize is how many events each session keeps for replay. With
+	// none, a session can only be resumed if it missed nothing.
+	ReplayBufferSize int
+	// SendQueueSize is how many frames can wait to be written to a client.
+	SendQueueSize int
+	// SlowConsumerPolicy says what happens when a client's send queue is full.
+	SlowConsumerPolicy SlowConsumerPolicy
+	// MaxFrameSize is the largest frame a client may send, in bytes. It's big
+	// enough for an SDP offer.
+	MaxFrameSize int64
+	// CompressionLevel is the flate level used for clients that negotiated
+	// permessage-deflate.
+	CompressionLevel int
+	// ConnectionLimit and UserLimit bound how fast frames are accepted from a
+	// single connection and from all of a user's connections together.
+	ConnectionLimit RateLimit
+	UserLimit       RateLimit
+	// TypingInterval is the least time between two typing events a user can
+	// send to the same conversation; anything more often is dropped.
+	TypingInterval time.Duration
+	// TypingTimeout is how long a typing indicator shows without a refresh.
+	TypingTimeout time.Duration
+	// PollTimeout is how long a long-poll waits for something to return.
+	PollTimeout time.Duration
+	// RingTimeout is how long a call rings before it's missed.
+	RingTimeout time.Duration
+
+	// instance tells this Manager apart from others on the bus
+	instance   string
+	sessions   map[string]*Session
+	topics     map[string]map[*Session]bool
+	typing     map[typingKey]time.Time
+	calls      map[string]*call
+	deliveries *deliveryQueue
+	outbox     *deliveryQueue
+	limiter    *userLimiter
+	fallbacks  *fallbackConns
+
+	shutdown chan struct{}
+	done     chan struct{}
+	// stopped is closed once Start has published everything queued while
+	// draining, after done.
+	stopped chan struct{}
+	// accepting is held to check draining and add to writers together, so
+	// Shutdown can't start waiting on writers between the two.
+	accepting sync.Mutex
+	draining  atomic.Bool
+	writers   sync.WaitGroup
+}
+
+const (
+	defaultHeartbeatInterval = 30 * time.Second
+	defaultResumeTimeout     = 2 * time.Minute
+	defaultReplayBufferSize  = 256
+	defaultSendQueueSize     = 512
+	defaultMaxFrameSize      = 6144
+	defaultTypingInterval    = 5 * time.Second
+	defaultTypingTimeout     = 10 * time.Second
+	// readyMessageLimit is how many undelivered messages Ready carries. Past
+	// that clients go by the counts and fetch history over REST.
+	readyMessageLimit = 100
+	// publishTimeout bounds each publish, so a stuck bus can't hold up the
+	// deliveries queued behind it forever.
+	publishTimeout = 5 * time.Second
+)
+
+func NewManager(chatService *chat.Service, serverService *server.Service, authService *auth.Service, presenceService *presence.Service, bus Bus) *Manager {
+	instance, err := randomId()
+	if err != nil {
+		panic("error generating instance id: " + err.Error())
+	}
+
+	return &Manager{
+		Broadcast:   make(chan Inbound),
+		Register:    make(chan *Client),
+		Resume:      make(chan ResumeRequest),
+		Unregister:  make(chan *Client),
+		Sessions:    make(map[string]map[*Session]bool),
+		ChatService: chatService,
+		Servers:     serverService,
+		Auth:        authService,
+		Presence:    presenceService,
+		Bus:         bus,
+		Metrics:     &Metrics{},
+
+		HeartbeatInterval: defaultHeartbeatInterval,
+		ResumeTimeout:     defaultResumeTimeout,
+		ReplayBufferSize:  defaultReplayBufferSize,
+		SendQueueSize:     defaultSendQueueSize,
+		MaxFrameSize:      defaultMaxFrameSize,
+		CompressionLevel:  flate.BestSpeed,
+		ConnectionLimit:   RateLimit{Rate: 5, Burst: 10},
+		UserLimit:         RateLimit{Rate: 10, Burst: 20},
+		TypingInterval:    defaultTypingInterval,
+		TypingTimeout:     defaultTypingTimeout,
+		PollTimeout:       defaultPollTimeout,
+		RingTimeout:       defaultRingTimeout,
+
+		instance:   instance,
+		sessions:   make(map[string]*Session),
+		topics:     make(map[string]map[*Session]bool),
+		typing:     make(map[typingKey]time.Time),
+		calls:      make(map[string]*call),
+		deliveries: newDeliveryQueue(),
+		outbox:     newDeliveryQueue(),
+		limiter:    newUserLimiter(),
+		fallbacks:  newFallbackConns(),
+
+		shutdown: make(chan struct{}),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+}
+
+func (m *Manager) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if err := m.Bus.Subscribe(ctx, m.deliveries.push); err != nil {
+		panic("error subscribing to gateway bus: " + err.Error())
+	}
+	published := make(chan struct{})
+	go m.publishLoop(ctx, published)
+	defer func() {
+		cancel()
+		<-published
+		close(m.stopped)
+	}()
+
+	sweep := time.NewTicker(m.ResumeTimeout / 4)
+	defer sweep.Stop()
+	measure := time.NewTicker(metricsInterval)
+	defer measure.Stop()
+	ringing := time.NewTicker(callSweepInterval)
+	defer ringing.Stop()
+
+	for {
+		select {
+		case conn := <-m.Register:
+			m.add(conn)
+		case req := <-m.Resume:
+			m.resume(req.Client, req.Resume)
+		case conn := <-m.Unregister:
+			m.remove(conn)
+		case in := <-m.Broadcast:
+			m.route(in)
+		case <-m.deliveries.notify:
+			for _, delivery := range m.deliveries.drain() {
+				m.deliver(delivery)
+			}
+		case now := <-sweep.C:
+			m.expire(now)
+			m.expireTyping(now)
+			m.limiter.expire(m.UserLimit, now)
+			m.reapPolls(now)
+		case <-measure.C:
+			m.measureQueues()
+		case now := <-ringing.C:
+			m.expireCalls(now)
+		case <-m.shutdown:
+			m.drain()
+			close(m.done)
+			return
+		}
+	}
+}
+
+// Shutdown drains the gateway: new connections are turned away, every client is
+// told to reconnect and closed once its queue is flushed, and the Manager stops
+// after whatever it was in the middle of, like storing a message. It returns
+// once every client's writer has finished and everything left to publish, like
+// users going offline, has been, or once ctx is done.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.accepting.Lock()
+	m.draining.Store(true)
+	m.accepting.Unlock()
+
+	select {
+	case m.shutdown <- struct{}{}:
+	case <-m.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	flushed := make(chan struct{})
+	go func() {
+		m.writers.Wait()
+		close(flushed)
+	}()
+
+	select {
+	case <-flushed:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case <-m.stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (m *Manager) drain() {
+	reconnect, err := encodeEvent(OpReconnect, "", nil)
+	if err != nil {
+		log.Println("error encoding reconnect: " + err.Error())
+	}
+
+	for _, sessions := range m.Sessions {
+		for session := range sessions {
+			if conn := session.client; conn != nil {
+				if reconnect != nil {
+					m.enqueue(conn, "", reconnect)
+				}
+				m.closeClientWithCode(conn, websocket.CloseServiceRestart, "server restarting")
+			}
+		}
+	}
+}
+
+// addWriter counts a new connection's writer in the writers Shutdown waits
+// for, unless the gateway is already draining.
+func (m *Manager) addWriter() bool {
+	m.accepting.Lock()
+	defer m.accepting.Unlock()
+
+	if m.draining.Load() {
+		return false
+	}
+	m.writers.Add(1)
+	return true
+}
+
+// submit hands a value to the Manager goroutine, unless it has already stopped.
+func submit[T any](m *Manager, ch chan<- T, value T) bool {
+	select {
+	case ch <- value:
+		return true
+	case <-m.done:
+		return false
+	}
+}
+
+func (m *Manager) route(in Inbound) {
+	switch payload := in.Payload.(type) {
+	case *models.Message:
+		if in.Type == EventMessageUpdate {
+			m.editMessage(in.From, *payload)
+		} else {
+			m.routeMessage(in.From, *payload)
+		}
+	case *MessageDelete:
+		m.deleteMessage(in.From, payload.ID)
+	case *models.ReactionChange:
+		m.react(in.From, in.Type, *payload)
+	case *PresenceUpdate:
+		m.updatePresence(in.From, payload.Status)
+	case *TypingStart:
+		m.routeTyping(in.From, *payload)
+	case *DeliveryAck:
+		if err := m.ChatService.MarkDelivered(in.From.Id, payload.MessageId); err != nil {
+			log.Println("error marking messages delivered: " + err.Error())
+		}
+	case *ReadAck:
+		m.routeRead(in.From, *payload)
+	case *CallStart:
+		m.startCall(in.From, *payload)
+	case *CallAction:
+		m.forwardCall(in.From, in.Type, payload.CallId, nil)
+	case *CallSignal:
+		m.forwardCall(in.From, in.Type, payload.CallId, payload)
+	default:
+		log.Println("no route for event: " + in.Type)
+	}
+}
+
+func (m *Manager) routeMessage(from *Client, message models.Message) {
+	stored, created, err := m.ChatService.AddMessage(message)
+	if err != nil {
+		log.Println("error adding message: " + err.Error())
+		if errors.Is(err, chat.ErrInvalidReply) {
+			from.sendError(Error{Code: ErrorInvalidReply, Message: err.Error(), Nonce: message.Nonce})
+			return
+		}
+		if errors.Is(err, chat.ErrInvalidAttachment) {
+			from.sendError(Error{Code: ErrorInvalidAttachment, Message: err.Error(), Nonce: message.Nonce})
+			return
+		}
+		from.sendError(Error{Code: ErrorMessageNotStored, Message: "message could not be stored", Nonce: message.Nonce})
+		return
+	}
+	m.ack(from, stored)
+
+	// a retry of a message that was already stored was delivered the first time
+	if !created {
+		return
+	}
+
+	m.dispatchMessage(from, stored)
+}
+
+// dispatchMessage sends a stored message to both sides of its DM, except the
+// connection it came from, if any.
+func (m *Manager) dispatchMessage(from *Client, message models.Message) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println("error encoding message: " + err.Error())
+		return
+	}
+
+	// both sides join the conversation's topic as the message reaches them,
+	// in case it's the first one
+	topic := DirectTopic(message.Sender, message.Recipient)
+	m.publish(Delivery{UserId: message.Recipient, Join: topic, Type: EventMessageCreate, Data: data}, nil)
+	if message.Recipient != message.Sender {
+		m.publish(Delivery{UserId: message.Sender, Join: topic, Type: EventMessageCreate, Data: data}, from)
+	}
+}
+
+func (m *Manager) editMessage(from *Client, message models.Message) {
+	edited, err := m.ChatService.EditMessage(from.Id, message.ID, message.Content)
+	if err != nil {
+		log.Println("error editing message: " + err.Error())
+		from.sendError(Error{Code: ErrorMessageNotChanged, Message: "message could not be edited"})
+		return
+	}
+	m.MessageUpdated(edited)
+}
+
+func (m *Manager) deleteMessage(from *Client, messageId int64) {
+	deleted, err := m.ChatService.DeleteMessage(from.Id, messageId)
+	if err != nil {
+		log.Println("error deleting message: " + err.Error())
+		from.sendError(Error{Code: ErrorMessageNotChanged, Message: "message could not be deleted"})
+		return
+	}
+	m.MessageDeleted(deleted)
+}
+
+func (m *Manager) react(from *Client, eventType string, change models.ReactionChange) {
+	react, notify := m.ChatService.AddReaction, m.ReactionAdded
+	if eventType == EventReactionRemove {
+		react, notify = m.ChatService.RemoveReaction, m.ReactionRemoved
+	}
+
+	changed, ok, err := react(change)
+	if err != nil {
+		log.Println("error changing reaction: " + err.Error())
+		from.sendError(Error{Code: ErrorMessageNotChanged, Message: "reaction could not be changed"})
+		return
+	}
+	if ok {
+		notify(changed)
+	}
+}
+
+// ReactionAdded tells both sides of a DM that someone reacted to a message. It's
+// safe to call from any goroutine.
+func (m *Manager) ReactionAdded(change models.ReactionChange) {
+	m.dispatchReaction(EventReactionAdd, change)
+}
+
+// ReactionRemoved tells both sides of a DM that someone took a reaction back.
+// It's safe to call from any goroutine.
+func (m *Manager) ReactionRemoved(change models.ReactionChange) {
+	m.dispatchReaction(EventReactionRemove, change)
+}
+
+func (m *Manager) dispatchReaction(eventType string, change models.ReactionChange) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		log.Println("error encoding reaction: " + err.Error())
+		return
+	}
+	m.publish(Delivery{Topic: DirectTopic(change.Sender, change.Recipient), Type: eventType, Data: data}, nil)
+}
+
+// MessageUpdated tells both sides of a DM, every device included, that a message
+// was edited. It's safe to call from any goroutine.
+func (m *Manager) MessageUpdated(message models.Message) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		log.Println("error encoding message: " + err.Error())
+		return
+	}
+	m.publish(Delivery{Topic: DirectTopic(message.Sender, message.Recipient), Type: EventMessageUpdate, Data: data}, nil)
+}
+
+// MessageDeleted tells both sides of a DM, every device included, that a message
+// was deleted. It's safe to call from any goroutine.
+func (m *Manager) MessageDeleted(message models.Message) {
+	data, err := json.Marshal(MessageDelete{ID: message.ID, Sender: message.Sender, Recipient: message.Recipient})
+	if err != nil {
+		log.Println("error encoding message delete: " + err.Error())
+		return
+	}
+	m.publish(Delivery{Topic: DirectTopic(message.Sender, message.Recipient), Type: EventMessageDelete, Data: data}, nil)
+}
+
+// ack tells the connection a message came from that it was stored. It's
+// sequenced on the sender's session, so it's replayed if the connection drops
+// before the ack is written.
+func (m *Manager) ack(from *Client, message models.Message) {
+	if from.session == nil {
+		return
+	}
+
+	data, err := json.Marshal(MessageAck{Nonce: message.Nonce, ID: message.ID, Timestamp: message.Timestamp})
+	if err != nil {
+		log.Println("error encoding ack: " + err.Error())
+		return
+	}
+	m.dispatch(from.session, EventMessageAck, data)
+}
+
+// routeRead records that a user read a DM and tells their other devices, and the
+// other side if the user sends read receipts.
+func (m *Manager) routeRead(from *Client, ack ReadAck) {
+	shared, err := m.ChatService.MarkRead(from.Id, ack.UserId, ack.MessageId)
+	if err != nil {
+		log.Println("error marking messages read: " + err.Error())
+		return
+	}
+
+	data, err := json.Marshal(MessageRead{UserId: from.Id, Recipient: ack.UserId, MessageId: ack.MessageId, ReadAt: time.Now()})
+	if err != nil {
+		log.Println("error encoding read: " + err.Error())
+		return
+	}
+
+	if shared {
+		m.dispatchToTopic(DirectTopic(from.Id, ack.UserId), from, EventMessageRead, data)
+	} else {
+		m.dispatchToUser(from.Id, from, EventMessageRead, data)
+	}
+}
+
+// dispatchToUser publishes an event for every session the user has, on any
+// instance, skipping the one the event came from.
+func (m *Manager) dispatchToUser(userId string, except *Client, eventType string, data json.RawMessage) {
+	m.publish(Delivery{UserId: userId, Type: eventType, Data: data}, except)
+}
+
+// dispatchToTopic publishes an event for every session subscribed to the topic,
+// on any instance, skipping the one the event came from.
+func (m *Manager) dispatchToTopic(topic string, except *Client, eventType string, data json.RawMessage) {
+	m.publish(Delivery{Topic: topic, Type: eventType, Data: data}, except)
+}
+
+// publish queues a delivery for the bus. Publishing happens on its own
+// goroutine, in order, so the Manager never waits on the bus.
+func (m *Manager) publish(delivery Delivery, except *Client) {
+	if except != nil && except.session != nil {
+		delivery.Except = except.session.ID
+	}
+
+	m.outbox.push(delivery)
+}
+
+// publishLoop hands queued deliveries to the bus until ctx is done, then
+// publishes whatever is left, like the messages stored while draining.
+func (m *Manager) publishLoop(ctx context.Context, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		select {
+		case <-m.outbox.notify:
+			m.publishQueued(ctx)
+		case <-ctx.Done():
+			m.publishQueued(context.Background())
+			return
+		}
+	}
+}
+
+func (m *Manager) publishQueued(ctx context.Context) {
+	for _, delivery := range m.outbox.drain() {
+		publishCtx, cancel := context.WithTimeout(ctx, publishTimeout)
+		if err := m.Bus.Publish(publishCtx, delivery); err != nil {
+			log.Println("error publishing event: " + err.Error())
+		}
+		cancel()
+	}
+}
+
+// dispatch sequences an event on a session and queues it for the session's
+// client, if it has one.
+func (m *Manager) dispatch(session *Session, eventType string, data json.RawMessage) {
+	frame, err := session.record(eventType, data)
+	if err != nil {
+		log.Println("error dispatching event: " + err.Error())
+		return
+	}
+
+	if session.client != nil {
+		m.enqueue(session.client, eventType, frame)
+	}
+}
+
+// deliver dispatches a delivery heard on the bus to this instance's sessions.
+// Detached sessions still buffer it for when they resume.
+func (m *Manager) deliver(delivery Delivery) {
+	if delivery.Instance != "" {
+		if delivery.Instance == m.instance {
+			m.handleCallCommand(delivery)
+		}
+		return
+	}
+
+	skipped := make(map[string]bool, len(delivery.ExceptUsers))
+	for _, userId := range delivery.ExceptUsers {
+		skipped[userId] = true
+	}
+
+	for session := range m.addressed(delivery) {
+		if delivery.Join != "" {
+			m.subscribe(session, delivery.Join)
+		}
+		if session.ID == delivery.Except || (delivery.Session != "" && session.ID != delivery.Session) {
+			continue
+		}
+		if skipped[session.UserId] {
+			continue
+		}
+		if !session.wants(delivery) {
+			continue
+		}
+		m.dispatch(session, delivery.Type, delivery.Data)
+	}
+}
+
+// addressed is every session on this instance a delivery is for, each once.
+func (m *Manager) addressed(delivery Delivery) map[*Session]bool {
+	if len(delivery.UserIds) == 0 && len(delivery.Topics) == 0 {
+		if delivery.Topic != "" {
+			return m.topics[delivery.Topic]
+		}
+		return m.Sessions[delivery.UserId]
+	}
+
+	sessions := make(map[*Session]bool)
+	for _, userId := range delivery.UserIds {
+		maps.Copy(sessions, m.Sessions[userId])
+	}
+	for _, topic := range delivery.Topics {
+		maps.Copy(sessions, m.topics[topic])
+	}
+	return sessions
+}
+
+func (m *Manager) updatePresence(from *Client, status models.Status) {
+	changed, err := m.Presence.SetStatus(from.Id, status)
+	if err != nil {
+		log.Println("error updating presence: " + err.Error())
+		return
+	}
+
+	// the user's own devices always see their real status, invisible included
+	current, err := m.Presence.Status(from.Id)
+	if err != nil {
+		log.Println("error getting presence: " + err.Error())
+		return
+	}
+	own, _ := json.Marshal(models.Presence{UserId: from.Id, Status: current})
+	m.dispatchToUser(from.Id, nil, EventPresenceUpdate, own)
+
+	if changed {
+		m.broadcastPresence(from.Id)
+	}
+}
+
+// broadcastPresence tells the user's friends and fellow server members what
+// their status looks like now. Sessions only hear about people they just share
+// a server with if they have IntentServerPresence.
+//
+// It's two deliveries however big the audience is: one for the friends, and one
+// for the user's servers that skips the friends, who already have it.
+func (m *Manager) broadcastPresence(userId string) {
+	friends, err := m.Presence.Friends(userId)
+	if err != nil {
+		log.Println("error getting friends: " + err.Error())
+		return
+	}
+	servers, err := m.Servers.GetMemberServers(userId)
+	if err != nil {
+		log.Println("error getting servers: " + err.Error())
+		return
+	}
+
+	visible, err := m.Presence.Visible(userId)
+	if err != nil {
+		log.Println("error getting presence: " + err.Error())
+		return
+	}
+	data, err := json.Marshal(models.Presence{UserId: userId, Status: visible})
+	if err != nil {
+		log.Println("error encoding presence: " + err.Error())
+		return
+	}
+
+	if len(friends) > 0 {
+		m.publish(Delivery{UserIds: friends, Type: EventPresenceUpdate, Data: data}, nil)
+	}
+	if len(servers) > 0 {
+		topics := make([]string, 0, len(servers))
+		for _, server := range servers {
+			topics = append(topics, ServerTopic(server))
+		}
+		m.publish(Delivery{
+			Topics:      topics,
+			ExceptUsers: append(friends, userId),
+			Intent:      IntentServerPresence,
+			Type:        EventPresenceUpdate,
+			Data:        data,
+		}, nil)
+	}
+}
+
+func (m *Manager) add(conn *Client) {
+	session, err := newSession(conn.Id, m.ReplayBufferSize)
+	if err != nil {
+		log.Println("error creating session: " + err.Error())
+		m.closeClient(conn)
+		return
+	}
+	session.Intents = conn.intents
+
+	sessions, ok := m.Sessions[conn.Id]
+	if !ok {
+		sessions = make(map[*Session]bool)
+		m.Sessions[conn.Id] = sessions
+	}
+	sessions[session] = true
+	m.sessions[session.ID] = session
+	if topics, err := m.topicsFor(conn.Id); err != nil {
+		log.Println("error getting topics: " + err.Error())
+	} else {
+		m.subscribe(session, topics...)
+	}
+	m.attach(session, conn)
+	m.Metrics.Connected.Add(1)
+
+	undelivered, counts, err := m.ChatService.GetUndelivered(conn.Id, readyMessageLimit)
+	if err != nil {
+		log.Println("error getting undelivered messages: " + err.Error())
+	}
+
+	ready, _ := json.Marshal(Ready{SessionId: session.ID, UserId: conn.Id, Undelivered: undelivered, UndeliveredCounts: counts})
+	m.dispatch(session, EventReady, ready)
+}
+
+func (m *Manager) resume(conn *Client, resume Resume) {
+	session, ok := m.sessions[resume.SessionId]
+	var frames [][]byte
+	if ok && session.UserId == conn.Id {
+		frames, ok = session.since(resume.Seq)
+	} else {
+		ok = false
+	}
+
+	if !ok {
+		// the client has to identify again and re-sync over REST
+		conn.identified.Store(false)
+		if frame, err := encodeEvent(OpInvalidSession, "", false); err == nil {
+			m.enqueue(conn, "", frame)
+		}
+		return
+	}
+
+	// the old connection may not have been reaped yet, but this one replaces it.
+	// Attach first so presence doesn't flap offline in between.
+	old := session.client
+	m.attach(session, conn)
+	if old != nil {
+		m.closeClient(old)
+	}
+	m.Metrics.Connected.Add(1)
+
+	for _, frame := range frames {
+		m.enqueue(conn, "", frame)
+	}
+	m.dispatch(session, EventResumed, nil)
+}
+
+func (m *Manager) attach(session *Session, conn *Client) {
+	session.client = conn
+	session.detachedAt = time.Time{}
+	conn.session = session
+	conn.attached = true
+
+	changed, err := m.Presence.Connect(conn.Id)
+	if err != nil {
+		log.Println("error recording connection: " + err.Error())
+	} else if changed {
+		m.broadcastPresence(conn.Id)
+	}
+}
+
+func (m *Manager) remove(conn *Client) {
+	m.closeClient(conn)
+}
+
+// closeClient closes a client's send channel, which makes its writer close the
+// socket, and detaches it from its session. It's safe to call more than once.
+func (m *Manager) closeClient(conn *Client) {
+	m.closeClientWithCode(conn, 0, "")
+}
+
+// closeClientWithCode is closeClient with a close code and reason for the
+// client's writer to send once it has flushed what's already queued.
+func (m *Manager) closeClientWithCode(conn *Client, code int, reason string) {
+	if conn.sendClosed {
+		return
+	}
+	conn.sendClosed = true
+	conn.closeCode = code
+	conn.closeReason = reason
+	close(conn.Send)
+
+	if session := conn.session; session != nil && session.client == conn {
+		session.client = nil
+		session.detachedAt = time.Now()
+		m.leaveCalls(session)
+	}
+
+	if conn.attached {
+		conn.attached = false
+		// while draining everyone is about to reconnect somewhere else, so
+		// don't tell their friends they went offline
+		changed, err := m.Presence.Disconnect(conn.Id)
+		if err != nil {
+			log.Println("error recording disconnection: " + err.Error())
+		} else if changed && !m.draining.Load() {
+			m.broadcastPresence(conn.Id)
+		}
+	}
+}
+
+// expire forgets sessions that have been detached for longer than ResumeTimeout.
+func (m *Manager) expire(now time.Time) {
+	for id, session := range m.sessions {
+		if session.client != nil || now.Sub(session.detachedAt) < m.ResumeTimeout {
+			continue
+		}
+
+		delete(m.sessions, id)
+		m.unsubscribe(session)
+		sessions := m.Sessions[session.UserId]
+		delete(sessions, session)
+		if len(sessions) == 0 {
+			delete(m.Sessions, session.UserId)
+		}
+	}
+}
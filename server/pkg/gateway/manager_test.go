@@ -0,0 +1,419 @@
+package gateway
+
+import (
+	"encoding/json"
+	"errors"
+	"ivar/pkg/auth"
+	"ivar/pkg/chat"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"ivar/pkg/presence"
+	"ivar/pkg/server"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func newTestClient(m *Manager, id string) *Client {
+	c := NewClient(id, nil, make(chan []byte, 8), m)
+	m.Register <- c
+	// drain READY
+	<-c.Send
+	return c
+}
+
+func expectFrame(t *testing.T, c *Client, name string) {
+	t.Helper()
+	select {
+	case <-c.Send:
+	case <-time.After(time.Second):
+		t.Errorf("%s should have received a frame", name)
+	}
+}
+
+func expectNoFrame(t *testing.T, c *Client, name string) {
+	t.Helper()
+	select {
+	case msg := <-c.Send:
+		t.Errorf("%s should not have received a frame, got: %s", name, msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func expectAck(t *testing.T, c *Client) MessageAck {
+	t.Helper()
+	select {
+	case frame := <-c.Send:
+		var event Event
+		_ = json.Unmarshal(frame, &event)
+		if event.Type != EventMessageAck {
+			t.Fatalf("expected MESSAGE_ACK, got: %s", frame)
+		}
+		var ack MessageAck
+		_ = json.Unmarshal(event.Data, &ack)
+		return ack
+	case <-time.After(time.Second):
+		t.Fatalf("sender should have received an ack")
+	}
+	return MessageAck{}
+}
+
+func TestManager_DirectMessage_FansOutToAllDevices(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	senderLaptop := newTestClient(m, "sender")
+	senderPhone := newTestClient(m, "sender")
+	recipientLaptop := newTestClient(m, "recipient")
+	recipientPhone := newTestClient(m, "recipient")
+	bystander := newTestClient(m, "bystander")
+
+	m.Broadcast <- Inbound{From: senderLaptop, Type: EventMessageCreate, Payload: &models.Message{Sender: "sender", Recipient: "recipient", Content: "hi"}}
+
+	expectFrame(t, recipientLaptop, "recipient laptop")
+	expectFrame(t, recipientPhone, "recipient phone")
+	expectFrame(t, senderPhone, "sender phone")
+	expectAck(t, senderLaptop)
+	expectNoFrame(t, senderLaptop, "sender laptop")
+	expectNoFrame(t, bystander, "bystander")
+
+	store.AssertCalled(t, "StoreMessage", models.Message{Sender: "sender", Recipient: "recipient", Content: "hi"})
+}
+
+func TestManager_Unregister_RemovesOnlyThatDevice(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	sender := newTestClient(m, "sender")
+	laptop := newTestClient(m, "recipient")
+	phone := newTestClient(m, "recipient")
+
+	m.Unregister <- laptop
+
+	m.Broadcast <- Inbound{From: sender, Type: EventMessageCreate, Payload: &models.Message{Sender: "sender", Recipient: "recipient", Content: "hi"}}
+
+	expectFrame(t, phone, "recipient phone")
+	if _, ok := <-laptop.Send; ok {
+		t.Errorf("unregistered device should have its send channel closed")
+	}
+}
+
+func TestManager_DirectMessage_AckedWithNonce(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	sender := newTestClient(m, "sender")
+	newTestClient(m, "recipient")
+
+	m.Broadcast <- Inbound{From: sender, Type: EventMessageCreate, Payload: &models.Message{Sender: "sender", Recipient: "recipient", Content: "hi", Nonce: "nonce1"}}
+
+	ack := expectAck(t, sender)
+	if ack.Nonce != "nonce1" || ack.ID != 1 || ack.Timestamp.IsZero() {
+		t.Errorf("ack should carry the nonce, id and timestamp, got: %+v", ack)
+	}
+}
+
+func TestManager_DirectMessage_RetryNotRedelivered(t *testing.T) {
+	store := newTestStore()
+	stored := models.Message{ID: 1, Sender: "sender", Recipient: "recipient", Content: "hi", Nonce: "nonce1"}
+	store.On("StoreMessage", mock.Anything).Return(stored, true, nil).Once()
+	store.On("StoreMessage", mock.Anything).Return(stored, false, nil).Once()
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	sender := newTestClient(m, "sender")
+	recipient := newTestClient(m, "recipient")
+
+	for i := 0; i < 2; i++ {
+		m.Broadcast <- Inbound{From: sender, Type: EventMessageCreate, Payload: &models.Message{Sender: "sender", Recipient: "recipient", Content: "hi", Nonce: "nonce1"}}
+		if ack := expectAck(t, sender); ack.ID != 1 {
+			t.Errorf("every attempt should be acked with the stored id, got: %+v", ack)
+		}
+	}
+
+	expectFrame(t, recipient, "recipient")
+	expectNoFrame(t, recipient, "recipient")
+}
+
+func TestManager_DirectMessage_StoreFailure(t *testing.T) {
+	store := newTestStore()
+	store.On("StoreMessage", mock.Anything).Return(models.Message{}, false, errors.New("failed"))
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	sender := newTestClient(m, "sender")
+	recipient := newTestClient(m, "recipient")
+
+	m.Broadcast <- Inbound{From: sender, Type: EventMessageCreate, Payload: &models.Message{Sender: "sender", Recipient: "recipient", Content: "hi", Nonce: "nonce1"}}
+
+	select {
+	case frame := <-sender.control:
+		var event Event
+		_ = json.Unmarshal(frame, &event)
+		var e Error
+		_ = json.Unmarshal(event.Data, &e)
+		if event.Op != OpError || e.Code != ErrorMessageNotStored || e.Nonce != "nonce1" {
+			t.Errorf("expected an error for nonce1, got: %s", frame)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("sender should have received an error")
+	}
+	expectNoFrame(t, recipient, "recipient")
+}
+
+func TestManager_DirectMessage_ReplyPreviewed(t *testing.T) {
+	store := newTestStore()
+	store.On("GetMessagePreview", []string{"sender", "recipient"}, int64(1)).Return(models.MessagePreview{ID: 1, Sender: "recipient", Snippet: "lunch?"}, nil)
+	storeMessages(store)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	sender := newTestClient(m, "sender")
+	recipient := newTestClient(m, "recipient")
+
+	replyTo := int64(1)
+	m.Broadcast <- Inbound{From: sender, Type: EventMessageCreate, Payload: &models.Message{Sender: "sender", Recipient: "recipient", Content: "sure", ReplyTo: &replyTo}}
+
+	event := expectEvent(t, recipient, "recipient", EventMessageCreate)
+	var message models.Message
+	_ = json.Unmarshal(event.Data, &message)
+	if message.Reply == nil || message.Reply.Snippet != "lunch?" {
+		t.Errorf("reply should carry a preview, got: %+v", message.Reply)
+	}
+	if len(message.Mentions) != 1 || message.Mentions[0] != "recipient" {
+		t.Errorf("reply should mention the recipient, got: %v", message.Mentions)
+	}
+}
+
+func TestManager_DirectMessage_InvalidReply(t *testing.T) {
+	store := newTestStore()
+	store.On("GetMessagePreview", []string{"sender", "recipient"}, int64(9)).Return(models.MessagePreview{}, database.ErrNotFound)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	sender := newTestClient(m, "sender")
+	recipient := newTestClient(m, "recipient")
+
+	replyTo := int64(9)
+	m.Broadcast <- Inbound{From: sender, Type: EventMessageCreate, Payload: &models.Message{Sender: "sender", Recipient: "recipient", Content: "hi", Nonce: "nonce1", ReplyTo: &replyTo}}
+
+	select {
+	case frame := <-sender.control:
+		var event Event
+		_ = json.Unmarshal(frame, &event)
+		var e Error
+		_ = json.Unmarshal(event.Data, &e)
+		if event.Op != OpError || e.Code != ErrorInvalidReply || e.Nonce != "nonce1" {
+			t.Errorf("expected an invalid reply error for nonce1, got: %s", frame)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("sender should have received an error")
+	}
+	expectNoFrame(t, recipient, "recipient")
+}
+
+func TestManager_ReadAck_ToldToSender(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+	store.On("MarkRead", "recipient", "sender", int64(1)).Return(nil)
+	store.On("GetPrivacySettings", "recipient").Return(models.PrivacySettings{ReadReceipts: true}, nil)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	sender := newTestClient(m, "sender")
+	recipientLaptop := newTestClient(m, "recipient")
+	recipientPhone := newTestClient(m, "recipient")
+	bystander := newTestClient(m, "bystander")
+
+	// the first message puts everyone in the conversation's topic
+	m.Broadcast <- Inbound{From: sender, Type: EventMessageCreate, Payload: &models.Message{Sender: "sender", Recipient: "recipient", Content: "hi"}}
+	expectAck(t, sender)
+	expectFrame(t, recipientLaptop, "recipient laptop")
+	expectFrame(t, recipientPhone, "recipient phone")
+
+	m.Broadcast <- Inbound{From: recipientLaptop, Payload: &ReadAck{UserId: "sender", MessageId: 1}}
+
+	expectFrame(t, sender, "sender")
+	expectFrame(t, recipientPhone, "recipient phone")
+	expectNoFrame(t, recipientLaptop, "recipient laptop")
+	expectNoFrame(t, bystander, "bystander")
+}
+
+func TestManager_ReadAck_ReceiptsOff(t *testing.T) {
+	store := newTestStore()
+	store.On("MarkRead", "recipient", "sender", int64(3)).Return(nil)
+	store.On("GetPrivacySettings", "recipient").Return(models.PrivacySettings{ReadReceipts: false}, nil)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	sender := newTestClient(m, "sender")
+	recipientLaptop := newTestClient(m, "recipient")
+	recipientPhone := newTestClient(m, "recipient")
+
+	m.Broadcast <- Inbound{From: recipientLaptop, Payload: &ReadAck{UserId: "sender", MessageId: 3}}
+
+	expectFrame(t, recipientPhone, "recipient phone")
+	expectNoFrame(t, sender, "sender")
+}
+
+// conversationStore is a mock store where alice and bob have a DM going, so both
+// are subscribed to its topic when they connect.
+func conversationStore() *database.MockStore {
+	store := new(database.MockStore)
+	store.On("GetFriends", mock.Anything).Return([]models.User{}, nil).Maybe()
+	nothingUndelivered(store)
+	store.On("GetMemberServers", mock.Anything).Return([]string{}, nil).Maybe()
+	store.On("AllChats", "alice").Return([]models.User{{ID: "bob"}}, nil).Maybe()
+	store.On("AllChats", "bob").Return([]models.User{{ID: "alice"}}, nil).Maybe()
+	store.On("AllChats", mock.Anything).Return([]models.User{}, nil).Maybe()
+	return store
+}
+
+func expectEvent(t *testing.T, c *Client, name, eventType string) Event {
+	t.Helper()
+	select {
+	case frame := <-c.Send:
+		var event Event
+		_ = json.Unmarshal(frame, &event)
+		if event.Type != eventType {
+			t.Fatalf("%s expected %s, got: %s", name, eventType, frame)
+		}
+		return event
+	case <-time.After(time.Second):
+		t.Fatalf("%s should have received %s", name, eventType)
+	}
+	return Event{}
+}
+
+func TestManager_EditMessage_ToldToBothSides(t *testing.T) {
+	store := conversationStore()
+	editedAt := time.Now()
+	store.On("EditMessage", "alice", int64(7), "edited").Return(models.Message{ID: 7, Sender: "alice", Recipient: "bob", Content: "edited", EditedAt: &editedAt}, nil)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	aliceLaptop := newTestClient(m, "alice")
+	alicePhone := newTestClient(m, "alice")
+	bob := newTestClient(m, "bob")
+	bystander := newTestClient(m, "bystander")
+
+	m.Broadcast <- Inbound{From: aliceLaptop, Type: EventMessageUpdate, Payload: &models.Message{ID: 7, Content: "edited"}}
+
+	event := expectEvent(t, bob, "bob", EventMessageUpdate)
+	var message models.Message
+	_ = json.Unmarshal(event.Data, &message)
+	if message.Content != "edited" || message.EditedAt == nil {
+		t.Errorf("bob should get the edited message, got: %+v", message)
+	}
+	// the device it was edited on is told too, so it knows the edit stuck
+	expectEvent(t, aliceLaptop, "alice laptop", EventMessageUpdate)
+	expectEvent(t, alicePhone, "alice phone", EventMessageUpdate)
+	expectNoFrame(t, bystander, "bystander")
+}
+
+func TestManager_DeleteMessage_ToldToBothSides(t *testing.T) {
+	store := conversationStore()
+	store.On("DeleteMessage", "alice", int64(7)).Return(models.Message{ID: 7, Sender: "alice", Recipient: "bob", Deleted: true}, nil)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	alice := newTestClient(m, "alice")
+	bob := newTestClient(m, "bob")
+
+	m.Broadcast <- Inbound{From: alice, Type: EventMessageDelete, Payload: &MessageDelete{ID: 7}}
+
+	event := expectEvent(t, bob, "bob", EventMessageDelete)
+	var deleted MessageDelete
+	_ = json.Unmarshal(event.Data, &deleted)
+	if deleted.ID != 7 || deleted.Sender != "alice" || deleted.Recipient != "bob" {
+		t.Errorf("bob should be told which message went, got: %+v", deleted)
+	}
+	expectEvent(t, alice, "alice", EventMessageDelete)
+}
+
+func TestManager_EditMessage_NotOwn(t *testing.T) {
+	store := conversationStore()
+	store.On("EditMessage", "bob", int64(7), "edited").Return(models.Message{}, database.ErrNotFound)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	alice := newTestClient(m, "alice")
+	bob := newTestClient(m, "bob")
+
+	m.Broadcast <- Inbound{From: bob, Type: EventMessageUpdate, Payload: &models.Message{ID: 7, Content: "edited"}}
+
+	select {
+	case frame := <-bob.control:
+		var event Event
+		_ = json.Unmarshal(frame, &event)
+		var e Error
+		_ = json.Unmarshal(event.Data, &e)
+		if event.Op != OpError || e.Code != ErrorMessageNotChanged {
+			t.Errorf("bob should get an error, got: %s", frame)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("bob should get an error")
+	}
+	expectNoFrame(t, alice, "alice")
+}
+
+func TestManager_AddReaction_ToldToBothSides(t *testing.T) {
+	store := conversationStore()
+	change := models.ReactionChange{MessageId: 7, UserId: "bob", Emoji: "👍"}
+	store.On("AddReaction", change).Return(models.ReactionChange{MessageId: 7, UserId: "bob", Emoji: "👍", Sender: "alice", Recipient: "bob"}, true, nil)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	alice := newTestClient(m, "alice")
+	bob := newTestClient(m, "bob")
+	bystander := newTestClient(m, "bystander")
+
+	m.Broadcast <- Inbound{From: bob, Type: EventReactionAdd, Payload: &models.ReactionChange{MessageId: 7, UserId: "bob", Emoji: "👍"}}
+
+	event := expectEvent(t, alice, "alice", EventReactionAdd)
+	var added models.ReactionChange
+	_ = json.Unmarshal(event.Data, &added)
+	if added.MessageId != 7 || added.UserId != "bob" || added.Emoji != "👍" {
+		t.Errorf("alice should be told who reacted with what, got: %+v", added)
+	}
+	expectEvent(t, bob, "bob", EventReactionAdd)
+	expectNoFrame(t, bystander, "bystander")
+}
+
+func TestManager_AddReaction_Unchanged(t *testing.T) {
+	store := conversationStore()
+	change := models.ReactionChange{MessageId: 7, UserId: "bob", Emoji: "👍"}
+	store.On("AddReaction", change).Return(models.ReactionChange{MessageId: 7, UserId: "bob", Emoji: "👍", Sender: "alice", Recipient: "bob"}, false, nil)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	alice := newTestClient(m, "alice")
+	bob := newTestClient(m, "bob")
+
+	m.Broadcast <- Inbound{From: bob, Type: EventReactionAdd, Payload: &change}
+
+	// reacting twice with the same emoji isn't news
+	expectNoFrame(t, alice, "alice")
+	expectNoFrame(t, bob, "bob")
+}
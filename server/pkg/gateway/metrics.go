@@ -0,0 +1,35 @@
+package gateway
+
+import (
+	"net/http"
+	"sync/atomic"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Metrics are process-wide gateway counters and gauges. The counters are only
+// ever incremented, so scrapers can compute rates from them.
+type Metrics struct {
+	Connected     atomic.Int64
+	Reaped        atomic.Int64
+	Dropped       atomic.Int64
+	SlowConsumers atomic.Int64
+	RateLimited   atomic.Int64
+
+	// QueuedFrames and DeepestQueue are gauges over every client's send queue,
+	// refreshed by the Manager every metricsInterval.
+	QueuedFrames atomic.Int64
+	DeepestQueue atomic.Int64
+}
+
+func (m *Manager) HandleMetrics(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, gin.H{"data": gin.H{
+		"connected":     m.Metrics.Connected.Load(),
+		"reaped":        m.Metrics.Reaped.Load(),
+		"dropped":       m.Metrics.Dropped.Load(),
+		"slowConsumers": m.Metrics.SlowConsumers.Load(),
+		"rateLimited":   m.Metrics.RateLimited.Load(),
+		"queuedFrames":  m.Metrics.QueuedFrames.Load(),
+		"deepestQueue":  m.Metrics.DeepestQueue.Load(),
+	}})
+}
@@ -0,0 +1,156 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// maxNotifyPayload is just under Postgres' 8000 byte limit on NOTIFY payloads.
+	maxNotifyPayload = 7999
+	// spillRetention is how long a delivery too large to notify is kept for
+	// instances to load. It only has to outlast the notification.
+	spillRetention = time.Minute
+)
+
+// notification is what's sent over NOTIFY: the delivery itself or, when that's
+// too large, the id of the gateway_deliveries row holding it.
+type notification struct {
+	Ref int64 `json:"ref,omitempty"`
+	Delivery
+}
+
+// PostgresBus is a Bus over LISTEN/NOTIFY, so every instance talking to the same
+// database hears every delivery. Deliveries published while an instance's
+// listener is reconnecting are lost to it; clients on that instance recover the
+// same way they do from any other gap, by re-syncing over REST.
+//
+// Deliveries too large for a notification, like a message full of escaped
+// characters or attachments, are stored and notified by reference instead.
+type PostgresBus struct {
+	db      *pgxpool.Pool
+	channel string
+}
+
+func NewPostgresBus(db *pgxpool.Pool, channel string) *PostgresBus {
+	return &PostgresBus{
+		db:      db,
+		channel: channel,
+	}
+}
+
+func (b *PostgresBus) Publish(ctx context.Context, delivery Delivery) error {
+	payload, err := json.Marshal(delivery)
+	if err != nil {
+		return err
+	}
+	if len(payload) <= maxNotifyPayload {
+		_, err = b.db.Exec(ctx, "select pg_notify($1, $2)", b.channel, string(payload))
+		return err
+	}
+
+	// expired rows are cleared out as new ones are spilled
+	_, err = b.db.Exec(ctx, `
+		with expired as (
+			delete from gateway_deliveries where created_at < now() - make_interval(secs => $3)
+		), spilled as (
+			insert into gateway_deliveries (payload) values ($2) returning id
+		)
+		select pg_notify($1, json_build_object('ref', id)::text) from spilled`,
+		b.channel, string(payload), spillRetention.Seconds())
+	return err
+}
+
+func (b *PostgresBus) Subscribe(ctx context.Context, handler func(Delivery)) error {
+	conn, err := b.listen(ctx)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for {
+			err := b.receive(ctx, conn, handler)
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("lost gateway bus listener: " + err.Error())
+
+			for {
+				time.Sleep(time.Second)
+				if ctx.Err() != nil {
+					return
+				}
+				if conn, err = b.listen(ctx); err == nil {
+					break
+				}
+				log.Println("unable to listen on gateway bus: " + err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (b *PostgresBus) listen(ctx context.Context) (*pgxpool.Conn, error) {
+	conn, err := b.db.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Exec(ctx, "listen "+pgx.Identifier{b.channel}.Sanitize()); err != nil {
+		conn.Release()
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+// receive hands notifications to handler until the connection fails. It owns
+// conn and takes it out of the pool for good, since it's still listening.
+func (b *PostgresBus) receive(ctx context.Context, conn *pgxpool.Conn, handler func(Delivery)) error {
+	defer func() {
+		_ = conn.Hijack().Close(context.Background())
+	}()
+
+	for {
+		received, err := conn.Conn().WaitForNotification(ctx)
+		if err != nil {
+			return err
+		}
+
+		delivery, err := b.decode(ctx, received.Payload)
+		if err != nil {
+			log.Println("error decoding delivery: " + err.Error())
+			continue
+		}
+		handler(delivery)
+	}
+}
+
+// decode reads a notification's delivery, loading it if it was spilled.
+func (b *PostgresBus) decode(ctx context.Context, payload string) (Delivery, error) {
+	var n notification
+	if err := json.Unmarshal([]byte(payload), &n); err != nil {
+		return Delivery{}, err
+	}
+	if n.Ref == 0 {
+		return n.Delivery, nil
+	}
+
+	// the listening connection is busy waiting, so the spilled delivery comes
+	// from the pool
+	var spilled string
+	if err := b.db.QueryRow(ctx, "select payload from gateway_deliveries where id = $1", n.Ref).Scan(&spilled); err != nil {
+		return Delivery{}, err
+	}
+	var delivery Delivery
+	if err := json.Unmarshal([]byte(spilled), &delivery); err != nil {
+		return Delivery{}, err
+	}
+	return delivery, nil
+}
@@ -0,0 +1,82 @@
+package gateway
+
+import (
+	"encoding/json"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func friendsStore() *database.MockStore {
+	store := new(database.MockStore)
+	store.On("GetFriends", "alice").Return([]models.User{{ID: "bob"}}, nil)
+	store.On("GetFriends", "bob").Return([]models.User{{ID: "alice"}}, nil)
+	nothingUndelivered(store)
+	noMemberships(store)
+	return store
+}
+
+func readPresence(t *testing.T, conn *websocket.Conn) models.Presence {
+	t.Helper()
+	event := readEvent(t, conn)
+	if event.Type != EventPresenceUpdate {
+		t.Fatalf("expected presence update, got: %+v", event)
+	}
+	var presence models.Presence
+	_ = json.Unmarshal(event.Data, &presence)
+	return presence
+}
+
+func TestPresence_PushedToFriends(t *testing.T) {
+	_, url := newTestServer(t, friendsStore())
+
+	bob := dial(t, url, "bob")
+	alice := dial(t, url, "alice")
+
+	if p := readPresence(t, bob); p.UserId != "alice" || p.Status != models.StatusOnline {
+		t.Errorf("bob should see alice online, got: %+v", p)
+	}
+
+	event, _ := NewEvent(OpPresenceUpdate, "", PresenceUpdate{Status: models.StatusDoNotDisturb})
+	_ = alice.WriteJSON(event)
+
+	if p := readPresence(t, alice); p.Status != models.StatusDoNotDisturb {
+		t.Errorf("alice should see herself as dnd, got: %+v", p)
+	}
+	if p := readPresence(t, bob); p.Status != models.StatusDoNotDisturb {
+		t.Errorf("bob should see alice as dnd, got: %+v", p)
+	}
+
+	_ = alice.Close()
+	if p := readPresence(t, bob); p.UserId != "alice" || p.Status != models.StatusOffline {
+		t.Errorf("bob should see alice offline, got: %+v", p)
+	}
+}
+
+func TestPresence_InvisibleLooksOffline(t *testing.T) {
+	_, url := newTestServer(t, friendsStore())
+
+	bob := dial(t, url, "bob")
+	alice := dial(t, url, "alice")
+	readPresence(t, bob)
+
+	event, _ := NewEvent(OpPresenceUpdate, "", PresenceUpdate{Status: models.StatusInvisible})
+	_ = alice.WriteJSON(event)
+
+	if p := readPresence(t, alice); p.Status != models.StatusInvisible {
+		t.Errorf("alice should see herself as invisible, got: %+v", p)
+	}
+	if p := readPresence(t, bob); p.Status != models.StatusOffline {
+		t.Errorf("bob should see alice offline, got: %+v", p)
+	}
+
+	// closing an invisible connection changes nothing anyone else can see
+	_ = alice.Close()
+	_ = bob.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, msg, err := bob.ReadMessage(); err == nil {
+		t.Errorf("bob should not hear anything, got: %s", msg)
+	}
+}
@@ -0,0 +1,79 @@
+package gateway
+
+import "time"
+
+// SlowConsumerPolicy says what to do with a client whose send queue is full,
+// which happens when it reads slower than events arrive for it. Whatever the
+// policy, ephemeral events like typing are simply dropped first: they'd be stale
+// by the time they were written anyway.
+type SlowConsumerPolicy int
+
+const (
+	// DisconnectSlowConsumers closes the connection with CloseSlowConsumer once
+	// it has written what's already queued. The session stays resumable, so the
+	// client can reconnect and replay what it missed from the session buffer.
+	DisconnectSlowConsumers SlowConsumerPolicy = iota
+	// DropOldest throws away the oldest queued frame to make room. The client
+	// sees a gap in sequence numbers and should re-sync over REST.
+	DropOldest
+)
+
+// ephemeralEvents are never worth disconnecting a client over.
+var ephemeralEvents = map[string]bool{
+	EventTypingStart: true,
+}
+
+const metricsInterval = time.Second
+
+// enqueue queues a frame for a client without ever blocking the Manager.
+func (m *Manager) enqueue(conn *Client, eventType string, frame []byte) {
+	if conn.sendClosed {
+		return
+	}
+
+	select {
+	case conn.Send <- frame:
+		return
+	default:
+	}
+
+	if ephemeralEvents[eventType] {
+		m.Metrics.Dropped.Add(1)
+		return
+	}
+
+	switch m.SlowConsumerPolicy {
+	case DropOldest:
+		select {
+		case <-conn.Send:
+			m.Metrics.Dropped.Add(1)
+		default:
+		}
+		select {
+		case conn.Send <- frame:
+		default:
+			m.Metrics.Dropped.Add(1)
+		}
+	default:
+		m.Metrics.SlowConsumers.Add(1)
+		m.closeClientWithCode(conn, CloseSlowConsumer, "send queue full")
+	}
+}
+
+// measureQueues updates the queue depth gauges from every attached client.
+func (m *Manager) measureQueues() {
+	var total, deepest int64
+	for _, sessions := range m.Sessions {
+		for session := range sessions {
+			if session.client == nil || session.client.sendClosed {
+				continue
+			}
+			depth := int64(len(session.client.Send))
+			total += depth
+			deepest = max(deepest, depth)
+		}
+	}
+
+	m.Metrics.QueuedFrames.Store(total)
+	m.Metrics.DeepestQueue.Store(deepest)
+}
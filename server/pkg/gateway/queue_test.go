@@ -0,0 +1,119 @@
+package gateway
+
+import (
+	"encoding/json"
+	"ivar/pkg/auth"
+	"ivar/pkg/chat"
+	"ivar/pkg/models"
+	"ivar/pkg/presence"
+	"ivar/pkg/server"
+	"testing"
+	"time"
+)
+
+func newQueueTestManager(t *testing.T, policy SlowConsumerPolicy) *Manager {
+	t.Helper()
+	store := newTestStore()
+	storeMessages(store)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	m.SlowConsumerPolicy = policy
+	m.TypingInterval = 0
+	go m.Start()
+	return m
+}
+
+// newTestSender is newTestClient with room in its queue for the ack to every
+// message it sends.
+func newTestSender(m *Manager, id string) *Client {
+	c := NewClient(id, nil, make(chan []byte, 64), m)
+	m.Register <- c
+	// drain READY
+	<-c.Send
+	return c
+}
+
+func overflow(m *Manager, from *Client, recipient string, eventType string, n int) {
+	for i := 0; i < n; i++ {
+		var payload any = &models.Message{Sender: from.Id, Recipient: recipient, Content: string(rune('a' + i))}
+		if eventType == EventTypingStart {
+			payload = &TypingStart{UserId: from.Id, Recipient: recipient}
+		}
+		m.Broadcast <- Inbound{From: from, Type: eventType, Payload: payload}
+	}
+	// let the deliveries drain through the bus
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestQueue_SlowConsumer_Disconnected(t *testing.T) {
+	m := newQueueTestManager(t, DisconnectSlowConsumers)
+	sender := newTestSender(m, "sender")
+	slow := newTestClient(m, "slow")
+
+	overflow(m, sender, "slow", EventMessageCreate, cap(slow.Send)+1)
+
+	received := 0
+	for range slow.Send {
+		received++
+	}
+	if received != cap(slow.Send) {
+		t.Errorf("queued frames should still be flushed, got %d", received)
+	}
+	if slow.closeCode != CloseSlowConsumer {
+		t.Errorf("close code should be %d, got: %d", CloseSlowConsumer, slow.closeCode)
+	}
+	if m.Metrics.SlowConsumers.Load() != 1 {
+		t.Errorf("slow consumers should be 1, got: %d", m.Metrics.SlowConsumers.Load())
+	}
+}
+
+func TestQueue_SlowConsumer_DropOldest(t *testing.T) {
+	m := newQueueTestManager(t, DropOldest)
+	sender := newTestSender(m, "sender")
+	slow := newTestClient(m, "slow")
+
+	overflow(m, sender, "slow", EventMessageCreate, cap(slow.Send)+2)
+
+	var first Event
+	_ = json.Unmarshal(<-slow.Send, &first)
+	var message models.Message
+	_ = json.Unmarshal(first.Data, &message)
+	if message.Content != "c" {
+		t.Errorf("the two oldest frames should have been dropped, got: %q", message.Content)
+	}
+	if m.Metrics.Dropped.Load() != 2 {
+		t.Errorf("dropped should be 2, got: %d", m.Metrics.Dropped.Load())
+	}
+}
+
+func TestQueue_SlowConsumer_EphemeralDropped(t *testing.T) {
+	m := newQueueTestManager(t, DisconnectSlowConsumers)
+	sender := newTestSender(m, "sender")
+	slow := newTestClient(m, "slow")
+
+	overflow(m, sender, "slow", EventTypingStart, cap(slow.Send)+3)
+
+	if m.Metrics.SlowConsumers.Load() != 0 {
+		t.Errorf("typing should never disconnect a client")
+	}
+	if m.Metrics.Dropped.Load() != 3 {
+		t.Errorf("dropped should be 3, got: %d", m.Metrics.Dropped.Load())
+	}
+}
+
+func TestQueue_DepthMeasured(t *testing.T) {
+	m := newQueueTestManager(t, DisconnectSlowConsumers)
+	sender := newTestSender(m, "sender")
+	newTestClient(m, "slow")
+
+	overflow(m, sender, "slow", EventMessageCreate, 3)
+
+	// three messages for the recipient and three acks for the sender
+	deadline := time.Now().Add(2 * metricsInterval)
+	for m.Metrics.QueuedFrames.Load() != 6 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if m.Metrics.QueuedFrames.Load() != 6 || m.Metrics.DeepestQueue.Load() != 3 {
+		t.Errorf("expected 6 queued frames, 3 deep, got: %d total, %d deepest", m.Metrics.QueuedFrames.Load(), m.Metrics.DeepestQueue.Load())
+	}
+}
@@ -0,0 +1,109 @@
+package gateway
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket: Burst frames at once, refilling at Rate a second.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token if there is one. Otherwise it reports how long until
+// there will be.
+func (b *bucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	if b.last.IsZero() {
+		b.tokens = float64(limit.Burst)
+	} else {
+		b.tokens = min(float64(limit.Burst), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	}
+	b.last = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// full reports whether the bucket would have refilled completely by now, so
+// forgetting it changes nothing.
+func (b *bucket) full(limit RateLimit, now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*limit.Rate >= float64(limit.Burst)
+}
+
+// userLimiter holds a bucket per user, shared by all of that user's connections
+// to this instance.
+type userLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*bucket
+}
+
+func newUserLimiter() *userLimiter {
+	return &userLimiter{buckets: make(map[string]*bucket)}
+}
+
+func (l *userLimiter) take(userId string, limit RateLimit, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[userId]
+	if !ok {
+		b = &bucket{}
+		l.buckets[userId] = b
+	}
+	return b.take(limit, now)
+}
+
+// expire forgets buckets that have refilled.
+func (l *userLimiter) expire(limit RateLimit, now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for userId, b := range l.buckets {
+		if b.full(limit, now) {
+			delete(l.buckets, userId)
+		}
+	}
+}
+
+// allow checks an inbound frame against the connection's and the user's limits.
+// Going over sends the client an error; going over too often in a row returns
+// ErrRateLimited, and the connection should be closed.
+func (c *Client) allow(now time.Time) (bool, error) {
+	ok, retryAfter := c.limit.take(c.manager.ConnectionLimit, now)
+	if ok {
+		ok, retryAfter = c.manager.limiter.take(c.Id, c.manager.UserLimit, now)
+	}
+	if ok {
+		return true, nil
+	}
+
+	if now.Sub(c.lastStrike) > strikeWindow {
+		c.strikes = 0
+	}
+	c.strikes++
+	c.lastStrike = now
+	c.manager.Metrics.RateLimited.Add(1)
+
+	if c.strikes > maxStrikes {
+		return false, ErrRateLimited
+	}
+
+	c.sendError(Error{Code: ErrorRateLimited, Message: ErrRateLimited.Error(), RetryAfter: retryAfter.Milliseconds()})
+	return false, nil
+}
+
+const (
+	// maxStrikes is how many frames over the limit a client can send within
+	// strikeWindow of each other before we hang up on it.
+	maxStrikes   = 5
+	strikeWindow = 10 * time.Second
+)
@@ -0,0 +1,90 @@
+package gateway
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestBucket_Take(t *testing.T) {
+	limit := RateLimit{Rate: 1, Burst: 2}
+	now := time.Now()
+	var b bucket
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := b.take(limit, now); !ok {
+			t.Errorf("burst should allow frame %d", i+1)
+		}
+	}
+	ok, retryAfter := b.take(limit, now)
+	if ok {
+		t.Errorf("third frame should be limited")
+	}
+	if retryAfter != time.Second {
+		t.Errorf("retry after should be 1s, got: %v", retryAfter)
+	}
+	if ok, _ := b.take(limit, now.Add(time.Second)); !ok {
+		t.Errorf("a second later there should be a token again")
+	}
+}
+
+func TestRateLimit_ErrorThenClose(t *testing.T) {
+	_, url := newTestServer(t, newTestStore(), func(m *Manager) {
+		m.ConnectionLimit = RateLimit{Rate: 0.01, Burst: 1}
+	})
+
+	conn := dial(t, url, "userId1")
+	presence, _ := NewEvent(OpPresenceUpdate, "", PresenceUpdate{Status: "online"})
+
+	// the identify spent the only token
+	_ = conn.WriteJSON(presence)
+	event := readEvent(t, conn)
+	var e Error
+	_ = json.Unmarshal(event.Data, &e)
+	if event.Op != OpError || e.Code != ErrorRateLimited || e.RetryAfter <= 0 {
+		t.Fatalf("expected rate limit error, got: %+v", event)
+	}
+
+	for i := 0; i < maxStrikes; i++ {
+		_ = conn.WriteJSON(presence)
+	}
+	for {
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, _, err := conn.ReadMessage(); err != nil {
+			if !websocket.IsCloseError(err, CloseRateLimited) {
+				t.Errorf("expected close code %d, got: %v", CloseRateLimited, err)
+			}
+			break
+		}
+	}
+}
+
+func TestRateLimit_SharedAcrossUsersConnections(t *testing.T) {
+	_, url := newTestServer(t, newTestStore(), func(m *Manager) {
+		m.UserLimit = RateLimit{Rate: 0.01, Burst: 2}
+	})
+
+	dial(t, url, "userId1")
+	second := dial(t, url, "userId1")
+
+	presence, _ := NewEvent(OpPresenceUpdate, "", PresenceUpdate{Status: "online"})
+	_ = second.WriteJSON(presence)
+
+	if event := readEvent(t, second); event.Op != OpError {
+		t.Errorf("two identifies should have used up the user's tokens, got: %+v", event)
+	}
+}
+
+func TestReadLimit_OversizedFrameClosed(t *testing.T) {
+	_, url := newTestServer(t, newTestStore(), func(m *Manager) {
+		m.MaxFrameSize = 64
+	})
+
+	conn := dial(t, url, "userId1")
+	_ = conn.WriteMessage(websocket.TextMessage, []byte(`{"op":0,"t":"MESSAGE_CREATE","d":{"content":"`+strings.Repeat("a", 100)+`"}}`))
+
+	expectCloseCode(t, conn, websocket.CloseMessageTooBig)
+}
@@ -0,0 +1,101 @@
+package gateway
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+)
+
+type bufferedEvent struct {
+	seq   int64
+	frame []byte
+}
+
+// Session outlives the connection it was identified on. Every dispatch to the
+// session gets the next sequence number and is kept in a bounded replay buffer,
+// so a client that drops can resume on a new connection without missing events.
+//
+// Sessions are owned by the Manager goroutine and must only be touched from it.
+type Session struct {
+	ID     string
+	UserId string
+	// Intents are the event categories the session identified with. They're
+	// kept for the life of the session, resumes included.
+	Intents Intents
+
+	client     *Client
+	seq        int64
+	buffer     []bufferedEvent
+	bufferSize int
+	detachedAt time.Time
+	topics     map[string]bool
+	// calls are the ids of the calls the session started or answered, to
+	// leave if it drops
+	calls map[string]bool
+}
+
+func newSession(userId string, bufferSize int) (*Session, error) {
+	id, err := randomId()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Session{
+		ID:         id,
+		UserId:     userId,
+		bufferSize: bufferSize,
+		topics:     make(map[string]bool),
+		calls:      make(map[string]bool),
+	}, nil
+}
+
+func randomId() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// record sequences an event and keeps it in the replay buffer, returning the
+// frame to send to the attached client, if any.
+func (s *Session) record(eventType string, data json.RawMessage) ([]byte, error) {
+	s.seq++
+	frame, err := json.Marshal(Event{Op: OpDispatch, Type: eventType, Seq: s.seq, Data: data})
+	if err != nil {
+		return nil, err
+	}
+
+	if s.bufferSize <= 0 {
+		return frame, nil
+	}
+	if len(s.buffer) == s.bufferSize {
+		s.buffer = s.buffer[1:]
+	}
+	s.buffer = append(s.buffer, bufferedEvent{seq: s.seq, frame: frame})
+
+	return frame, nil
+}
+
+// since returns the buffered frames after seq, or false if some of them have
+// already rolled out of the buffer.
+func (s *Session) since(seq int64) ([][]byte, bool) {
+	if seq > s.seq || seq < 0 {
+		return nil, false
+	}
+	if seq == s.seq {
+		return nil, true
+	}
+	if len(s.buffer) == 0 || s.buffer[0].seq > seq+1 {
+		return nil, false
+	}
+
+	frames := make([][]byte, 0, s.seq-seq)
+	for _, event := range s.buffer {
+		if event.seq > seq {
+			frames = append(frames, event.frame)
+		}
+	}
+	return frames, true
+}
@@ -0,0 +1,186 @@
+package gateway
+
+import (
+	"encoding/json"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/mock"
+)
+
+func identify(t *testing.T, url, userId string) (*websocket.Conn, Ready) {
+	t.Helper()
+	conn := connect(t, url, userId)
+	if err := conn.WriteJSON(Event{Op: OpIdentify}); err != nil {
+		t.Fatalf("error identifying: %v", err)
+	}
+
+	event := readEvent(t, conn)
+	var ready Ready
+	_ = json.Unmarshal(event.Data, &ready)
+	return conn, ready
+}
+
+func sendMessage(t *testing.T, conn *websocket.Conn, recipient, content string) {
+	t.Helper()
+	event, _ := NewEvent(OpDispatch, EventMessageCreate, models.Message{Recipient: recipient, Content: content})
+	if err := conn.WriteJSON(event); err != nil {
+		t.Fatalf("error writing event: %v", err)
+	}
+}
+
+func resume(t *testing.T, url, userId string, r Resume) *websocket.Conn {
+	t.Helper()
+	conn := connect(t, url, userId)
+	event, _ := NewEvent(OpResume, "", r)
+	if err := conn.WriteJSON(event); err != nil {
+		t.Fatalf("error resuming: %v", err)
+	}
+	return conn
+}
+
+func TestSession_Resume_ReplaysMissedEvents(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+	_, url := newTestServer(t, store)
+
+	sender := dial(t, url, "sender")
+	dropped, ready := identify(t, url, "recipient")
+	_ = dropped.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	sendMessage(t, sender, "recipient", "one")
+	sendMessage(t, sender, "recipient", "two")
+	time.Sleep(50 * time.Millisecond)
+
+	conn := resume(t, url, "recipient", Resume{SessionId: ready.SessionId, Seq: 1})
+
+	for i, content := range []string{"one", "two"} {
+		event := readEvent(t, conn)
+		var message models.Message
+		_ = json.Unmarshal(event.Data, &message)
+		if event.Seq != int64(i+2) || message.Content != content {
+			t.Errorf("expected %q with seq %d, got: %+v", content, i+2, event)
+		}
+	}
+
+	if event := readEvent(t, conn); event.Type != EventResumed || event.Seq != 4 {
+		t.Errorf("expected resumed with seq 4, got: %+v", event)
+	}
+}
+
+func TestSession_Resume_UnknownSession_Invalid(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	conn := resume(t, url, "userId1", Resume{SessionId: "nope", Seq: 1})
+
+	if event := readEvent(t, conn); event.Op != OpInvalidSession {
+		t.Errorf("expected invalid session, got: %+v", event)
+	}
+
+	// a rejected resume can still identify afresh on the same connection
+	if err := conn.WriteJSON(Event{Op: OpIdentify}); err != nil {
+		t.Fatalf("error identifying: %v", err)
+	}
+	if event := readEvent(t, conn); event.Type != EventReady {
+		t.Errorf("expected ready, got: %+v", event)
+	}
+}
+
+func TestSession_Resume_OtherUsersSession_Invalid(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	_, ready := identify(t, url, "userId1")
+	conn := resume(t, url, "userId2", Resume{SessionId: ready.SessionId, Seq: 1})
+
+	if event := readEvent(t, conn); event.Op != OpInvalidSession {
+		t.Errorf("expected invalid session, got: %+v", event)
+	}
+}
+
+func TestSession_Resume_BufferRolledOver_Invalid(t *testing.T) {
+	store := newTestStore()
+	storeMessages(store)
+	_, url := newTestServer(t, store, func(m *Manager) {
+		m.ReplayBufferSize = 2
+	})
+
+	sender := dial(t, url, "sender")
+	dropped, ready := identify(t, url, "recipient")
+	_ = dropped.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	for _, content := range []string{"one", "two", "three"} {
+		sendMessage(t, sender, "recipient", content)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	conn := resume(t, url, "recipient", Resume{SessionId: ready.SessionId, Seq: 1})
+
+	if event := readEvent(t, conn); event.Op != OpInvalidSession {
+		t.Errorf("expected invalid session, got: %+v", event)
+	}
+}
+
+func TestSession_Since(t *testing.T) {
+	s, _ := newSession("userId1", 3)
+	for i := 0; i < 5; i++ {
+		_, _ = s.record(EventMessageCreate, json.RawMessage(`{}`))
+	}
+
+	if frames, ok := s.since(2); !ok || len(frames) != 3 {
+		t.Errorf("expected 3 frames after seq 2, got: %d, %v", len(frames), ok)
+	}
+	if _, ok := s.since(1); ok {
+		t.Errorf("seq 1 has rolled out of the buffer, resume should fail")
+	}
+	if frames, ok := s.since(5); !ok || len(frames) != 0 {
+		t.Errorf("expected nothing after the latest seq, got: %d, %v", len(frames), ok)
+	}
+	if _, ok := s.since(6); ok {
+		t.Errorf("seq from the future should fail")
+	}
+}
+
+func TestSession_Since_NoBuffer(t *testing.T) {
+	s, _ := newSession("userId1", 0)
+	if _, err := s.record(EventMessageCreate, json.RawMessage(`{}`)); err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+
+	if frames, ok := s.since(1); !ok || len(frames) != 0 {
+		t.Errorf("expected nothing after the latest seq, got: %d, %v", len(frames), ok)
+	}
+	if _, ok := s.since(0); ok {
+		t.Errorf("nothing is kept, resume should fail")
+	}
+}
+
+func TestSession_Ready_CarriesUndelivered(t *testing.T) {
+	store := new(database.MockStore)
+	store.On("GetFriends", mock.Anything).Return([]models.User{}, nil).Maybe()
+	store.On("GetUndeliveredMessages", "recipient", readyMessageLimit).Return([]models.Message{{ID: 7, Sender: "sender", Recipient: "recipient", Content: "while you were out"}}, nil)
+	store.On("CountUndeliveredMessages", "recipient").Return(map[string]int{"sender": 1}, nil)
+	store.On("MarkDelivered", "recipient", int64(7)).Return(nil)
+	noMemberships(store)
+	_, url := newTestServer(t, store)
+
+	conn, ready := identify(t, url, "recipient")
+	if len(ready.Undelivered) != 1 || ready.Undelivered[0].Content != "while you were out" {
+		t.Errorf("ready should carry the undelivered message, got: %+v", ready.Undelivered)
+	}
+	if ready.UndeliveredCounts["sender"] != 1 {
+		t.Errorf("ready should count 1 undelivered from sender, got: %+v", ready.UndeliveredCounts)
+	}
+
+	event, _ := NewEvent(OpDeliveryAck, "", DeliveryAck{MessageId: 7})
+	if err := conn.WriteJSON(event); err != nil {
+		t.Fatalf("error acking: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	store.AssertCalled(t, "MarkDelivered", "recipient", int64(7))
+}
@@ -0,0 +1,66 @@
+package gateway
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestManager_Shutdown_DrainsConnections(t *testing.T) {
+	m, url := newTestServer(t, newTestStore())
+
+	identified := dial(t, url, "userId1")
+	unidentified := connect(t, url, "userId2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+
+	if event := readEvent(t, identified); event.Op != OpReconnect {
+		t.Errorf("expected reconnect, got: %+v", event)
+	}
+	expectCloseCode(t, identified, websocket.CloseServiceRestart)
+	expectCloseCode(t, unidentified, websocket.CloseServiceRestart)
+
+	late, _, err := websocket.DefaultDialer.Dial(url+"/ws/userId3?token="+signToken(t, "userId3", time.Minute), nil)
+	if err != nil {
+		t.Fatalf("error dialing: %v", err)
+	}
+	defer late.Close()
+	expectCloseCode(t, late, websocket.CloseServiceRestart)
+}
+
+// slowBus takes a while over every publish.
+type slowBus struct {
+	*LocalBus
+	published atomic.Int32
+}
+
+func (b *slowBus) Publish(ctx context.Context, delivery Delivery) error {
+	time.Sleep(100 * time.Millisecond)
+	b.published.Add(1)
+	return b.LocalBus.Publish(ctx, delivery)
+}
+
+func TestManager_Shutdown_WaitsForPublishing(t *testing.T) {
+	bus := &slowBus{LocalBus: NewLocalBus()}
+	m, _ := newTestServer(t, newTestStore(), func(m *Manager) { m.Bus = bus })
+
+	m.publish(Delivery{UserIds: []string{"userId1"}, Type: EventPresenceUpdate}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := m.Shutdown(ctx); err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+
+	// the caller closes the bus's connection next
+	if published := bus.published.Load(); published != 1 {
+		t.Errorf("delivery should be published before Shutdown returns, got: %v", published)
+	}
+}
@@ -0,0 +1,69 @@
+package gateway
+
+// A topic names something a session can subscribe to besides its own user.
+// Sessions are subscribed to every topic their user belongs to when they're
+// created, and to a DM's topic when a message in it reaches them.
+
+// ServerTopic is the topic for everyone in a server.
+func ServerTopic(serverId string) string {
+	return "server:" + serverId
+}
+
+// DirectTopic is the same whichever way round the two users are given.
+func DirectTopic(userA, userB string) string {
+	if userB < userA {
+		userA, userB = userB, userA
+	}
+	return "dm:" + userA + ":" + userB
+}
+
+// topicsFor looks up every topic a user belongs to: their servers and the DMs
+// they've had.
+func (m *Manager) topicsFor(userId string) ([]string, error) {
+	servers, err := m.Servers.GetMemberServers(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	chats, err := m.ChatService.GetAllChats(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	topics := make([]string, 0, len(servers)+len(chats))
+	for _, server := range servers {
+		topics = append(topics, ServerTopic(server))
+	}
+	for _, chat := range chats {
+		topics = append(topics, DirectTopic(userId, chat.ID))
+	}
+	return topics, nil
+}
+
+func (m *Manager) subscribe(session *Session, topics ...string) {
+	for _, topic := range topics {
+		if session.topics[topic] {
+			continue
+		}
+		session.topics[topic] = true
+
+		subscribers, ok := m.topics[topic]
+		if !ok {
+			subscribers = make(map[*Session]bool)
+			m.topics[topic] = subscribers
+		}
+		subscribers[session] = true
+	}
+}
+
+// unsubscribe takes a session out of every topic it's in.
+func (m *Manager) unsubscribe(session *Session) {
+	for topic := range session.topics {
+		subscribers := m.topics[topic]
+		delete(subscribers, session)
+		if len(subscribers) == 0 {
+			delete(m.topics, topic)
+		}
+	}
+	session.topics = make(map[string]bool)
+}
@@ -0,0 +1,59 @@
+package gateway
+
+import (
+	"ivar/pkg/auth"
+	"ivar/pkg/chat"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"ivar/pkg/presence"
+	"ivar/pkg/server"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func TestDirectTopic_EitherOrder(t *testing.T) {
+	if DirectTopic("alice", "bob") != DirectTopic("bob", "alice") {
+		t.Errorf("a DM's topic shouldn't depend on who's asking, got: %s, %s", DirectTopic("alice", "bob"), DirectTopic("bob", "alice"))
+	}
+}
+
+func TestTopic_SubscribedFromMemberships(t *testing.T) {
+	store := new(database.MockStore)
+	store.On("GetFriends", mock.Anything).Return([]models.User{}, nil).Maybe()
+	nothingUndelivered(store)
+	store.On("GetMemberServers", "alice").Return([]string{"1"}, nil)
+	store.On("GetMemberServers", mock.Anything).Return([]string{}, nil)
+	store.On("AllChats", "alice").Return([]models.User{{ID: "bob"}}, nil)
+	store.On("AllChats", mock.Anything).Return([]models.User{}, nil)
+
+	m := NewManager(&chat.Service{Store: store}, &server.Service{Store: store}, &auth.Service{}, presence.NewService(store), NewLocalBus())
+	go m.Start()
+
+	alice := newTestClient(m, "alice")
+	bystander := newTestClient(m, "bystander")
+
+	m.dispatchToTopic(ServerTopic("1"), nil, EventTypingStart, []byte(`{}`))
+	expectFrame(t, alice, "alice")
+	expectNoFrame(t, bystander, "bystander")
+
+	m.dispatchToTopic(DirectTopic("bob", "alice"), nil, EventTypingStart, []byte(`{}`))
+	expectFrame(t, alice, "alice")
+	expectNoFrame(t, bystander, "bystander")
+}
+
+func TestTopic_UnsubscribedOnExpiry(t *testing.T) {
+	m := NewManager(nil, nil, &auth.Service{}, nil, NewLocalBus())
+	session, _ := newSession("alice", 8)
+	m.sessions[session.ID] = session
+	m.subscribe(session, ServerTopic("1"), ServerTopic("1"), ServerTopic("2"))
+
+	if len(m.topics) != 2 || len(m.topics[ServerTopic("1")]) != 1 {
+		t.Fatalf("expected 2 topics with one subscriber each, got: %v", m.topics)
+	}
+
+	m.expire(session.detachedAt.Add(m.ResumeTimeout))
+	if len(m.topics) != 0 {
+		t.Errorf("expired sessions should leave every topic, got: %v", m.topics)
+	}
+}
@@ -0,0 +1,40 @@
+package gateway
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+type typingKey struct {
+	userId    string
+	recipient string
+}
+
+func (m *Manager) routeTyping(from *Client, typing TypingStart) {
+	now := time.Now()
+	key := typingKey{userId: typing.UserId, recipient: typing.Recipient}
+	if last, ok := m.typing[key]; ok && now.Sub(last) < m.TypingInterval {
+		return
+	}
+	m.typing[key] = now
+
+	typing.ExpiresAt = now.Add(m.TypingTimeout)
+	data, err := json.Marshal(typing)
+	if err != nil {
+		log.Println("error encoding typing: " + err.Error())
+		return
+	}
+
+	// only the other side sees someone typing, not the typist's other devices
+	m.dispatchToUser(typing.Recipient, nil, EventTypingStart, data)
+}
+
+// expireTyping forgets rate limit state that can no longer hold anything back.
+func (m *Manager) expireTyping(now time.Time) {
+	for key, last := range m.typing {
+		if now.Sub(last) >= m.TypingInterval {
+			delete(m.typing, key)
+		}
+	}
+}
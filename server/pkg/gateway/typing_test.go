@@ -0,0 +1,49 @@
+package gateway
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTyping_RelayedWithExpiry(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	recipient := dial(t, url, "recipient")
+	sender := dial(t, url, "sender")
+
+	event, _ := NewEvent(OpDispatch, EventTypingStart, TypingStart{UserId: "spoofed", Recipient: "recipient"})
+	_ = sender.WriteJSON(event)
+
+	received := readEvent(t, recipient)
+	if received.Type != EventTypingStart {
+		t.Fatalf("expected typing start, got: %+v", received)
+	}
+
+	var typing TypingStart
+	_ = json.Unmarshal(received.Data, &typing)
+	if typing.UserId != "sender" {
+		t.Errorf("user id should come from the token, got: %v", typing.UserId)
+	}
+	if !typing.ExpiresAt.After(time.Now()) {
+		t.Errorf("typing should expire in the future, got: %v", typing.ExpiresAt)
+	}
+}
+
+func TestTyping_RateLimited(t *testing.T) {
+	_, url := newTestServer(t, newTestStore())
+
+	recipient := dial(t, url, "recipient")
+	sender := dial(t, url, "sender")
+
+	event, _ := NewEvent(OpDispatch, EventTypingStart, TypingStart{Recipient: "recipient"})
+	_ = sender.WriteJSON(event)
+	_ = sender.WriteJSON(event)
+
+	readEvent(t, recipient)
+
+	_ = recipient.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, msg, err := recipient.ReadMessage(); err == nil {
+		t.Errorf("second typing event should be dropped, got: %s", msg)
+	}
+}
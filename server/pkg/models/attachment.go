@@ -0,0 +1,19 @@
+package models
+
+// Attachment is a file uploaded to go with a message. It belongs to whoever
+// uploaded it until a message claims it, and after that to both sides of the
+// conversation. Images also have their dimensions and a thumbnail.
+type Attachment struct {
+	ID          int64  `json:"id"`
+	Uploader    string `json:"uploader"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+	Width       *int   `json:"width,omitempty"`
+	Height      *int   `json:"height,omitempty"`
+	Thumbnail   bool   `json:"thumbnail,omitempty"`
+	// BlobKey and ThumbnailKey are where the bytes are kept, and the server's
+	// business only.
+	BlobKey      string `json:"-"`
+	ThumbnailKey string `json:"-"`
+}
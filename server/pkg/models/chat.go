@@ -1,10 +1,32 @@
 package models
 
+// ChatInfo is who's in a DM and the latest page of its history.
 type ChatInfo struct {
-	Users    []User    `json:"users"`
-	Messages []Message `json:"messages"`
+	Users []User `json:"users"`
+	MessagePage
 }
 
 type ChatInfoRequest struct {
 	Users []string `json:"users" binding:"required"`
 }
+
+// MessageQuery asks for a page of a DM's history: the messages before or after
+// a message id, the ones around it, or the latest if no cursor is set. At most
+// one cursor may be. Users starts with the user asking, whatever order the
+// request had them in.
+type MessageQuery struct {
+	Users  []string `json:"users" binding:"required"`
+	Before int64    `json:"before,omitempty"`
+	After  int64    `json:"after,omitempty"`
+	Around int64    `json:"around,omitempty"`
+	Limit  int      `json:"limit,omitempty"`
+}
+
+// MessagePage is a page of history, newest first. Before and After are the
+// cursors for the older and newer pages next to it, and are only set if there's
+// anything there.
+type MessagePage struct {
+	Messages []Message `json:"messages"`
+	Before   *int64    `json:"before,omitempty"`
+	After    *int64    `json:"after,omitempty"`
+}
@@ -2,10 +2,60 @@ package models
 
 import "time"
 
+// MessageKind tells ordinary messages apart from ones the server writes itself.
+type MessageKind string
+
+const (
+	MessageKindDefault    MessageKind = "default"
+	MessageKindMissedCall MessageKind = "missed_call"
+)
+
 type Message struct {
 	ID        int64     `json:"id,omitempty"`
 	Timestamp time.Time `json:"timestamp,omitempty"`
 	Sender    string    `json:"sender" binding:"required"`
 	Recipient string    `json:"recipient" binding:"required"`
 	Content   string    `json:"content" binding:"required"`
+	// Kind is set by the server; anything a client sends is a default message.
+	Kind MessageKind `json:"kind,omitempty"`
+	// Nonce is picked by the sending client so it can match the stored message
+	// to the one it showed optimistically. Resending with the same nonce doesn't
+	// store the message twice.
+	Nonce string `json:"nonce,omitempty" db:"-"`
+	// EditedAt is when the content was last changed, if it ever was.
+	EditedAt *time.Time `json:"editedAt,omitempty"`
+	// Deleted marks a tombstone: the message was deleted and has no content.
+	Deleted bool `json:"deleted,omitempty"`
+	// ReplyTo is the id of an earlier message in the same DM this one replies
+	// to. Reply is a preview of it, filled in by the server.
+	ReplyTo *int64          `json:"replyTo,omitempty"`
+	Reply   *MessagePreview `json:"reply,omitempty"`
+	// Mentions are the users the message should notify, worked out by the
+	// server. Replying to someone else's message mentions them.
+	Mentions []string `json:"mentions,omitempty"`
+	// Reactions are counted per emoji, in the order they were first used.
+	Reactions []Reaction `json:"reactions,omitempty"`
+	// AttachmentIds are uploads of the sender's for the message to carry, and
+	// Attachments are what the server fills in for them.
+	AttachmentIds []int64      `json:"attachmentIds,omitempty" db:"-"`
+	Attachments   []Attachment `json:"attachments,omitempty"`
+}
+
+// MessagePreview is enough of a message to quote it above a reply. A deleted
+// message's preview has no snippet.
+type MessagePreview struct {
+	ID      int64  `json:"id"`
+	Sender  string `json:"sender"`
+	Snippet string `json:"snippet"`
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Revision is what a message said before an edit, and since when.
+type Revision struct {
+	Content   string    `json:"content"`
+	RevisedAt time.Time `json:"revisedAt"`
+}
+
+type EditMessageRequest struct {
+	Content string `json:"content" binding:"required"`
 }
@@ -0,0 +1,20 @@
+package models
+
+type Status string
+
+const (
+	StatusOnline       Status = "online"
+	StatusIdle         Status = "idle"
+	StatusDoNotDisturb Status = "dnd"
+	StatusInvisible    Status = "invisible"
+	StatusOffline      Status = "offline"
+)
+
+type Presence struct {
+	UserId string `json:"userId"`
+	Status Status `json:"status"`
+}
+
+type PresenceRequest struct {
+	Users []string `json:"users" binding:"required"`
+}
@@ -0,0 +1,27 @@
+package models
+
+// Reaction is how many people reacted to a message with one emoji, and whether
+// the user asking is one of them. Emoji is either the unicode emoji itself or a
+// custom emoji as name:id.
+type Reaction struct {
+	Emoji string `json:"emoji"`
+	Count int    `json:"count"`
+	Me    bool   `json:"me"`
+}
+
+// ReactionChange is a user adding or removing a reaction to a message, in the
+// DM between Sender and Recipient.
+type ReactionChange struct {
+	MessageId int64  `json:"messageId"`
+	UserId    string `json:"userId"`
+	Emoji     string `json:"emoji"`
+	Sender    string `json:"sender,omitempty"`
+	Recipient string `json:"recipient,omitempty"`
+}
+
+// ReactorPage is a page of the users who reacted with an emoji, ordered by id.
+// After is the cursor for the next page, if there is one.
+type ReactorPage struct {
+	Users []User  `json:"users"`
+	After *string `json:"after,omitempty"`
+}
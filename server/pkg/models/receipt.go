@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+// Receipt is what the recipient of a message has done with it. ReadAt is left
+// out for recipients who have turned read receipts off.
+type Receipt struct {
+	MessageId   int64      `json:"messageId"`
+	UserId      string     `json:"userId"`
+	DeliveredAt *time.Time `json:"deliveredAt"`
+	ReadAt      *time.Time `json:"readAt"`
+}
+
+type PrivacySettings struct {
+	ReadReceipts bool `json:"readReceipts"`
+}
@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// SearchQuery is a parsed search. Terms is the free text, in websearch syntax:
+// quoted phrases, or, and -excluded words. The rest narrow it down; From and In
+// are lowercase usernames, matched if any of them is.
+type SearchQuery struct {
+	Terms string
+	From  []string
+	// In are the users whose DMs with the searcher to look in.
+	In  []string
+	Has []SearchHas
+	// Since is inclusive and Until exclusive.
+	Since *time.Time
+	Until *time.Time
+}
+
+// SearchHas is something a message has to have to match a has: filter.
+type SearchHas string
+
+const (
+	HasAttachment SearchHas = "attachment"
+	HasImage      SearchHas = "image"
+	HasLink       SearchHas = "link"
+	HasReply      SearchHas = "reply"
+)
+
+// SearchResult is a message that matched a search, with a snippet of its content
+// around the matches.
+type SearchResult struct {
+	Message Message       `json:"message"`
+	Snippet []SnippetPart `json:"snippet"`
+}
+
+// SnippetPart is a run of a snippet's text, which is either all part of a match
+// or not at all. Clients highlight the ones that are.
+type SnippetPart struct {
+	Text  string `json:"text"`
+	Match bool   `json:"match,omitempty"`
+}
+
+// SearchPage is a page of results, newest first. Before is the cursor for the
+// next page, if there is one.
+type SearchPage struct {
+	Results []SearchResult `json:"results"`
+	Before  *int64         `json:"before,omitempty"`
+}
@@ -0,0 +1,230 @@
+package presence
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"ivar/pkg/models"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const defaultInstanceTimeout = 30 * time.Second
+
+// PostgresRegistry is a Registry shared by every instance talking to the same
+// database. Instances check in every so often; the connections of one that stops,
+// say because it crashed, stop counting once it's been quiet for Timeout.
+type PostgresRegistry struct {
+	db       *pgxpool.Pool
+	instance string
+	// Timeout is how long an instance can go without checking in before it's
+	// taken for dead.
+	Timeout time.Duration
+
+	// mu serializes this instance's writes. counts is what they've written,
+	// to write again if the instance was taken for dead but wasn't.
+	mu     sync.Mutex
+	counts map[string]int
+	stop   context.CancelFunc
+}
+
+func NewPostgresRegistry(db *pgxpool.Pool) *PostgresRegistry {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic("error generating instance id: " + err.Error())
+	}
+
+	return &PostgresRegistry{
+		db:       db,
+		instance: hex.EncodeToString(id),
+		Timeout:  defaultInstanceTimeout,
+		counts:   make(map[string]int),
+	}
+}
+
+// Start checks the instance in, and keeps checking it in until Close.
+func (r *PostgresRegistry) Start(ctx context.Context) error {
+	if err := r.checkIn(ctx); err != nil {
+		return err
+	}
+
+	ctx, r.stop = context.WithCancel(ctx)
+	go func() {
+		ticker := time.NewTicker(r.Timeout / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.checkIn(ctx); err != nil && ctx.Err() == nil {
+					log.Println("unable to check in presence registry: " + err.Error())
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Close stops checking in and takes this instance's connections out of every
+// user's count.
+func (r *PostgresRegistry) Close(ctx context.Context) error {
+	if r.stop != nil {
+		r.stop()
+	}
+
+	_, err := r.db.Exec(ctx, "delete from gateway_instances where id = $1", r.instance)
+	return err
+}
+
+// checkIn marks the instance alive and forgets the instances that aren't.
+func (r *PostgresRegistry) checkIn(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var inserted bool
+	err := r.db.QueryRow(ctx, `
+		insert into gateway_instances (id) values ($1)
+		on conflict (id) do update set seen_at = now()
+		returning xmax = 0`, r.instance).Scan(&inserted)
+	if err != nil {
+		return err
+	}
+
+	// another instance took this one for dead and its connections went with
+	// it, so they're written back
+	if inserted && len(r.counts) > 0 {
+		userIds := make([]string, 0, len(r.counts))
+		counts := make([]int, 0, len(r.counts))
+		for userId, count := range r.counts {
+			userIds = append(userIds, userId)
+			counts = append(counts, count)
+		}
+		_, err := r.db.Exec(ctx, `
+			insert into presence_connections (instance_id, user_id, connections)
+			select $1, user_id, connections from unnest($2::text[], $3::int[]) as c(user_id, connections)
+			on conflict (instance_id, user_id) do update set connections = excluded.connections`,
+			r.instance, userIds, counts)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = r.db.Exec(ctx, "delete from gateway_instances where seen_at < now() - make_interval(secs => $1)", r.Timeout.Seconds())
+	return err
+}
+
+// AddConnections reads the user's record before writing when they gain a
+// connection, and after when they lose one. Whichever of two racing instances
+// reads last sees the other's write, so a user is never left looking online
+// with nobody announcing it, or the other way round.
+func (r *PostgresRegistry) AddConnections(userId string, delta int) (Record, Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	count := max(r.counts[userId]+delta, 0)
+	if delta > 0 {
+		before, err := r.get(userId)
+		if err != nil {
+			return Record{}, Record{}, err
+		}
+		if err := r.write(userId, count); err != nil {
+			return Record{}, Record{}, err
+		}
+		after := before
+		after.Connections += delta
+		return before, after, nil
+	}
+
+	if err := r.write(userId, count); err != nil {
+		return Record{}, Record{}, err
+	}
+	after, err := r.get(userId)
+	if err != nil {
+		return Record{}, Record{}, err
+	}
+	before := after
+	before.Connections -= delta
+	return before, after, nil
+}
+
+func (r *PostgresRegistry) write(userId string, count int) error {
+	if count == 0 {
+		delete(r.counts, userId)
+		_, err := r.db.Exec(context.Background(), "delete from presence_connections where instance_id = $1 and user_id = $2", r.instance, userId)
+		return err
+	}
+
+	r.counts[userId] = count
+	_, err := r.db.Exec(context.Background(), `
+		insert into presence_connections (instance_id, user_id, connections) values ($1, $2, $3)
+		on conflict (instance_id, user_id) do update set connections = excluded.connections`,
+		r.instance, userId, count)
+	return err
+}
+
+func (r *PostgresRegistry) Choose(userId string, status models.Status) (Record, error) {
+	before, err := r.get(userId)
+	if err != nil {
+		return Record{}, err
+	}
+
+	if status == models.StatusOnline {
+		_, err = r.db.Exec(context.Background(), "delete from presence_statuses where user_id = $1", userId)
+	} else {
+		_, err = r.db.Exec(context.Background(), `
+			insert into presence_statuses (user_id, status) values ($1, $2)
+			on conflict (user_id) do update set status = excluded.status`,
+			userId, status)
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	return before, nil
+}
+
+func (r *PostgresRegistry) Get(userIds []string) (map[string]Record, error) {
+	rows, err := r.db.Query(context.Background(), `
+		select u.id, coalesce(c.connections, 0), coalesce(s.status, $3)
+		from unnest($1::text[]) as u(id)
+		left join (
+			select pc.user_id, sum(pc.connections)::int as connections
+			from presence_connections pc
+			join gateway_instances i on i.id = pc.instance_id
+			where pc.user_id = any($1) and i.seen_at > now() - make_interval(secs => $2)
+			group by pc.user_id
+		) c on c.user_id = u.id
+		left join presence_statuses s on s.user_id = u.id`,
+		userIds, r.Timeout.Seconds(), models.StatusOnline)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := make(map[string]Record, len(userIds))
+	for rows.Next() {
+		var (
+			userId string
+			record Record
+		)
+		if err := rows.Scan(&userId, &record.Connections, &record.Chosen); err != nil {
+			return nil, err
+		}
+		records[userId] = record
+	}
+	return records, rows.Err()
+}
+
+func (r *PostgresRegistry) get(userId string) (Record, error) {
+	records, err := r.Get([]string{userId})
+	if err != nil {
+		return Record{}, err
+	}
+	return records[userId], nil
+}
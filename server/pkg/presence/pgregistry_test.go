@@ -0,0 +1,52 @@
+package presence
+
+import (
+	"context"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"os"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestPostgresRegistry_SharedAcrossInstances(t *testing.T) {
+	url := os.Getenv("TEST_DATABASE_URL")
+	if url == "" {
+		t.Skip("TEST_DATABASE_URL not set")
+	}
+
+	db, err := pgxpool.New(context.Background(), url)
+	if err != nil {
+		t.Fatalf("error connecting to database: %v", err)
+	}
+	defer db.Close()
+
+	instances := make([]*Service, 2)
+	for i := range instances {
+		registry := NewPostgresRegistry(db)
+		if err := registry.Start(context.Background()); err != nil {
+			t.Fatalf("error starting registry: %v", err)
+		}
+		defer registry.Close(context.Background())
+		instances[i] = &Service{Store: new(database.MockStore), Registry: registry}
+	}
+	a, b := instances[0], instances[1]
+
+	if changed, err := a.Connect("registryUser"); err != nil || !changed {
+		t.Fatalf("first connection should change presence, got: %v %v", changed, err)
+	}
+	if changed, _ := b.Connect("registryUser"); changed {
+		t.Errorf("a connection on another instance should not change presence")
+	}
+	// the phone is still connected to the other instance
+	if changed, _ := a.Disconnect("registryUser"); changed {
+		t.Errorf("closing one of two connections should not change presence")
+	}
+	if presences, _ := a.GetPresences([]string{"registryUser"}); presences[0].Status != models.StatusOnline {
+		t.Errorf("user should look online everywhere, got: %v", presences)
+	}
+	if changed, _ := b.Disconnect("registryUser"); !changed {
+		t.Errorf("closing the last connection should change presence")
+	}
+}
@@ -0,0 +1,90 @@
+package presence
+
+import (
+	"ivar/pkg/models"
+	"sync"
+)
+
+// Record is what a user's presence is worked out from.
+type Record struct {
+	// Connections is how many live gateway connections the user has, on every
+	// instance together.
+	Connections int
+	// Chosen is the status the user picked, StatusOnline unless they picked
+	// something else.
+	Chosen models.Status
+}
+
+// Registry keeps presence records where every gateway instance can see them.
+// Each instance counts its own connections, and a user's record adds them up.
+type Registry interface {
+	// AddConnections changes how many connections the user has on this
+	// instance by delta, returning their record from before and after. When
+	// instances race to change the same user, at least one of them sees the
+	// user go from no connections to some, or from some to none.
+	AddConnections(userId string, delta int) (Record, Record, error)
+	// Choose records the status the user picked, returning their record from
+	// before.
+	Choose(userId string, status models.Status) (Record, error)
+	// Get returns a record for every one of the users, connected or not.
+	Get(userIds []string) (map[string]Record, error)
+}
+
+// LocalRegistry is a Registry for a single instance, kept in memory.
+type LocalRegistry struct {
+	mu          sync.RWMutex
+	connections map[string]int
+	chosen      map[string]models.Status
+}
+
+func NewLocalRegistry() *LocalRegistry {
+	return &LocalRegistry{
+		connections: make(map[string]int),
+		chosen:      make(map[string]models.Status),
+	}
+}
+
+func (r *LocalRegistry) AddConnections(userId string, delta int) (Record, Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	before := r.record(userId)
+	if count := r.connections[userId] + delta; count > 0 {
+		r.connections[userId] = count
+	} else {
+		delete(r.connections, userId)
+	}
+	return before, r.record(userId), nil
+}
+
+func (r *LocalRegistry) Choose(userId string, status models.Status) (Record, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	before := r.record(userId)
+	if status == models.StatusOnline {
+		delete(r.chosen, userId)
+	} else {
+		r.chosen[userId] = status
+	}
+	return before, nil
+}
+
+func (r *LocalRegistry) Get(userIds []string) (map[string]Record, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	records := make(map[string]Record, len(userIds))
+	for _, userId := range userIds {
+		records[userId] = r.record(userId)
+	}
+	return records, nil
+}
+
+func (r *LocalRegistry) record(userId string) Record {
+	chosen, ok := r.chosen[userId]
+	if !ok {
+		chosen = models.StatusOnline
+	}
+	return Record{Connections: r.connections[userId], Chosen: chosen}
+}
@@ -0,0 +1,132 @@
+package presence
+
+import (
+	"errors"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+)
+
+var ErrInvalidStatus = errors.New("invalid status")
+
+// Service tracks who is online. Connection counts come from the gateway, the
+// chosen status from explicit client updates. Both are kept in Registry, so
+// every gateway instance sees the same presence.
+type Service struct {
+	Store    database.Store
+	Registry Registry
+}
+
+// NewService returns a Service for a single instance. One gateway instance
+// among several needs a shared Registry instead.
+func NewService(store database.Store) *Service {
+	return &Service{
+		Store:    store,
+		Registry: NewLocalRegistry(),
+	}
+}
+
+// Connect records a new live connection for the user and reports whether what
+// others see changed.
+func (s *Service) Connect(userId string) (bool, error) {
+	before, after, err := s.Registry.AddConnections(userId, 1)
+	if err != nil {
+		return false, err
+	}
+	return visible(before) != visible(after), nil
+}
+
+// Disconnect is the counterpart to Connect.
+func (s *Service) Disconnect(userId string) (bool, error) {
+	before, after, err := s.Registry.AddConnections(userId, -1)
+	if err != nil {
+		return false, err
+	}
+	return visible(before) != visible(after), nil
+}
+
+// SetStatus records the status the user picked and reports whether what others
+// see changed.
+func (s *Service) SetStatus(userId string, status models.Status) (bool, error) {
+	switch status {
+	case models.StatusOnline, models.StatusIdle, models.StatusDoNotDisturb, models.StatusInvisible:
+	default:
+		return false, ErrInvalidStatus
+	}
+
+	before, err := s.Registry.Choose(userId, status)
+	if err != nil {
+		return false, err
+	}
+	after := before
+	after.Chosen = status
+	return visible(before) != visible(after), nil
+}
+
+// Status is the user's own view of their status, invisible included.
+func (s *Service) Status(userId string) (models.Status, error) {
+	records, err := s.Registry.Get([]string{userId})
+	if err != nil {
+		return "", err
+	}
+	return status(records[userId]), nil
+}
+
+// Visible is what everyone else sees: invisible users look offline.
+func (s *Service) Visible(userId string) (models.Status, error) {
+	records, err := s.Registry.Get([]string{userId})
+	if err != nil {
+		return "", err
+	}
+	return visible(records[userId]), nil
+}
+
+func (s *Service) GetPresences(userIds []string) ([]models.Presence, error) {
+	records, err := s.Registry.Get(userIds)
+	if err != nil {
+		return nil, err
+	}
+
+	presences := make([]models.Presence, 0, len(userIds))
+	for _, userId := range userIds {
+		presences = append(presences, models.Presence{UserId: userId, Status: visible(records[userId])})
+	}
+	return presences, nil
+}
+
+// Friends are who hear about the user's presence changes whatever intents they
+// identified with. Server members hear through the servers' topics.
+func (s *Service) Friends(userId string) ([]string, error) {
+	friends, err := s.Store.GetFriends(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{userId: true}
+	friendIds := make([]string, 0, len(friends))
+	for _, friend := range friends {
+		if !seen[friend.ID] {
+			seen[friend.ID] = true
+			friendIds = append(friendIds, friend.ID)
+		}
+	}
+
+	return friendIds, nil
+}
+
+func status(record Record) models.Status {
+	if record.Connections <= 0 {
+		return models.StatusOffline
+	}
+	if record.Chosen == "" {
+		return models.StatusOnline
+	}
+	return record.Chosen
+}
+
+func visible(record Record) models.Status {
+	status := status(record)
+	if status == models.StatusInvisible {
+		return models.StatusOffline
+	}
+	return status
+}
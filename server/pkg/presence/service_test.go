@@ -0,0 +1,110 @@
+package presence
+
+import (
+	"errors"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"slices"
+	"testing"
+)
+
+func TestService_ConnectDisconnect(t *testing.T) {
+	s := NewService(new(database.MockStore))
+
+	if changed, _ := s.Connect("userId1"); !changed {
+		t.Errorf("first connection should change presence")
+	}
+	if changed, _ := s.Connect("userId1"); changed {
+		t.Errorf("second connection should not change presence")
+	}
+	if changed, _ := s.Disconnect("userId1"); changed {
+		t.Errorf("closing one of two connections should not change presence")
+	}
+	if changed, _ := s.Disconnect("userId1"); !changed {
+		t.Errorf("closing the last connection should change presence")
+	}
+	if status, _ := s.Visible("userId1"); status != models.StatusOffline {
+		t.Errorf("status should be offline, got: %v", status)
+	}
+}
+
+func TestService_SetStatus_Invisible(t *testing.T) {
+	s := NewService(new(database.MockStore))
+	s.Connect("userId1")
+
+	changed, err := s.SetStatus("userId1", models.StatusInvisible)
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if !changed {
+		t.Errorf("going invisible should change what others see")
+	}
+	if status, _ := s.Visible("userId1"); status != models.StatusOffline {
+		t.Errorf("invisible users should look offline, got: %v", status)
+	}
+	if status, _ := s.Status("userId1"); status != models.StatusInvisible {
+		t.Errorf("users should see their own status as invisible, got: %v", status)
+	}
+
+	presences, err := s.GetPresences([]string{"userId1", "userId2"})
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if presences[0].Status != models.StatusOffline || presences[1].Status != models.StatusOffline {
+		t.Errorf("both users should look offline, got: %v", presences)
+	}
+}
+
+func TestService_SetStatus_Invalid(t *testing.T) {
+	s := NewService(new(database.MockStore))
+
+	if _, err := s.SetStatus("userId1", models.StatusOffline); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("error should be ErrInvalidStatus, got: %v", err)
+	}
+}
+
+func TestService_SetStatus_Offline_NotVisibleUntilConnected(t *testing.T) {
+	s := NewService(new(database.MockStore))
+
+	changed, _ := s.SetStatus("userId1", models.StatusDoNotDisturb)
+	if changed {
+		t.Errorf("status of a disconnected user should not change what others see")
+	}
+	s.Connect("userId1")
+	if status, _ := s.Visible("userId1"); status != models.StatusDoNotDisturb {
+		t.Errorf("status should be dnd, got: %v", status)
+	}
+}
+
+func TestService_Friends_Success(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("GetFriends", "userId1").Return([]models.User{{ID: "userId1"}, {ID: "userId2"}, {ID: "userId2"}}, nil)
+
+	s := NewService(m)
+
+	friends, err := s.Friends("userId1")
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if !slices.Equal(friends, []string{"userId2"}) {
+		t.Errorf("friends should be userId2, got: %v", friends)
+	}
+}
+
+func TestService_Friends_Failure(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("GetFriends", "userId1").Return([]models.User{}, errors.New("failed"))
+
+	s := NewService(m)
+
+	_, err := s.Friends("userId1")
+
+	m.AssertExpectations(t)
+
+	if err.Error() != "failed" {
+		t.Errorf("error should be 'failed', got: %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package search
+
+import (
+	"errors"
+	"fmt"
+	"ivar/pkg/models"
+	"slices"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// ErrInvalidQuery is returned, wrapped with what's wrong, for searches that
+// can't be run as written.
+var ErrInvalidQuery = errors.New("invalid search")
+
+const dateLayout = "2006-01-02"
+
+var hasFilters = []models.SearchHas{models.HasAttachment, models.HasImage, models.HasLink, models.HasReply}
+
+// Parse reads a search the way people type it. Filters narrow it down:
+//
+//	from:alice        sent by alice
+//	in:@bob           in the DM with bob
+//	has:attachment    with an attachment; also image, link and reply
+//	before:2026-01-01 sent before that day
+//	after:2026-01-01  sent after that day
+//	during:2026-01-01 sent on that day
+//
+// Anything else is the text to find, where "quoted phrases", or and -word work
+// as they do in web searches. Filter values with spaces can be quoted too. Dates
+// are UTC.
+func Parse(raw string) (models.SearchQuery, error) {
+	var (
+		query    models.SearchQuery
+		terms    []string
+		filtered bool
+	)
+	for _, token := range tokenize(raw) {
+		key, value, ok := strings.Cut(token, ":")
+		value = unquote(value)
+		if !ok || value == "" {
+			terms = append(terms, token)
+			continue
+		}
+
+		switch strings.ToLower(key) {
+		case "from":
+			query.From = append(query.From, username(value))
+		case "in":
+			if strings.HasPrefix(value, "#") {
+				return models.SearchQuery{}, fmt.Errorf("%w: there are no channels to search, so %s can't be searched in", ErrInvalidQuery, value)
+			}
+			query.In = append(query.In, username(value))
+		case "has":
+			has := models.SearchHas(strings.ToLower(value))
+			if !slices.Contains(hasFilters, has) {
+				return models.SearchQuery{}, fmt.Errorf("%w: unknown has:%s", ErrInvalidQuery, value)
+			}
+			query.Has = append(query.Has, has)
+		case "before", "after", "during":
+			day, err := time.Parse(dateLayout, value)
+			if err != nil {
+				return models.SearchQuery{}, fmt.Errorf("%w: %s:%s isn't a date like %s", ErrInvalidQuery, key, value, dateLayout)
+			}
+			next := day.AddDate(0, 0, 1)
+			switch strings.ToLower(key) {
+			case "before":
+				query.Until = earliest(query.Until, day)
+			case "after":
+				query.Since = latest(query.Since, next)
+			case "during":
+				query.Since = latest(query.Since, day)
+				query.Until = earliest(query.Until, next)
+			}
+		default:
+			// not a filter, just text with a colon in it
+			terms = append(terms, token)
+			continue
+		}
+		filtered = true
+	}
+
+	query.Terms = strings.Join(terms, " ")
+	if query.Terms == "" && !filtered {
+		return models.SearchQuery{}, fmt.Errorf("%w: nothing to search for", ErrInvalidQuery)
+	}
+	return query, nil
+}
+
+// tokenize splits a search on whitespace, except inside double quotes, which
+// stay part of their token.
+func tokenize(raw string) []string {
+	var (
+		tokens  []string
+		current strings.Builder
+		quoted  bool
+	)
+	for _, r := range raw {
+		switch {
+		case r == '"':
+			quoted = !quoted
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens
+}
+
+func unquote(value string) string {
+	return strings.TrimSpace(strings.Trim(value, `"`))
+}
+
+// username is how a user is written in a filter, with or without an @.
+func username(value string) string {
+	return strings.ToLower(strings.TrimPrefix(value, "@"))
+}
+
+func earliest(current *time.Time, t time.Time) *time.Time {
+	if current != nil && current.Before(t) {
+		return current
+	}
+	return &t
+}
+
+func latest(current *time.Time, t time.Time) *time.Time {
+	if current != nil && current.After(t) {
+		return current
+	}
+	return &t
+}
@@ -0,0 +1,80 @@
+package search
+
+import (
+	"errors"
+	"ivar/pkg/models"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestParse_Filters(t *testing.T) {
+	query, err := Parse(`from:Alice in:@bob has:attachment before:2026-01-01 deploy failed`)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+
+	if query.Terms != "deploy failed" {
+		t.Errorf("terms should be what isn't a filter, got: %q", query.Terms)
+	}
+	if !slices.Equal(query.From, []string{"alice"}) || !slices.Equal(query.In, []string{"bob"}) {
+		t.Errorf("users should be lowercase without their @, got: %+v", query)
+	}
+	if !slices.Equal(query.Has, []models.SearchHas{models.HasAttachment}) {
+		t.Errorf("has should be attachment, got: %v", query.Has)
+	}
+	if query.Since != nil || query.Until == nil || !query.Until.Equal(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("before should end at the start of the day, got: %v %v", query.Since, query.Until)
+	}
+}
+
+func TestParse_Dates(t *testing.T) {
+	query, err := Parse(`after:2026-01-01 during:2026-01-02 during:2026-01-01`)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+
+	// the tightest bounds win, which here is nothing at all
+	day := time.Date(2026, 1, 2, 0, 0, 0, 0, time.UTC)
+	if !query.Since.Equal(day) || !query.Until.Equal(day) {
+		t.Errorf("bounds should narrow to the tightest, got: %v %v", query.Since, query.Until)
+	}
+}
+
+func TestParse_Quotes(t *testing.T) {
+	query, err := Parse(`from:"Test User 1" "deploy failed" -staging http://example.com`)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+
+	if !slices.Equal(query.From, []string{"test user 1"}) {
+		t.Errorf("quoted values should keep their spaces, got: %v", query.From)
+	}
+	if query.Terms != `"deploy failed" -staging http://example.com` {
+		t.Errorf("text should be left for websearch, got: %q", query.Terms)
+	}
+}
+
+func TestParse_OnlyFilters(t *testing.T) {
+	query, err := Parse(`from:alice has:image`)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	if query.Terms != "" || len(query.From) != 1 || len(query.Has) != 1 {
+		t.Errorf("filters alone should be a search, got: %+v", query)
+	}
+}
+
+func TestParse_Failure(t *testing.T) {
+	for _, raw := range []string{
+		"",
+		"   ",
+		"has:balloons",
+		"before:yesterday",
+		"in:#general deploy",
+	} {
+		if _, err := Parse(raw); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("%q should be ErrInvalidQuery, got: %v", raw, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package search
+
+import (
+	"fmt"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+)
+
+type Service struct {
+	Store database.Store
+}
+
+const (
+	defaultPageSize = 25
+	maxPageSize     = 100
+	maxQueryLength  = 512
+)
+
+// Search finds messages in the user's DMs that match a query, as Parse reads
+// it, newest first. before is the cursor from the previous page, or 0 for the
+// first one.
+func (s *Service) Search(userId, raw string, before int64, limit int) (models.SearchPage, error) {
+	if len(raw) > maxQueryLength {
+		return models.SearchPage{}, fmt.Errorf("%w: longer than %d characters", ErrInvalidQuery, maxQueryLength)
+	}
+	query, err := Parse(raw)
+	if err != nil {
+		return models.SearchPage{}, err
+	}
+
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	// one more than the page holds says whether there's another
+	results, err := s.Store.SearchMessages(userId, query, before, limit+1)
+	if err != nil {
+		return models.SearchPage{}, err
+	}
+
+	page := models.SearchPage{Results: results}
+	if len(results) > limit {
+		page.Results = results[:limit]
+		next := page.Results[limit-1].Message.ID
+		page.Before = &next
+	}
+
+	return page, nil
+}
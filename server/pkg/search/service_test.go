@@ -0,0 +1,89 @@
+package search
+
+import (
+	"errors"
+	"ivar/pkg/database"
+	"ivar/pkg/models"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func results(ids ...int64) []models.SearchResult {
+	found := make([]models.SearchResult, len(ids))
+	for i, id := range ids {
+		found[i] = models.SearchResult{Message: models.Message{ID: id}, Snippet: []models.SnippetPart{{Text: "deploy", Match: true}}}
+	}
+	return found
+}
+
+func TestService_Search_Paged(t *testing.T) {
+	query := models.SearchQuery{Terms: "deploy", From: []string{"alice"}}
+	m := new(database.MockStore)
+	m.On("SearchMessages", "userId", query, int64(0), 3).Return(results(9, 7, 4), nil)
+	m.On("SearchMessages", "userId", query, int64(7), 3).Return(results(4), nil)
+
+	s := Service{m}
+
+	first, err := s.Search("userId", "from:alice deploy", 0, 2)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	if len(first.Results) != 2 || first.Before == nil || *first.Before != 7 {
+		t.Errorf("first page should stop at 7, got: %+v", first)
+	}
+
+	last, err := s.Search("userId", "from:alice deploy", *first.Before, 2)
+	if err != nil {
+		t.Fatalf("error should be nil, got: %v", err)
+	}
+	if len(last.Results) != 1 || last.Before != nil {
+		t.Errorf("last page should have no cursor, got: %+v", last)
+	}
+
+	m.AssertExpectations(t)
+}
+
+func TestService_Search_DefaultLimit(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("SearchMessages", "userId", models.SearchQuery{Terms: "deploy"}, int64(0), defaultPageSize+1).Return(results(), nil)
+
+	s := Service{m}
+
+	page, err := s.Search("userId", "deploy", 0, 0)
+
+	m.AssertExpectations(t)
+
+	if err != nil || page.Before != nil {
+		t.Errorf("an empty page should have no cursor, got: %+v %v", page, err)
+	}
+}
+
+func TestService_Search_InvalidQuery(t *testing.T) {
+	m := new(database.MockStore)
+
+	s := Service{m}
+
+	for _, raw := range []string{"has:balloons", strings.Repeat("deploy ", 100)} {
+		if _, err := s.Search("userId", raw, 0, 0); !errors.Is(err, ErrInvalidQuery) {
+			t.Errorf("error should be ErrInvalidQuery, got: %v", err)
+		}
+	}
+	m.AssertNotCalled(t, "SearchMessages", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestService_Search_Failure(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("SearchMessages", "userId", mock.Anything, int64(0), defaultPageSize+1).Return([]models.SearchResult{}, errors.New("failed"))
+
+	s := Service{m}
+
+	_, err := s.Search("userId", "deploy", 0, 0)
+
+	m.AssertExpectations(t)
+
+	if err == nil || err.Error() != "failed" {
+		t.Errorf("error should be 'failed', got: %v", err)
+	}
+}
@@ -29,6 +29,16 @@ func (s *Service) GetServers() ([]models.Server, error) {
 	return s.Store.GetServers()
 }
 
+// GetMemberServers returns the ids of every server the user is a member of.
+func (s *Service) GetMemberServers(userId string) ([]string, error) {
+	servers, err := s.Store.GetMemberServers(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	return servers, nil
+}
+
 func (s *Service) CreateInvite(serverId int) (string, error) {
 	existingCode, err := s.Store.GetInvite(serverId)
 	if err != nil {
@@ -11,6 +11,11 @@ type Service struct {
 	Store database.Store
 }
 
+const (
+	defaultPageSize = 50
+	maxPageSize     = 100
+)
+
 func (s *Service) Create(id, username string) error {
 	if err := s.Store.CreateUser(id, username); err != nil {
 		return err
@@ -87,11 +92,97 @@ func (s *Service) GetChatInfo(users []string) (models.ChatInfo, error) {
 		return models.ChatInfo{}, err
 	}
 
-	chatMessages, err := s.Store.RetrieveMessages(users)
+	page, err := s.GetMessages(models.MessageQuery{Users: users})
 	if err != nil {
 		return models.ChatInfo{}, err
 	}
-	chatInfo.Messages = chatMessages
+	chatInfo.MessagePage = page
 
 	return chatInfo, nil
 }
+
+// GetMessages returns a page of a DM's history. Each side of the page is asked
+// for with one more message than it holds, to tell whether there's a cursor.
+func (s *Service) GetMessages(query models.MessageQuery) (models.MessagePage, error) {
+	limit := query.Limit
+	if limit <= 0 {
+		limit = defaultPageSize
+	}
+	limit = min(limit, maxPageSize)
+
+	switch {
+	case query.After != 0:
+		messages, err := s.Store.RetrieveMessages(query.Users, 0, query.After, limit+1)
+		if err != nil {
+			return models.MessagePage{}, err
+		}
+		newer := len(messages) > limit
+		if newer {
+			messages = messages[1:]
+		}
+		return newPage(messages, true, newer), nil
+	case query.Around != 0:
+		// the message itself goes with the older half
+		olderLimit, newerLimit := limit-limit/2, limit/2
+		older, err := s.Store.RetrieveMessages(query.Users, query.Around+1, 0, olderLimit+1)
+		if err != nil {
+			return models.MessagePage{}, err
+		}
+		newer, err := s.Store.RetrieveMessages(query.Users, 0, query.Around, newerLimit+1)
+		if err != nil {
+			return models.MessagePage{}, err
+		}
+		hasOlder, hasNewer := len(older) > olderLimit, len(newer) > newerLimit
+		if hasOlder {
+			older = older[:olderLimit]
+		}
+		if hasNewer {
+			newer = newer[1:]
+		}
+		return newPage(append(newer, older...), hasOlder, hasNewer), nil
+	default:
+		messages, err := s.Store.RetrieveMessages(query.Users, query.Before, 0, limit+1)
+		if err != nil {
+			return models.MessagePage{}, err
+		}
+		older := len(messages) > limit
+		if older {
+			messages = messages[:limit]
+		}
+		// whatever came before the cursor, the cursor came after it
+		return newPage(messages, older, query.Before != 0), nil
+	}
+}
+
+func newPage(messages []models.Message, older, newer bool) models.MessagePage {
+	page := models.MessagePage{Messages: messages}
+	if len(messages) == 0 {
+		return page
+	}
+	if older {
+		before := messages[len(messages)-1].ID
+		page.Before = &before
+	}
+	if newer {
+		after := messages[0].ID
+		page.After = &after
+	}
+	return page
+}
+
+func (s *Service) GetPrivacySettings(userId string) (models.PrivacySettings, error) {
+	settings, err := s.Store.GetPrivacySettings(userId)
+	if err != nil {
+		return models.PrivacySettings{}, err
+	}
+
+	return settings, nil
+}
+
+func (s *Service) UpdatePrivacySettings(userId string, settings models.PrivacySettings) error {
+	if err := s.Store.UpdatePrivacySettings(userId, settings); err != nil {
+		return err
+	}
+
+	return nil
+}
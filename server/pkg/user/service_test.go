@@ -4,6 +4,7 @@ import (
 	"errors"
 	"ivar/pkg/database"
 	"ivar/pkg/models"
+	"slices"
 	"testing"
 	"time"
 
@@ -280,7 +281,7 @@ func TestService_GetChatInfo_Success(t *testing.T) {
 		{ID: "user1", Username: "username1"},
 		{ID: "user2", Username: "username2"},
 	}}, nil)
-	m.On("RetrieveMessages", []string{"user1", "user2"}).Return([]models.Message{{ID: 1, Timestamp: time.Now(), Sender: "user1", Recipient: "user2"}}, nil)
+	m.On("RetrieveMessages", []string{"user1", "user2"}, int64(0), int64(0), defaultPageSize+1).Return([]models.Message{{ID: 1, Timestamp: time.Now(), Sender: "user1", Recipient: "user2"}}, nil)
 
 	s := Service{m}
 
@@ -313,7 +314,7 @@ func TestService_GetChatInfo_FailsToFetchMessages_Failure(t *testing.T) {
 		{ID: "user1", Username: "username1"},
 		{ID: "user2", Username: "username2"},
 	}}, nil)
-	m.On("RetrieveMessages", []string{"user1", "user2"}).Return([]models.Message{}, errors.New("failed"))
+	m.On("RetrieveMessages", []string{"user1", "user2"}, int64(0), int64(0), defaultPageSize+1).Return([]models.Message{}, errors.New("failed"))
 	s := Service{m}
 
 	_, err := s.GetChatInfo([]string{"user1", "user2"})
@@ -324,3 +325,150 @@ func TestService_GetChatInfo_FailsToFetchMessages_Failure(t *testing.T) {
 		t.Errorf("error should be 'failed', got: %v", err)
 	}
 }
+
+// history returns messages from..to, newest first.
+func history(from, to int64) []models.Message {
+	messages := []models.Message{}
+	for id := to; id >= from; id-- {
+		messages = append(messages, models.Message{ID: id, Sender: "user1", Recipient: "user2"})
+	}
+	return messages
+}
+
+func TestService_GetMessages_Latest(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("RetrieveMessages", []string{"user1", "user2"}, int64(0), int64(0), 4).Return(history(7, 10), nil)
+	s := Service{m}
+
+	page, err := s.GetMessages(models.MessageQuery{Users: []string{"user1", "user2"}, Limit: 3})
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if len(page.Messages) != 3 || page.Messages[0].ID != 10 {
+		t.Errorf("page should be 10 to 8, got: %v", page.Messages)
+	}
+	if page.Before == nil || *page.Before != 8 {
+		t.Errorf("before should be 8, got: %v", page.Before)
+	}
+	if page.After != nil {
+		t.Errorf("after should be nil, got: %v", *page.After)
+	}
+}
+
+func TestService_GetMessages_Before(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("RetrieveMessages", []string{"user1", "user2"}, int64(3), int64(0), 4).Return(history(1, 2), nil)
+	s := Service{m}
+
+	page, err := s.GetMessages(models.MessageQuery{Users: []string{"user1", "user2"}, Before: 3, Limit: 3})
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if len(page.Messages) != 2 || page.Before != nil {
+		t.Errorf("page should be the last one, got: %+v", page)
+	}
+	if page.After == nil || *page.After != 2 {
+		t.Errorf("after should be 2, got: %v", page.After)
+	}
+}
+
+func TestService_GetMessages_After(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("RetrieveMessages", []string{"user1", "user2"}, int64(0), int64(4), 3).Return(history(5, 7), nil)
+	s := Service{m}
+
+	page, err := s.GetMessages(models.MessageQuery{Users: []string{"user1", "user2"}, After: 4, Limit: 2})
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if len(page.Messages) != 2 || page.Messages[0].ID != 6 || page.Messages[1].ID != 5 {
+		t.Errorf("page should be 6 and 5, got: %v", page.Messages)
+	}
+	if page.After == nil || *page.After != 6 || page.Before == nil || *page.Before != 5 {
+		t.Errorf("cursors should be 5 and 6, got: %v %v", page.Before, page.After)
+	}
+}
+
+func TestService_GetMessages_Around(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("RetrieveMessages", []string{"user1", "user2"}, int64(6), int64(0), 3).Return(history(4, 5), nil)
+	m.On("RetrieveMessages", []string{"user1", "user2"}, int64(0), int64(5), 3).Return(history(6, 8), nil)
+	s := Service{m}
+
+	page, err := s.GetMessages(models.MessageQuery{Users: []string{"user1", "user2"}, Around: 5, Limit: 4})
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	ids := []int64{}
+	for _, message := range page.Messages {
+		ids = append(ids, message.ID)
+	}
+	if !slices.Equal(ids, []int64{7, 6, 5, 4}) {
+		t.Errorf("page should be 7 to 4, got: %v", ids)
+	}
+	if page.Before != nil {
+		t.Errorf("before should be nil, got: %v", *page.Before)
+	}
+	if page.After == nil || *page.After != 7 {
+		t.Errorf("after should be 7, got: %v", page.After)
+	}
+}
+
+func TestService_GetMessages_Failure(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("RetrieveMessages", []string{"user1", "user2"}, int64(0), int64(2), defaultPageSize+1).Return([]models.Message{}, errors.New("failed"))
+	s := Service{m}
+
+	_, err := s.GetMessages(models.MessageQuery{Users: []string{"user1", "user2"}, After: 2})
+
+	m.AssertExpectations(t)
+
+	if err.Error() != "failed" {
+		t.Errorf("error should be 'failed', got: %v", err)
+	}
+}
+
+func TestService_GetPrivacySettings_Success(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("GetPrivacySettings", "userId1").Return(models.PrivacySettings{ReadReceipts: true}, nil)
+
+	s := Service{m}
+
+	settings, err := s.GetPrivacySettings("userId1")
+
+	m.AssertExpectations(t)
+
+	if err != nil {
+		t.Errorf("error should be nil, got: %v", err)
+	}
+	if !settings.ReadReceipts {
+		t.Errorf("read receipts should be on")
+	}
+}
+
+func TestService_UpdatePrivacySettings_Failure(t *testing.T) {
+	m := new(database.MockStore)
+	m.On("UpdatePrivacySettings", "userId1", models.PrivacySettings{ReadReceipts: false}).Return(errors.New("failed"))
+
+	s := Service{m}
+
+	err := s.UpdatePrivacySettings("userId1", models.PrivacySettings{ReadReceipts: false})
+
+	m.AssertExpectations(t)
+
+	if err.Error() != "failed" {
+		t.Errorf("error should be 'failed', got: %v", err)
+	}
+}
@@ -0,0 +1,98 @@
+import { createContext, useCallback, useContext, useEffect, useRef, useState } from 'react';
+import { useAuth } from '@clerk/clerk-react';
+import useWebSocket from 'react-use-websocket';
+import { GatewayEvent, GatewayOp, Hello } from '@/core/models/gateway-event.interface';
+
+// the token goes in the Sec-WebSocket-Protocol header, so it stays out of URLs and logs
+const BEARER_PROTOCOL = 'ivar.bearer';
+const CLOSE_AUTHENTICATION_FAILED = 4001;
+const CLOSE_TOKEN_EXPIRED = 4002;
+
+type Listener = (event: GatewayEvent) => void;
+
+const GatewayContext = createContext<
+  | {
+      sendEvent: (type: string, data: unknown) => void;
+      subscribe: (listener: Listener) => () => void;
+    }
+  | undefined
+>(undefined);
+
+export const GatewayProvider = ({
+  userId,
+  children
+}: {
+  userId: string;
+  children: React.ReactNode;
+}) => {
+  const { getToken } = useAuth();
+  const [token, setToken] = useState<string | null>(null);
+  const listeners = useRef(new Set<Listener>());
+  const heartbeat = useRef<ReturnType<typeof setInterval>>();
+
+  useEffect(() => {
+    if (userId && !token) {
+      getToken({ template: 'gateway' }).then(setToken);
+    }
+  }, [userId, token, getToken]);
+
+  const { sendMessage, sendJsonMessage } = useWebSocket(
+    userId && token ? `${import.meta.env.VITE_SERVICE_WS_URL}/ws/${userId}` : null,
+    {
+      protocols: token ? [BEARER_PROTOCOL, token] : undefined,
+      shouldReconnect: (e) =>
+        e.code !== CLOSE_AUTHENTICATION_FAILED && e.code !== CLOSE_TOKEN_EXPIRED,
+      retryOnError: true,
+      onMessage: (e) => {
+        const event: GatewayEvent = JSON.parse(e.data);
+        if (event.op === GatewayOp.Hello) {
+          const hello = event.d as Hello;
+          sendJsonMessage({ op: GatewayOp.Identify });
+          clearInterval(heartbeat.current);
+          heartbeat.current = setInterval(
+            () => sendJsonMessage({ op: GatewayOp.Heartbeat }),
+            hello.heartbeat_interval
+          );
+          return;
+        }
+        if (event.op === GatewayOp.Dispatch) {
+          listeners.current.forEach((listener) => listener(event));
+        }
+      },
+      onClose: (e) => {
+        clearInterval(heartbeat.current);
+        if (e.code === CLOSE_TOKEN_EXPIRED) {
+          // reconnects with a fresh token once it's fetched
+          setToken(null);
+        }
+      }
+    }
+  );
+
+  useEffect(() => () => clearInterval(heartbeat.current), []);
+
+  const sendEvent = useCallback(
+    (type: string, data: unknown) =>
+      sendMessage(JSON.stringify({ op: GatewayOp.Dispatch, t: type, d: data })),
+    [sendMessage]
+  );
+
+  const subscribe = useCallback((listener: Listener) => {
+    listeners.current.add(listener);
+    return () => {
+      listeners.current.delete(listener);
+    };
+  }, []);
+
+  return (
+    <GatewayContext.Provider value={{ sendEvent, subscribe }}>{children}</GatewayContext.Provider>
+  );
+};
+
+export function useGateway() {
+  const context = useContext(GatewayContext);
+  if (!context) {
+    throw new Error('useGateway must be used within GatewayProvider');
+  }
+  return context;
+}
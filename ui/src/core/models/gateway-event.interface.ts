@@ -0,0 +1,17 @@
+export enum GatewayOp {
+  Dispatch = 0,
+  Heartbeat = 1,
+  Identify = 2,
+  Hello = 10
+}
+
+export interface GatewayEvent<T = unknown> {
+  op: GatewayOp;
+  t?: string;
+  s?: number;
+  d?: T;
+}
+
+export interface Hello {
+  heartbeat_interval: number;
+}
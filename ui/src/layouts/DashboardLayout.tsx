@@ -18,11 +18,11 @@ import {
 import Loader from '@/components/local/Loader/Loader';
 import { useGetChats } from '@/core/service/chat/use-get-chats';
 import { useAppState } from '@/store/provider';
-import useWebSocket from 'react-use-websocket';
 import { Tooltip, TooltipContent, TooltipTrigger } from '@/components/ui/tooltip';
 import CreateServerButton from '@/components/local/Server/CreateServerButton';
 import { useGetServers } from '@/core/service/server/use-get-servers';
 import { Server } from '@/core/models/get-servers.interface';
+import { GatewayProvider } from '@/core/gateway/gateway-provider';
 
 export default function DashboardLayout() {
   const navigate = useNavigate();
@@ -44,12 +44,6 @@ export default function DashboardLayout() {
     }
   }, [user, user?.username, createUser]);
 
-  useWebSocket(`${import.meta.env.VITE_SERVICE_WS_URL}/ws/${currentUser.id}`, {
-    share: true,
-    shouldReconnect: () => true,
-    retryOnError: true
-  });
-
   useEffect(() => {
     if (isError && !isPending) {
       signOut();
@@ -72,7 +66,7 @@ export default function DashboardLayout() {
   }
 
   return (
-    <>
+    <GatewayProvider userId={currentUser.id}>
       <div className='h-full min-w-16 max-w-16 bg-secondary'>
         <div className='flex flex-col h-full py-2 px-1 overflow-y-auto gap-2'>
           {servers?.data.map((server: Server) => (
@@ -179,6 +173,6 @@ export default function DashboardLayout() {
       <div className='flex flex-col h-full w-full min-w-[70%]'>
         <Outlet />
       </div>
-    </>
+    </GatewayProvider>
   );
 }
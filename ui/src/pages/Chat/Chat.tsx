@@ -5,9 +5,9 @@ import { useChatInfo } from '@/core/service/chat/use-get-chat-info';
 import { useIsLoggedIn } from '@/hooks/use-is-logged-in';
 import React, { useEffect, useRef, useState } from 'react';
 import { useParams } from 'react-router-dom';
-import useWebSocket, { ReadyState } from 'react-use-websocket';
 import moment from 'moment';
 import { useAppState } from '@/store/provider';
+import { useGateway } from '@/core/gateway/gateway-provider';
 
 export default function Chat() {
   useIsLoggedIn();
@@ -22,29 +22,25 @@ export default function Chat() {
 
   const { mutate: getChatInfo, data: chatInfo, status } = useChatInfo();
 
-  const { readyState, lastJsonMessage, sendJsonMessage } = useWebSocket(
-    `${import.meta.env.VITE_SERVICE_WS_URL}/ws/${currentUser.id}`,
-    {
-      share: true,
-      shouldReconnect: () => true,
-      retryOnError: true
-    }
-  );
+  const { sendEvent, subscribe } = useGateway();
 
-  useEffect(() => {
-    if (readyState === ReadyState.OPEN) {
-      console.log('opened');
-    }
-  }, [readyState]);
-
-  useEffect(() => {
-    if (lastJsonMessage) {
-      const parsedJson: Message = JSON.parse(JSON.stringify(lastJsonMessage));
-      if (parsedJson.sender === params?.userId) {
-        setMessages((prev) => [parsedJson, ...prev]);
-      }
-    }
-  }, [lastJsonMessage]);
+  useEffect(
+    () =>
+      subscribe((event) => {
+        if (event.t !== 'MESSAGE_CREATE') {
+          return;
+        }
+        const message = event.d as Message;
+        // the other side, or this user on another device
+        if (
+          (message.sender === params?.userId && message.recipient === currentUser.id) ||
+          (message.sender === currentUser.id && message.recipient === params?.userId)
+        ) {
+          setMessages((prev) => [message, ...prev]);
+        }
+      }),
+    [subscribe, params?.userId, currentUser.id]
+  );
 
   useEffect(() => {
     if (currentUser && currentUser.id && params && params.userId) {
@@ -70,7 +66,11 @@ export default function Chat() {
           content: currentValue,
           timestamp: new Date().toISOString()
         };
-        sendJsonMessage(jsonMsg);
+        sendEvent('MESSAGE_CREATE', {
+          recipient: recipient,
+          content: currentValue,
+          nonce: crypto.randomUUID()
+        });
         if (messages.length === 0) {
           dispatch({
             type: 'ADD_CHAT',